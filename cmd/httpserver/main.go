@@ -1,25 +1,41 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"fmt"
-	"httpfromtcp/internal/headers"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/sse"
+	"httpfromtcp/internal/websocket"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const PORT = 42069
 
+var serverMetrics = server.NewMetrics()
+
+var httpbinProxy *server.ReverseProxy
+
+var upgrader = &websocket.Upgrader{EnableCompression: true}
+
 func main() {
-	server, err := server.Serve(PORT, handler)
+	proxy, err := server.NewReverseProxy("https://httpbin.org")
+	if err != nil {
+		log.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.StripPrefix = "/httpbin"
+	httpbinProxy = proxy
+
+	server, err := server.Serve(PORT, handler,
+		server.WithAccessLog(server.NewCombinedLogger(os.Stdout)),
+		server.WithMetrics(serverMetrics),
+		server.WithH2C(),
+	)
 	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
@@ -42,8 +58,14 @@ func handler(w *response.Writer, req *request.Request) {
 		handler500(w, req)
 	case path == "/video":
 		handlerVideo(w, req)
+	case path == "/events":
+		handlerEvents(w, req)
+	case path == "/ws":
+		handlerWebSocket(w, req)
+	case path == "/metrics":
+		serverMetrics.Handler()(w, req)
 	case strings.HasPrefix(path, "/httpbin"):
-		handlerChunked(w, req)
+		httpbinProxy.Handle(w, req)
 	default:
 		handler200(w, req)
 	}
@@ -103,60 +125,69 @@ func handler200(w *response.Writer, _ *request.Request) {
 	w.WriteBody(body)
 }
 
-func handlerChunked(w *response.Writer, req *request.Request) {
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-	resp, err := http.Get("https://httpbin.org/" + target)
+func handlerVideo(w *response.Writer, req *request.Request) {
+	f, err := os.Open("./assets/vim.mp4")
 	if err != nil {
-		handler500(w, nil)
+		handler500(w, req)
+		return
 	}
-	defer resp.Body.Close()
+	defer f.Close()
 
-	hdrs := response.GetDefaultHeaders(0)
-	hdrs.Del("Content-Length")
-	hdrs.Override("Transfer-Encoding", "chunked")
-	hdrs.Override("Trailer", "X-Content-Sha256, X-Content-Length")
+	info, err := f.Stat()
+	if err != nil {
+		handler500(w, req)
+		return
+	}
 
 	w.WriteStatusLine(response.OK)
-	w.WriteHeaders(hdrs)
+	h := response.GetDefaultHeaders(int(info.Size()))
+	h.Override("Content-Type", "video/mp4")
+	w.WriteHeaders(h)
 
-	var fullRespBody bytes.Buffer
-	respBody := make([]byte, 1024)
-	for {
-		n, err := resp.Body.Read(respBody)
-		if n > 0 {
-			w.WriteChunkedBody(respBody[:n])
-			fullRespBody.Write(respBody[:n])
-		}
-		if err != nil {
-			fmt.Printf("Finished streaming with error: %v\n", err)
-			break
-		}
+	if _, err := w.ReadFrom(f); err != nil {
+		log.Printf("error sending video: %v", err)
 	}
+}
 
-	w.WriteChunkedBodyDone()
-
-	sha256Sum := sha256.Sum256(fullRespBody.Bytes())
-
-	trailerHdrs := headers.Headers{
-		"X-Content-Sha256": fmt.Sprintf("%x", sha256Sum),
-		"X-Content-Length": fmt.Sprintf("%d", fullRespBody.Len()),
+func handlerWebSocket(w *response.Writer, req *request.Request) {
+	conn, err := upgrader.Upgrade(w, req)
+	if err != nil {
+		log.Printf("websocket upgrade failed: %v", err)
+		return
 	}
 
-	w.WriteTrailers(trailerHdrs)
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(msgType, data); err != nil {
+			return
+		}
+	}
 }
 
-func handlerVideo(w *response.Writer, req *request.Request) {
-	w.WriteStatusLine(response.OK)
-
-	body, err := os.ReadFile("./assets/vim.mp4")
+// handlerEvents streams a clock tick every second, resuming the count from
+// Last-Event-ID when the client reconnects.
+func handlerEvents(w *response.Writer, req *request.Request) {
+	stream, err := sse.NewStream(w, req)
 	if err != nil {
-		handler500(w, req)
+		log.Printf("event stream failed: %v", err)
 		return
 	}
-
-	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "video/mp4")
-
-	w.WriteHeaders(h)
-	w.WriteBody(body)
+	defer stream.Close()
+	stream.StartHeartbeat(15 * time.Second)
+
+	next, _ := strconv.Atoi(stream.LastEventID())
+	for i := next + 1; i <= next+10; i++ {
+		err := stream.Send(sse.Event{
+			ID:    strconv.Itoa(i),
+			Event: "tick",
+			Data:  time.Now().Format(time.RFC3339),
+		})
+		if err != nil {
+			return
+		}
+		time.Sleep(time.Second)
+	}
 }
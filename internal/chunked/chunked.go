@@ -0,0 +1,64 @@
+package chunked
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// MaxLineBytes bounds a chunk-size line, extensions included. Nothing
+// legitimate comes close; the limit stops a peer from making a parser
+// buffer an endless extension.
+const MaxLineBytes = 4096
+
+var ErrInvalidSize = errors.New("invalid chunk size")
+
+var crlf = []byte("\r\n")
+
+// ParseSize reads a chunk-size line from the start of data, ignoring any
+// chunk extensions, and returns the size and the length of the line with
+// its CRLF. n is 0 while data does not yet hold a complete line.
+func ParseSize(data []byte) (size, n int, err error) {
+	i := bytes.Index(data, crlf)
+	if i == -1 {
+		if len(data) > MaxLineBytes {
+			return 0, 0, fmt.Errorf("%w: line exceeds %d bytes", ErrInvalidSize, MaxLineBytes)
+		}
+		return 0, 0, nil
+	}
+	if i > MaxLineBytes {
+		return 0, 0, fmt.Errorf("%w: line exceeds %d bytes", ErrInvalidSize, MaxLineBytes)
+	}
+
+	line := data[:i]
+	if ext := bytes.IndexByte(line, ';'); ext != -1 {
+		line = line[:ext]
+	}
+	line = bytes.TrimRight(line, " \t")
+
+	if len(line) == 0 || len(line) > 15 {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidSize, line)
+	}
+
+	for _, c := range line {
+		d := unhex(c)
+		if d < 0 {
+			return 0, 0, fmt.Errorf("%w: %q", ErrInvalidSize, line)
+		}
+		size = size<<4 | d
+	}
+
+	return size, i + 2, nil
+}
+
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c-'a') + 10
+	case 'A' <= c && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
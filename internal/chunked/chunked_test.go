@@ -0,0 +1,40 @@
+package chunked
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	// Test: Hex sizes, extensions and trailing whitespace
+	size, n, err := ParseSize([]byte("1aF;name=value\r\nrest"))
+	require.NoError(t, err)
+	assert.Equal(t, 0x1af, size)
+	assert.Equal(t, 16, n)
+
+	size, n, err = ParseSize([]byte("0 \t\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, size)
+	assert.Equal(t, 5, n)
+
+	// Test: An incomplete line needs more data
+	_, n, err = ParseSize([]byte("10;ext"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Test: Invalid sizes
+	for _, line := range []string{"\r\n", ";ext\r\n", "xyz\r\n", "-1\r\n", "0x10\r\n", "1000000000000000\r\n"} {
+		_, _, err = ParseSize([]byte(line))
+		require.ErrorIs(t, err, ErrInvalidSize, line)
+	}
+
+	// Test: Lines over MaxLineBytes are rejected, complete or not
+	ext := strings.Repeat("a", MaxLineBytes)
+	_, _, err = ParseSize([]byte("5;" + ext))
+	require.ErrorIs(t, err, ErrInvalidSize)
+	_, _, err = ParseSize([]byte("5;" + ext + "\r\n"))
+	require.ErrorIs(t, err, ErrInvalidSize)
+}
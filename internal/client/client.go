@@ -0,0 +1,497 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMaxIdleConnsPerHost = 4
+	defaultIdleTimeout         = 90 * time.Second
+	defaultDialTimeout         = 10 * time.Second
+	closeDrainBytes            = 4 << 10
+)
+
+// Responses are parsed by package response; its errors are repeated here
+// for callers of the client.
+var (
+	ErrMalformedStatusLine = response.ErrMalformedStatusLine
+	ErrHeaderTooLarge      = response.ErrHeaderTooLarge
+	ErrInvalidChunk        = response.ErrInvalidChunk
+)
+
+type Request struct {
+	Method  string
+	URL     *url.URL
+	Headers headers.Headers
+	Body    io.Reader
+	// ContentLength is the length of Body. -1 means unknown, in which case
+	// the body is sent chunked.
+	ContentLength int64
+}
+
+// NewRequest builds a request for rawURL. If body is a *bytes.Reader,
+// *bytes.Buffer or *strings.Reader its length is filled in; otherwise the
+// body is sent chunked.
+func NewRequest(method, rawURL string, body io.Reader) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	req := &Request{
+		Method:  method,
+		URL:     u,
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}
+
+	switch b := body.(type) {
+	case nil:
+		req.ContentLength = 0
+	case *bytes.Reader:
+		req.ContentLength = int64(b.Len())
+	case *bytes.Buffer:
+		req.ContentLength = int64(b.Len())
+	case *strings.Reader:
+		req.ContentLength = int64(b.Len())
+	default:
+		req.ContentLength = -1
+	}
+
+	return req, nil
+}
+
+type Response struct {
+	StatusCode int
+	Reason     string
+	// HttpVersion is the version from the status line, such as "1.1".
+	HttpVersion string
+	Headers     headers.Headers
+	// Trailers is filled in once Body has been read to EOF.
+	Trailers headers.Headers
+	// ContentLength is -1 when the length is not known in advance.
+	ContentLength int64
+	Body          io.ReadCloser
+}
+
+// Client sends HTTP/1.1 requests and keeps idle connections open for reuse.
+// It is safe for concurrent use.
+type Client struct {
+	MaxIdleConnsPerHost   int
+	IdleTimeout           time.Duration
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	TLSConfig             *tls.Config
+
+	mu   sync.Mutex
+	idle map[string][]*persistConn
+}
+
+func NewClient() *Client {
+	return &Client{
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		IdleTimeout:         defaultIdleTimeout,
+		DialTimeout:         defaultDialTimeout,
+	}
+}
+
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends req and reads the response header. The caller must read Body
+// to EOF and close it for the connection to be reused.
+func (c *Client) Do(req *Request) (*Response, error) {
+	key := connKey(req.URL)
+
+	pc, reused, err := c.getConn(key, req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, closed, err := c.roundTrip(pc, req)
+	if err != nil && closed && reused && req.Body == nil && idempotent(req.Method) {
+		// An idle connection may have been closed by the server. The
+		// request may still have reached it, so only a request that is
+		// safe to repeat is retried on a fresh one.
+		pc, _, err = c.dialConn(key, req.URL)
+		if err != nil {
+			return nil, err
+		}
+		resp, _, err = c.roundTrip(pc, req)
+	}
+
+	return resp, err
+}
+
+// CloseIdleConnections closes every pooled connection.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+	}
+}
+
+// roundTrip sends req on pc and reads the response header. closed reports
+// that a failure came from the connection ending before any response byte
+// arrived, as when the server closed an idle connection.
+func (c *Client) roundTrip(pc *persistConn, req *Request) (resp *Response, closed bool, err error) {
+	if err := writeRequest(pc.bw, req); err != nil {
+		pc.conn.Close()
+		return nil, connClosed(err), err
+	}
+
+	if c.ResponseHeaderTimeout > 0 {
+		pc.conn.SetReadDeadline(time.Now().Add(c.ResponseHeaderTimeout))
+	}
+
+	_, peekErr := pc.br.Peek(1)
+	r, err := pc.rr.ReadHeader(req.Method)
+	if err != nil {
+		pc.conn.Close()
+		return nil, peekErr != nil && connClosed(peekErr), err
+	}
+	pc.conn.SetReadDeadline(time.Time{})
+
+	resp = &Response{
+		StatusCode:    int(r.StatusLine.StatusCode),
+		Reason:        r.StatusLine.ReasonPhrase,
+		HttpVersion:   r.StatusLine.HttpVersion,
+		Headers:       r.Headers,
+		Trailers:      r.Trailers,
+		ContentLength: r.ContentLength,
+	}
+
+	// A body that runs until the connection closes leaves nothing to reuse.
+	// Nor does one framed by both Content-Length and Transfer-Encoding: a
+	// proxy on the way may have split the stream differently. After a 101
+	// the connection speaks another protocol.
+	_, hasLength := r.Headers["content-length"]
+	_, hasCoding := r.Headers["transfer-encoding"]
+	reusable := keepAlive(resp) && r.State != response.ResponseStateCloseDelimited && !(hasLength && hasCoding) &&
+		r.StatusLine.StatusCode != response.SwitchingProtocols
+
+	resp.Body = &bodyCloser{
+		r: pc.rr.BodyReader(r),
+		done: func(ok bool) {
+			if ok && reusable {
+				c.putConn(pc)
+				return
+			}
+			pc.conn.Close()
+		},
+	}
+
+	return resp, false, nil
+}
+
+// connClosed reports whether err is the peer closing or resetting the
+// connection. A timeout is not: the server may still be working on the
+// request.
+func connClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// idempotent reports whether repeating a request with method has the same
+// effect as sending it once (RFC 9110 section 9.2.2).
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+type persistConn struct {
+	key      string
+	conn     net.Conn
+	br       *bufio.Reader
+	rr       *response.Reader
+	bw       *bufio.Writer
+	idleFrom time.Time
+}
+
+func connKey(u *url.URL) string {
+	return u.Scheme + "://" + hostPort(u)
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func (c *Client) getConn(key string, u *url.URL) (*persistConn, bool, error) {
+	c.mu.Lock()
+	for len(c.idle[key]) > 0 {
+		conns := c.idle[key]
+		pc := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+
+		if c.IdleTimeout > 0 && time.Since(pc.idleFrom) > c.IdleTimeout {
+			pc.conn.Close()
+			continue
+		}
+
+		c.mu.Unlock()
+		return pc, true, nil
+	}
+	c.mu.Unlock()
+
+	return c.dialConn(key, u)
+}
+
+func (c *Client) dialConn(key string, u *url.URL) (*persistConn, bool, error) {
+	dialer := &net.Dialer{Timeout: c.DialTimeout}
+	conn, err := dialer.Dial("tcp", hostPort(u))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if u.Scheme == "https" {
+		cfg := &tls.Config{}
+		if c.TLSConfig != nil {
+			cfg = c.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		if len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{"http/1.1"}
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+		conn = tlsConn
+	}
+
+	br := bufio.NewReader(conn)
+	return &persistConn{
+		key:  key,
+		conn: conn,
+		br:   br,
+		rr:   response.NewReader(br),
+		bw:   bufio.NewWriter(conn),
+	}, false, nil
+}
+
+func (c *Client) putConn(pc *persistConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	max := c.MaxIdleConnsPerHost
+	if max <= 0 {
+		max = defaultMaxIdleConnsPerHost
+	}
+
+	if c.idle == nil {
+		c.idle = make(map[string][]*persistConn)
+	}
+	if len(c.idle[pc.key]) >= max {
+		pc.conn.Close()
+		return
+	}
+
+	pc.idleFrom = time.Now()
+	c.idle[pc.key] = append(c.idle[pc.key], pc)
+}
+
+func writeRequest(bw *bufio.Writer, req *Request) error {
+	if req.ContentLength > 0 && req.Body == nil {
+		return fmt.Errorf("content length is %d but the request has no body", req.ContentLength)
+	}
+
+	target := req.URL.RequestURI()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", req.Method, target)
+
+	h := headers.NewHeaders()
+	for key, value := range req.Headers {
+		h[key] = value
+	}
+	if h.Get("Host") == "" {
+		h.Override("Host", req.URL.Host)
+	}
+	h.Del("Content-Length")
+	h.Del("Transfer-Encoding")
+
+	chunked := false
+	switch {
+	case req.ContentLength > 0:
+		h.Override("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	case req.ContentLength < 0 && req.Body != nil:
+		h.Override("Transfer-Encoding", "chunked")
+		chunked = true
+	case req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH":
+		h.Override("Content-Length", "0")
+	}
+
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	for key, value := range h {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	b.WriteString("\r\n")
+
+	if _, err := bw.WriteString(b.String()); err != nil {
+		return err
+	}
+
+	switch {
+	case chunked:
+		if err := writeChunked(bw, req.Body); err != nil {
+			return err
+		}
+	case req.ContentLength > 0:
+		n, err := writeBody(bw, io.LimitReader(req.Body, req.ContentLength))
+		if err != nil {
+			return err
+		}
+		if n != req.ContentLength {
+			return fmt.Errorf("request body is %d bytes, content length is %d", n, req.ContentLength)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// writeBody sends body as it is read, so that a body still arriving from
+// elsewhere, such as a proxied request, is not held back in bw.
+func writeBody(bw *bufio.Writer, body io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			bw.Write(buf[:n])
+			if ferr := bw.Flush(); ferr != nil {
+				return written, ferr
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// writeChunked is writeBody with each read sent as a chunk.
+func writeChunked(bw *bufio.Writer, body io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%x\r\n", n)
+			bw.Write(buf[:n])
+			bw.WriteString("\r\n")
+			if ferr := bw.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := bw.WriteString("0\r\n\r\n")
+	return err
+}
+
+func keepAlive(resp *Response) bool {
+	conn := resp.Headers.Get("Connection")
+	if resp.HttpVersion == "1.0" {
+		return headers.HasToken(conn, "keep-alive")
+	}
+	return !headers.HasToken(conn, "close")
+}
+
+// bodyCloser returns the connection to the pool once the body has been
+// read to EOF, or closes it if the body is abandoned or fails.
+type bodyCloser struct {
+	r        io.Reader
+	done     func(ok bool)
+	finished bool
+	mu       sync.Mutex
+}
+
+func (b *bodyCloser) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.finished {
+		return 0, io.EOF
+	}
+
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.finish(true)
+	} else if err != nil {
+		b.finish(false)
+	}
+	return n, err
+}
+
+// Close drains a small remainder so that short or empty bodies still leave
+// a reusable connection; anything longer closes the connection instead.
+func (b *bodyCloser) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.finished {
+		return nil
+	}
+
+	_, err := io.CopyN(io.Discard, b.r, closeDrainBytes)
+	b.finish(err == io.EOF)
+	return nil
+}
+
+func (b *bodyCloser) finish(ok bool) {
+	if b.finished {
+		return
+	}
+	b.finished = true
+	b.done(ok)
+}
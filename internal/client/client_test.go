@@ -0,0 +1,295 @@
+package client
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedServer answers each request with the raw bytes returned by
+// respond, closing the connection when close is true.
+type scriptedServer struct {
+	ln       net.Listener
+	accepted atomic.Int32
+	requests chan *request.Request
+}
+
+func newScriptedServer(t *testing.T, respond func(req *request.Request) (raw string, close bool)) *scriptedServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &scriptedServer{ln: ln, requests: make(chan *request.Request, 16)}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.accepted.Add(1)
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := request.NewReader(conn)
+				for {
+					req, err := reader.ReadRequest()
+					if err != nil {
+						return
+					}
+					s.requests <- req
+					raw, closeConn := respond(req)
+					io.WriteString(conn, raw)
+					if closeConn {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *scriptedServer) url(path string) string {
+	return "http://" + s.ln.Addr().String() + path
+}
+
+func readBody(t *testing.T, resp *Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(body)
+}
+
+func TestClientFraming(t *testing.T) {
+	s := newScriptedServer(t, func(req *request.Request) (string, bool) {
+		switch req.RequestLine.RequestTarget {
+		case "/length":
+			return "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", false
+		case "/chunked":
+			return "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+				"6;ext=1\r\nhello \r\n5\r\nworld\r\n0\r\nX-Checksum: abc\r\n\r\n", false
+		case "/close":
+			return "HTTP/1.0 200 OK\r\n\r\nuntil the end", true
+		case "/continue":
+			return "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok", false
+		case "/both":
+			return "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n", false
+		case "/nocontent":
+			return "HTTP/1.1 204 No Content\r\n\r\n", false
+		default:
+			return "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n", false
+		}
+	})
+	c := NewClient()
+	defer c.CloseIdleConnections()
+
+	// Test: Content-Length body
+	resp, err := c.Get(s.url("/length"))
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "OK", resp.Reason)
+	assert.Equal(t, int64(5), resp.ContentLength)
+	assert.Equal(t, "hello", readBody(t, resp))
+
+	// Test: Chunked body with extension and trailers
+	resp, err = c.Get(s.url("/chunked"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "hello world", readBody(t, resp))
+	assert.Equal(t, "abc", resp.Trailers.Get("X-Checksum"))
+
+	// Test: 1xx interim responses are skipped
+	resp, err = c.Get(s.url("/continue"))
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "ok", readBody(t, resp))
+
+	// Test: 204 has no body
+	resp, err = c.Get(s.url("/nocontent"))
+	require.NoError(t, err)
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Empty(t, readBody(t, resp))
+
+	// Test: Everything so far reused a single connection
+	assert.Equal(t, int32(1), s.accepted.Load())
+
+	// Test: Close-delimited body reads to EOF and the connection is dropped
+	resp, err = c.Get(s.url("/close"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", resp.HttpVersion)
+	assert.Equal(t, "until the end", readBody(t, resp))
+
+	resp, err = c.Get(s.url("/length"))
+	require.NoError(t, err)
+	readBody(t, resp)
+	assert.Equal(t, int32(2), s.accepted.Load())
+
+	// Test: Chunked wins over Content-Length, but the connection is dropped
+	resp, err = c.Get(s.url("/both"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+
+	resp, err = c.Get(s.url("/length"))
+	require.NoError(t, err)
+	readBody(t, resp)
+	assert.Equal(t, int32(3), s.accepted.Load())
+}
+
+func TestClientRequestWriting(t *testing.T) {
+	s := newScriptedServer(t, func(req *request.Request) (string, bool) {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false
+	})
+	c := NewClient()
+	defer c.CloseIdleConnections()
+
+	// Test: Known-length body sends Content-Length
+	req, err := NewRequest("POST", s.url("/submit?x=1"), strings.NewReader("hello"))
+	require.NoError(t, err)
+	req.Headers.Set("X-Test", "yes")
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	readBody(t, resp)
+
+	got := <-s.requests
+	assert.Equal(t, "POST", got.RequestLine.Method)
+	assert.Equal(t, "/submit?x=1", got.RequestLine.RequestTarget)
+	assert.Equal(t, s.ln.Addr().String(), got.Headers.Get("Host"))
+	assert.Equal(t, "5", got.Headers.Get("Content-Length"))
+	assert.Equal(t, "yes", got.Headers.Get("X-Test"))
+	assert.Equal(t, "hello", string(got.Body))
+
+	// Test: Unknown-length body is sent chunked
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, "streamed ")
+		io.WriteString(pw, "body")
+		pw.Close()
+	}()
+	req, err = NewRequest("PUT", s.url("/stream"), pr)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	readBody(t, resp)
+
+	got = <-s.requests
+	assert.Equal(t, "chunked", got.Headers.Get("Transfer-Encoding"))
+	assert.Equal(t, "streamed body", string(got.Body))
+
+	// Test: A declared length without a body is an error, not a panic
+	req, err = NewRequest("POST", s.url("/"), nil)
+	require.NoError(t, err)
+	req.ContentLength = 5
+	_, err = c.Do(req)
+	require.Error(t, err)
+
+	// Test: Header injection is refused before anything is sent
+	req, err = NewRequest("GET", s.url("/"), nil)
+	require.NoError(t, err)
+	req.Headers.Set("X-Bad", "a\r\nInjected: 1")
+	_, err = c.Do(req)
+	require.Error(t, err)
+}
+
+func TestClientStaleConnectionRetry(t *testing.T) {
+	// The server closes every connection after responding but advertises
+	// keep-alive, so the pooled connection is always stale.
+	s := newScriptedServer(t, func(req *request.Request) (string, bool) {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", true
+	})
+	c := NewClient()
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(s.url("/"))
+		require.NoError(t, err)
+		assert.Equal(t, "ok", readBody(t, resp))
+	}
+	assert.Equal(t, int32(3), s.accepted.Load())
+
+	// Test: Other idempotent methods are retried too
+	req, err := NewRequest("DELETE", s.url("/"), nil)
+	require.NoError(t, err)
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+	assert.Equal(t, int32(4), s.accepted.Load())
+
+	// Test: A POST is not retried, since the server may have processed it
+	req, err = NewRequest("POST", s.url("/"), nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	require.Error(t, err)
+	assert.Equal(t, int32(4), s.accepted.Load())
+}
+
+func TestClientNoRetryAfterResponse(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := newScriptedServer(t, func(req *request.Request) (string, bool) {
+		switch req.RequestLine.RequestTarget {
+		case "/slow":
+			<-release
+		case "/partial":
+			return "HTTP/1.1 200 OK\r\nContent-", true
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", false
+	})
+	c := NewClient()
+	c.ResponseHeaderTimeout = 50 * time.Millisecond
+	defer c.CloseIdleConnections()
+
+	// Test: A response header timeout on a reused connection is not retried
+	resp, err := c.Get(s.url("/"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+	_, err = c.Get(s.url("/slow"))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, int32(1), s.accepted.Load())
+	assert.Len(t, s.requests, 2)
+
+	// Test: Nor is a connection that ended partway through the response
+	<-s.requests
+	<-s.requests
+	resp, err = c.Get(s.url("/"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+	_, err = c.Get(s.url("/partial"))
+	require.ErrorIs(t, err, response.ErrIncompleteResponse)
+	assert.Equal(t, int32(2), s.accepted.Load())
+	assert.Len(t, s.requests, 2)
+}
+
+func TestClientSwitchingProtocols(t *testing.T) {
+	s := newScriptedServer(t, func(req *request.Request) (string, bool) {
+		if req.RequestLine.RequestTarget == "/upgrade" {
+			return "HTTP/1.1 101 Switching Protocols\r\nConnection: upgrade\r\nUpgrade: test\r\n\r\n", false
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", false
+	})
+	c := NewClient()
+	defer c.CloseIdleConnections()
+
+	// Test: A connection that switched protocols is not pooled
+	resp, err := c.Get(s.url("/upgrade"))
+	require.NoError(t, err)
+	assert.Equal(t, 101, resp.StatusCode)
+	readBody(t, resp)
+	resp, err = c.Get(s.url("/"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+	assert.Equal(t, int32(2), s.accepted.Load())
+}
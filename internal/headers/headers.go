@@ -1,53 +1,215 @@
 package headers
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"regexp"
 	"strings"
 )
 
 type Headers map[string]string
 
+var (
+	// ErrMalformedHeader is returned for a header line without a colon.
+	ErrMalformedHeader = errors.New("malformed header line")
+	// ErrWhitespaceBeforeColon is returned when a field name is followed by
+	// whitespace before the colon (RFC 9112 section 5.1).
+	ErrWhitespaceBeforeColon = errors.New("whitespace between header name and colon")
+	// ErrObsFold is returned when a header line starts with whitespace, which
+	// is the obsolete line folding syntax (RFC 9112 section 5.2).
+	ErrObsFold = errors.New("obsolete line folding in header")
+	// ErrInvalidFieldName is returned by Validate for a name that is not a
+	// valid token.
+	ErrInvalidFieldName = errors.New("invalid header field name")
+	// ErrInvalidFieldValue is returned by Parse and Validate for a value
+	// containing CR, LF, NUL or other control characters.
+	ErrInvalidFieldValue = errors.New("invalid header field value")
+)
+
+// tokenTable marks the characters allowed in a token (RFC 9110 section
+// 5.6.2).
+var tokenTable = func() (t [256]bool) {
+	for c := '0'; c <= '9'; c++ {
+		t[c] = true
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		t[c] = true
+		t[c-'a'+'A'] = true
+	}
+	for _, c := range "!#$%&'*+-.^_`|~" {
+		t[c] = true
+	}
+	return t
+}()
+
+// commonFields holds the lowercase names of frequent fields so that parsing
+// them does not allocate a new key.
+var commonFields = func() map[string]string {
+	m := map[string]string{}
+	for _, name := range []string{
+		"accept", "accept-encoding", "accept-language", "authorization",
+		"cache-control", "connection", "content-length", "content-type",
+		"cookie", "host", "if-modified-since", "if-none-match", "origin",
+		"range", "referer", "te", "trailer", "transfer-encoding", "upgrade",
+		"user-agent", "x-forwarded-for", "x-forwarded-proto", "x-request-id",
+	} {
+		m[name] = name
+	}
+	return m
+}()
+
+var crlf = []byte("\r\n")
+
+// Parse reads one field line from data. It returns n == 0 when data does
+// not yet hold a complete line, and done once the empty line ending the
+// section has been consumed.
 func (h Headers) Parse(data []byte) (n int, done bool, err error) {
-	i := strings.Index(string(data), "\r\n")
+	i := bytes.Index(data, crlf)
 	if i == -1 {
 		return 0, false, nil
 	}
 
-	headersLine := string(data[:i])
+	line := data[:i]
 	n = i + 2
 
-	if headersLine == "" || i == 0 {
+	if len(line) == 0 {
 		return n, true, nil
 	}
 
-	headersLine = strings.TrimSpace(headersLine)
+	if isOWS(line[0]) {
+		return 0, false, fmt.Errorf("%w: %q", ErrObsFold, line)
+	}
 
-	k, v, ok := strings.Cut(headersLine, ":")
-	if !ok {
-		return 0, false, fmt.Errorf("invalid header format: %s", headersLine)
+	line = trimOWS(line)
+
+	colon := bytes.IndexByte(line, ':')
+	if colon == -1 {
+		return 0, false, fmt.Errorf("%w: %q", ErrMalformedHeader, line)
 	}
+	k, v := line[:colon], trimOWS(line[colon+1:])
 
-	if strings.Contains(k, " ") {
-		return 0, false, fmt.Errorf("invalid header key spacing: %s", k)
+	if len(k) > 0 && isOWS(k[len(k)-1]) {
+		return 0, false, fmt.Errorf("%w: %q", ErrWhitespaceBeforeColon, k)
 	}
 
-	v = strings.TrimSpace(v)
+	if !validToken(k) {
+		return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldName, k)
+	}
 
-	regexpKey := regexp.MustCompile(`^[a-zA-Z0-9!#$%&'*+.^_` + "`" + `|~-]+$`)
-	if !regexpKey.MatchString(k) {
-		return 0, false, fmt.Errorf("invalid header key: %s", k)
+	if !validFieldValue(v) {
+		return 0, false, fmt.Errorf("%w: %q: %q", ErrInvalidFieldValue, k, v)
 	}
 
-	key := strings.ToLower(k)
-	if prev, ok := h[key]; ok && prev != "" {
-		v = prev + ", " + v
+	// Repeated fields are merged even when a value is empty, so that a
+	// field's presence is never lost: "Content-Length:" followed by
+	// "Content-Length: 5" must not read as a single valid length.
+	key := fieldKey(k)
+	value := string(v)
+	if prev, ok := h[key]; ok {
+		value = prev + ", " + value
 	}
-	h[key] = v
+	h[key] = value
 
 	return n, false, nil
 }
 
+// fieldKey returns the lowercase form of name, reusing the interned string
+// for common fields.
+func fieldKey(name []byte) string {
+	var buf [32]byte
+	if len(name) > len(buf) {
+		return strings.ToLower(string(name))
+	}
+
+	lower := buf[:len(name)]
+	for i, c := range name {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+
+	if key, ok := commonFields[string(lower)]; ok {
+		return key
+	}
+	return string(lower)
+}
+
+func isOWS(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// trimOWS removes optional whitespace, which is only SP and HTAB (RFC 9110
+// section 5.6.3).
+func trimOWS(b []byte) []byte {
+	for len(b) > 0 && isOWS(b[0]) {
+		b = b[1:]
+	}
+	for len(b) > 0 && isOWS(b[len(b)-1]) {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+func validToken[T string | []byte](s T) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !tokenTable[s[i]] {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks every field before it is written to the wire, so a value
+// echoed from user input cannot inject extra header lines or split the
+// response.
+func (h Headers) Validate() error {
+	for key, value := range h {
+		if err := ValidateField(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateField checks a single field name and value.
+func ValidateField(key, value string) error {
+	if !validToken(key) {
+		return fmt.Errorf("%w: %q", ErrInvalidFieldName, key)
+	}
+
+	if !validFieldValue(value) {
+		return fmt.Errorf("%w: %q: %q", ErrInvalidFieldValue, key, value)
+	}
+
+	return nil
+}
+
+// validFieldValue rejects control characters other than HTAB.
+func validFieldValue[T string | []byte](value T) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// HasToken reports whether a comma-separated field value such as Connection
+// contains token, compared case-insensitively.
+func HasToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h Headers) Set(key string, value string) {
 	key = strings.ToLower(key)
 	v, ok := h[key]
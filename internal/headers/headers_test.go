@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,16 +19,23 @@ func TestHeaderParse(t *testing.T) {
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
-	// Test: Valid single header with exrta spaces
+	// Test: Valid single header with extra spaces around the value
 	headers = NewHeaders()
-	data = []byte("     Host:      localhost:42069     \r\n\r\n")
+	data = []byte("Host:      localhost:42069     \r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
 	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, 38, n)
+	assert.Equal(t, 33, n)
 	assert.False(t, done)
 
+	// Test: Leading whitespace is obs-fold even on the first line
+	headers = NewHeaders()
+	data = []byte("     Host: localhost:42069\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrObsFold)
+	assert.Empty(t, headers)
+
 	// Test: Valid 2 headers with existing headers
 	headers = NewHeaders()
 	data = []byte("Host: localhost:42069\r\nUser-Agent: test\r\n\r\n")
@@ -85,4 +93,139 @@ func TestHeaderParse(t *testing.T) {
 	require.Error(t, err)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
+
+	// Test: Whitespace before colon
+	headers = NewHeaders()
+	data = []byte("Host\t: localhost:42069\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrWhitespaceBeforeColon)
+
+	// Test: Obsolete line folding
+	headers = NewHeaders()
+	data = []byte("X-Long: first\r\n  second\r\n\r\n")
+	n, _, err = headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[n:])
+	require.ErrorIs(t, err, ErrObsFold)
+
+	// Test: Repeated fields merge even when the first value is empty
+	headers = NewHeaders()
+	data = []byte("Content-Length:\r\nContent-Length: 5\r\n\r\n")
+	n, _, err = headers.Parse(data)
+	require.NoError(t, err)
+	value, ok := headers["content-length"]
+	assert.True(t, ok)
+	assert.Empty(t, value)
+	_, _, err = headers.Parse(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, ", 5", headers["content-length"])
+
+	// Test: Control characters in a value
+	headers = NewHeaders()
+	_, _, err = headers.Parse([]byte("X-Nul: a\x00b\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidFieldValue)
+	_, _, err = headers.Parse([]byte("X-Cr: a\rb\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidFieldValue)
+
+	// Test: Validate accepts well-formed fields
+	headers = Headers{"content-type": "text/plain", "x-note": "a\tb"}
+	require.NoError(t, headers.Validate())
+
+	// Test: Validate rejects CRLF injection in a value
+	headers = Headers{"x-echo": "hi\r\nSet-Cookie: admin=1"}
+	require.ErrorIs(t, headers.Validate(), ErrInvalidFieldValue)
+
+	// Test: Validate rejects NUL in a value
+	require.ErrorIs(t, ValidateField("x-echo", "a\x00b"), ErrInvalidFieldValue)
+
+	// Test: Validate rejects an invalid name
+	require.ErrorIs(t, ValidateField("x echo", "ok"), ErrInvalidFieldName)
+	require.ErrorIs(t, ValidateField("x-echo\r\n", "ok"), ErrInvalidFieldName)
+}
+
+// parseFields feeds data to h.Parse the way the request parser does,
+// handing over chunks of at most chunkSize(remaining) bytes whenever Parse
+// needs more input.
+func parseFields(h Headers, data []byte, chunkSize func(remaining int) int) (bool, error) {
+	var buf []byte
+	for {
+		n, done, err := h.Parse(buf)
+		if err != nil || done {
+			return done, err
+		}
+		buf = buf[n:]
+
+		if n == 0 {
+			if len(data) == 0 {
+				return false, nil
+			}
+			size := chunkSize(len(data))
+			buf = append(buf, data[:size]...)
+			data = data[size:]
+		}
+	}
+}
+
+func FuzzHeadersParse(f *testing.F) {
+	seeds := []string{
+		"Host: localhost:42069\r\n\r\n",
+		"Host: localhost:42069\r\nUser-Agent: test\r\nAccept: */*\r\n\r\n",
+		"     Host:      localhost:42069     \r\n\r\n",
+		"Set-Person: lane\r\nSet-Person: prime\r\n\r\n",
+		"X-Empty:\r\nX-Empty: a\r\n\r\n",
+		"Host : localhost\r\n\r\n",
+		"H\u00a9st: localhost\r\n\r\n",
+		"Host localhost\r\n\r\n",
+		"A: b\r\n c\r\n\r\n",
+		"A: b\r\n\tc\r\n\r\n",
+		"A: b\x00c\r\n\r\n",
+		"A: b\rc\r\n\r\n",
+		"A: b\nC: d\r\n\r\n",
+		"\r\n",
+		":\r\n\r\n",
+	}
+	for i, seed := range seeds {
+		f.Add([]byte(seed), int64(i))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, seed int64) {
+		want := NewHeaders()
+		wantDone, wantErr := parseFields(want, data, func(remaining int) int { return remaining })
+
+		rng := rand.New(rand.NewSource(seed))
+		splits := []func(int) int{
+			func(int) int { return 1 },
+			func(remaining int) int { return 1 + rng.Intn(remaining) },
+		}
+		for _, split := range splits {
+			got := NewHeaders()
+			done, err := parseFields(got, data, split)
+			if wantErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, wantErr.Error(), err.Error())
+				continue
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, wantDone, done)
+			assert.Equal(t, want, got)
+		}
+	})
+}
+
+func BenchmarkHeadersParse(b *testing.B) {
+	data := []byte("Host: example.com\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0\r\n" +
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+		"Accept-Language: en-US,en;q=0.5\r\n" +
+		"X-Custom-Header: value\r\n\r\n")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		h := NewHeaders()
+		if _, err := parseFields(h, data, func(remaining int) int { return remaining }); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,303 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface starts every HTTP/2 connection (RFC 9113 section 3.4).
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	frameHeaderLen      = 9
+	defaultMaxFrameSize = 16384
+	maxFrameSizeLimit   = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+const (
+	FlagEndStream  uint8 = 0x1
+	FlagAck        uint8 = 0x1
+	FlagEndHeaders uint8 = 0x4
+	FlagPadded     uint8 = 0x8
+	FlagPriority   uint8 = 0x20
+)
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+// ErrCode is carried by RST_STREAM and GOAWAY (RFC 9113 section 7).
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code %#x", uint32(c))
+}
+
+// ConnError is a connection error: the connection is closed after GOAWAY.
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %s: %s", e.Code, e.Reason)
+}
+
+// StreamError is a stream error: the stream is reset and the connection
+// carries on.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %s: %s", e.StreamID, e.Code, e.Reason)
+}
+
+func connError(code ErrCode, format string, args ...any) error {
+	return ConnError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func streamError(id uint32, code ErrCode, format string, args ...any) error {
+	return StreamError{StreamID: id, Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+type FrameHeader struct {
+	Length   uint32
+	Type     FrameType
+	Flags    uint8
+	StreamID uint32
+}
+
+func (h FrameHeader) Has(flag uint8) bool {
+	return h.Flags&flag != 0
+}
+
+// Framer reads and writes frames on one connection. Reads and writes may
+// happen concurrently; concurrent writers must be serialised by the caller.
+type Framer struct {
+	r io.Reader
+	w *bufio.Writer
+
+	// MaxReadFrameSize is the largest payload accepted, our
+	// SETTINGS_MAX_FRAME_SIZE.
+	MaxReadFrameSize uint32
+
+	header [frameHeaderLen]byte
+	buf    []byte
+}
+
+func NewFramer(w io.Writer, r io.Reader) *Framer {
+	return &Framer{
+		r:                r,
+		w:                bufio.NewWriterSize(w, 4*defaultMaxFrameSize),
+		MaxReadFrameSize: defaultMaxFrameSize,
+	}
+}
+
+// ReadFrame reads the next frame. The payload is only valid until the next
+// call.
+func (f *Framer) ReadFrame() (FrameHeader, []byte, error) {
+	if _, err := io.ReadFull(f.r, f.header[:]); err != nil {
+		return FrameHeader{}, nil, err
+	}
+
+	h := FrameHeader{
+		Length:   uint32(f.header[0])<<16 | uint32(f.header[1])<<8 | uint32(f.header[2]),
+		Type:     FrameType(f.header[3]),
+		Flags:    f.header[4],
+		StreamID: binary.BigEndian.Uint32(f.header[5:]) & (1<<31 - 1),
+	}
+
+	if h.Length > f.MaxReadFrameSize {
+		return h, nil, connError(ErrCodeFrameSize, "frame of %d bytes exceeds %d", h.Length, f.MaxReadFrameSize)
+	}
+
+	if cap(f.buf) < int(h.Length) {
+		f.buf = make([]byte, h.Length)
+	}
+	payload := f.buf[:h.Length]
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return h, nil, err
+	}
+
+	return h, payload, nil
+}
+
+// WriteFrame buffers a frame; call Flush to send it.
+func (f *Framer) WriteFrame(typ FrameType, flags uint8, streamID uint32, payload []byte) error {
+	var hdr [frameHeaderLen]byte
+	hdr[0] = byte(len(payload) >> 16)
+	hdr[1] = byte(len(payload) >> 8)
+	hdr[2] = byte(len(payload))
+	hdr[3] = byte(typ)
+	hdr[4] = flags
+	binary.BigEndian.PutUint32(hdr[5:], streamID&(1<<31-1))
+
+	if _, err := f.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := f.w.Write(payload)
+	return err
+}
+
+func (f *Framer) Flush() error {
+	return f.w.Flush()
+}
+
+func (f *Framer) WriteSettings(settings ...Setting) error {
+	payload := make([]byte, 0, 6*len(settings))
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Value)
+	}
+	return f.WriteFrame(FrameSettings, 0, 0, payload)
+}
+
+func (f *Framer) WriteWindowUpdate(streamID, increment uint32) error {
+	return f.WriteFrame(FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+func (f *Framer) WriteRSTStream(streamID uint32, code ErrCode) error {
+	return f.WriteFrame(FrameRSTStream, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+func (f *Framer) WriteGoAway(lastStreamID uint32, code ErrCode, debug string) error {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, debug...)
+	return f.WriteFrame(FrameGoAway, 0, 0, payload)
+}
+
+// WriteHeaders sends a header block on a HEADERS frame followed by as many
+// CONTINUATION frames as maxFrameSize requires.
+func (f *Framer) WriteHeaders(streamID uint32, block []byte, endStream bool, maxFrameSize uint32) error {
+	typ := FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		n := len(block)
+		if n > int(maxFrameSize) {
+			n = int(maxFrameSize)
+		}
+
+		var flags uint8
+		if first && endStream {
+			flags |= FlagEndStream
+		}
+		if n == len(block) {
+			flags |= FlagEndHeaders
+		}
+
+		if err := f.WriteFrame(typ, flags, streamID, block[:n]); err != nil {
+			return err
+		}
+		block = block[n:]
+		typ = FrameContinuation
+	}
+	return nil
+}
+
+// parseSettings decodes a SETTINGS payload, also used for the
+// HTTP2-Settings header of an h2c upgrade.
+func parseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "SETTINGS length %d is not a multiple of 6", len(payload))
+	}
+
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+// stripPadding removes the pad length octet and padding of a PADDED frame.
+func stripPadding(h FrameHeader, payload []byte) ([]byte, error) {
+	if !h.Has(FlagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, connError(ErrCodeFrameSize, "padded frame without pad length")
+	}
+
+	pad := int(payload[0])
+	payload = payload[1:]
+	if pad > len(payload) {
+		return nil, connError(ErrCodeProtocol, "padding of %d bytes exceeds payload", pad)
+	}
+	return payload[:len(payload)-pad], nil
+}
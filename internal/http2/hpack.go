@@ -0,0 +1,466 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HPACK header compression (RFC 7541).
+
+var (
+	ErrCompression         = errors.New("hpack: invalid header block")
+	ErrHeaderListTooLarge  = errors.New("hpack: header list too large")
+	errIntegerOverflow     = fmt.Errorf("%w: integer overflow", ErrCompression)
+	errTruncatedHeaderData = fmt.Errorf("%w: truncated", ErrCompression)
+)
+
+const (
+	defaultHeaderTableSize = 4096
+	// entryOverhead is added to the length of name and value when sizing
+	// table entries and header lists (RFC 7541 section 4.1).
+	entryOverhead = 32
+)
+
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are sent as never-indexed literals so intermediaries
+	// do not compress them either.
+	Sensitive bool
+}
+
+func (f HeaderField) size() int {
+	return len(f.Name) + len(f.Value) + entryOverhead
+}
+
+// staticTable is RFC 7541 Appendix A. Index 1 is staticTable[0].
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// headerTable is the dynamic table. New entries are appended, so the most
+// recent entry has the lowest HPACK index.
+type headerTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *headerTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *headerTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *headerTable) evict() {
+	drop := 0
+	for t.size > t.maxSize && drop < len(t.entries) {
+		t.size -= t.entries[drop].size()
+		drop++
+	}
+	if drop > 0 {
+		t.entries = append(t.entries[:0], t.entries[drop:]...)
+	}
+}
+
+// field returns the entry at an HPACK index spanning the static and then
+// the dynamic table.
+func (t *headerTable) field(index uint64) (HeaderField, bool) {
+	if index == 0 {
+		return HeaderField{}, false
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], true
+	}
+
+	i := index - uint64(len(staticTable))
+	if i > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[uint64(len(t.entries))-i], true
+}
+
+// search returns the index of an exact match, or failing that of an entry
+// with the same name, or 0.
+func (t *headerTable) search(f HeaderField) (index int, exact bool) {
+	for i, e := range staticTable {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return i + 1, true
+		}
+		if index == 0 {
+			index = i + 1
+		}
+	}
+
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		dynIndex := len(staticTable) + len(t.entries) - i
+		if e.Value == f.Value {
+			return dynIndex, true
+		}
+		if index == 0 {
+			index = dynIndex
+		}
+	}
+
+	return index, false
+}
+
+// appendInteger encodes v with an n-bit prefix, keeping the high bits of
+// first (RFC 7541 section 5.1).
+func appendInteger(dst []byte, first byte, n uint, v uint64) []byte {
+	limit := uint64(1)<<n - 1
+	if v < limit {
+		return append(dst, first|byte(v))
+	}
+
+	dst = append(dst, first|byte(limit))
+	v -= limit
+	for v >= 128 {
+		dst = append(dst, byte(v&0x7f)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func readInteger(p []byte, n uint) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, errTruncatedHeaderData
+	}
+
+	limit := uint64(1)<<n - 1
+	v := uint64(p[0]) & limit
+	p = p[1:]
+	if v < limit {
+		return v, p, nil
+	}
+
+	for shift := uint(0); ; shift += 7 {
+		if len(p) == 0 {
+			return 0, nil, errTruncatedHeaderData
+		}
+		if shift > 56 {
+			return 0, nil, errIntegerOverflow
+		}
+		b := p[0]
+		p = p[1:]
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+	}
+}
+
+// appendString writes a string literal, Huffman coded when that is shorter.
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendInteger(dst, 0x80, 7, uint64(n))
+		return appendHuffman(dst, s)
+	}
+
+	dst = appendInteger(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func readString(p []byte, maxLen int) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, errTruncatedHeaderData
+	}
+
+	huffman := p[0]&0x80 != 0
+	n, p, err := readInteger(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > uint64(len(p)) {
+		return "", nil, errTruncatedHeaderData
+	}
+	raw := p[:n]
+	p = p[n:]
+
+	if !huffman {
+		return string(raw), p, nil
+	}
+
+	s, err := decodeHuffman(raw, maxLen)
+	return s, p, err
+}
+
+// Decoder decodes header blocks for one direction of a connection.
+type Decoder struct {
+	table hpackTableState
+	// MaxHeaderListSize bounds the decoded size of a block, counted as in
+	// SETTINGS_MAX_HEADER_LIST_SIZE. Zero means no limit.
+	MaxHeaderListSize int
+}
+
+type hpackTableState struct {
+	headerTable
+	// limit is the largest size a table size update may select, as
+	// advertised in our SETTINGS_HEADER_TABLE_SIZE.
+	limit int
+}
+
+func NewDecoder() *Decoder {
+	d := &Decoder{}
+	d.table.maxSize = defaultHeaderTableSize
+	d.table.limit = defaultHeaderTableSize
+	return d
+}
+
+// Decode decodes a complete header block. When the decoded list exceeds
+// MaxHeaderListSize the whole block is still processed, keeping the table in
+// sync, and ErrHeaderListTooLarge is returned with no fields.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var (
+		fields    []HeaderField
+		listSize  int
+		tooLarge  bool
+		sawHeader bool
+	)
+
+	maxString := d.MaxHeaderListSize
+	if maxString <= 0 {
+		maxString = 1 << 24
+	}
+
+	for len(block) > 0 {
+		b := block[0]
+
+		var (
+			f   HeaderField
+			err error
+		)
+
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field.
+			var index uint64
+			index, block, err = readInteger(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			f, ok = d.table.field(index)
+			if !ok {
+				return nil, fmt.Errorf("%w: invalid index %d", ErrCompression, index)
+			}
+		case b&0xc0 == 0x40:
+			// Literal with incremental indexing.
+			f, block, err = d.readLiteral(block, 6, maxString)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(HeaderField{Name: f.Name, Value: f.Value})
+		case b&0xe0 == 0x20:
+			// Dynamic table size update, allowed only before any field.
+			if sawHeader {
+				return nil, fmt.Errorf("%w: table size update after a header field", ErrCompression)
+			}
+			var size uint64
+			size, block, err = readInteger(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.table.limit) {
+				return nil, fmt.Errorf("%w: table size %d above limit %d", ErrCompression, size, d.table.limit)
+			}
+			d.table.setMaxSize(int(size))
+			continue
+		default:
+			// Literal without indexing (0000) or never indexed (0001).
+			sensitive := b&0x10 != 0
+			f, block, err = d.readLiteral(block, 4, maxString)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = sensitive
+		}
+
+		sawHeader = true
+		listSize += f.size()
+		if d.MaxHeaderListSize > 0 && listSize > d.MaxHeaderListSize {
+			tooLarge = true
+			fields = nil
+		}
+		if !tooLarge {
+			fields = append(fields, f)
+		}
+	}
+
+	if tooLarge {
+		return nil, ErrHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(p []byte, n uint, maxString int) (HeaderField, []byte, error) {
+	var f HeaderField
+
+	index, p, err := readInteger(p, n)
+	if err != nil {
+		return f, nil, err
+	}
+
+	if index == 0 {
+		f.Name, p, err = readString(p, maxString)
+		if err != nil {
+			return f, nil, err
+		}
+	} else {
+		named, ok := d.table.field(index)
+		if !ok {
+			return f, nil, fmt.Errorf("%w: invalid index %d", ErrCompression, index)
+		}
+		f.Name = named.Name
+	}
+
+	f.Value, p, err = readString(p, maxString)
+	if err != nil {
+		return f, nil, err
+	}
+
+	return f, p, nil
+}
+
+// Encoder encodes header blocks for one direction of a connection.
+type Encoder struct {
+	table headerTable
+	// minSize is the smallest table size set since the last block, which
+	// must be signalled before the final size (RFC 7541 section 4.2).
+	minSize       int
+	pendingUpdate bool
+}
+
+func NewEncoder() *Encoder {
+	e := &Encoder{}
+	e.table.maxSize = defaultHeaderTableSize
+	return e
+}
+
+// SetMaxTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE. The
+// encoder never uses more than the default 4096 bytes.
+func (e *Encoder) SetMaxTableSize(n int) {
+	if n > defaultHeaderTableSize {
+		n = defaultHeaderTableSize
+	}
+	if n == e.table.maxSize {
+		return
+	}
+
+	if !e.pendingUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// Encode appends the encoding of fields to dst as one header block.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		if e.minSize < e.table.maxSize {
+			dst = appendInteger(dst, 0x20, 5, uint64(e.minSize))
+		}
+		dst = appendInteger(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+
+	for _, f := range fields {
+		dst = e.encodeField(dst, f)
+	}
+	return dst
+}
+
+func (e *Encoder) encodeField(dst []byte, f HeaderField) []byte {
+	index, exact := e.table.search(f)
+	if exact && !f.Sensitive {
+		return appendInteger(dst, 0x80, 7, uint64(index))
+	}
+
+	switch {
+	case f.Sensitive:
+		dst = appendInteger(dst, 0x10, 4, uint64(index))
+	case f.size() > e.table.maxSize:
+		// Would evict the whole table for nothing.
+		dst = appendInteger(dst, 0x00, 4, uint64(index))
+	default:
+		dst = appendInteger(dst, 0x40, 6, uint64(index))
+		e.table.add(HeaderField{Name: f.Name, Value: f.Value})
+	}
+
+	if index == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
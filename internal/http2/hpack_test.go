@@ -0,0 +1,136 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestHPACKDecode(t *testing.T) {
+	// Test: RFC 7541 C.3, requests without Huffman coding sharing a table
+	d := NewDecoder()
+	fields, err := d.Decode(mustHex(t, "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}, fields)
+
+	fields, err = d.Decode(mustHex(t, "8286 84be 5808 6e6f 2d63 6163 6865"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":authority", Value: "www.example.com"}, fields[3])
+	assert.Equal(t, HeaderField{Name: "cache-control", Value: "no-cache"}, fields[4])
+
+	fields, err = d.Decode(mustHex(t, "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":path", Value: "/index.html"}, fields[2])
+	assert.Equal(t, HeaderField{Name: "custom-key", Value: "custom-value"}, fields[4])
+	assert.Equal(t, 164, d.table.size)
+
+	// Test: RFC 7541 C.4, the same requests with Huffman coding
+	d = NewDecoder()
+	fields, err = d.Decode(mustHex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"))
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", fields[3].Value)
+
+	fields, err = d.Decode(mustHex(t, "8286 84be 5886 a8eb 1064 9cbf"))
+	require.NoError(t, err)
+	assert.Equal(t, "no-cache", fields[4].Value)
+
+	fields, err = d.Decode(mustHex(t, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: "custom-key", Value: "custom-value"}, fields[4])
+
+	// Test: RFC 7541 C.5, responses evicting from a 256 byte table
+	d = NewDecoder()
+	d.table.setMaxSize(256)
+	_, err = d.Decode(mustHex(t, "4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	require.NoError(t, err)
+	assert.Equal(t, 222, d.table.size)
+	fields, err = d.Decode(mustHex(t, "4803 3330 37c1 c0bf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":status", Value: "307"}, fields[0])
+	assert.Equal(t, 222, d.table.size)
+	assert.Equal(t, ":status", d.table.entries[len(d.table.entries)-1].Name)
+
+	// Test: Never-indexed literals are marked sensitive
+	d = NewDecoder()
+	fields, err = d.Decode(mustHex(t, "1008 7061 7373 776f 7264 0673 6563 7265 74"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: "password", Value: "secret", Sensitive: true}, fields[0])
+	assert.Empty(t, d.table.entries)
+}
+
+func TestHPACKErrors(t *testing.T) {
+	cases := map[string]string{
+		"index zero":                "80",
+		"index past the table":      "ff00",
+		"truncated string":          "4005 6162",
+		"integer overflow":          "ff ffff ffff ffff ffff ffff 7f",
+		"size update above limit":   "3fe2 1f",
+		"size update after field":   "82 20",
+		"Huffman padding too long":  "4081 6181 ff",
+		"Huffman padding not ones":  "4081 6181 1e",
+		"EOS in Huffman string":     "4081 6184 ffff ffff",
+		"truncated integer":         "ff",
+		"literal name index bad":    "7f 00 0161",
+		"string length past buffer": "0003 6162",
+	}
+	for name, block := range cases {
+		_, err := NewDecoder().Decode(mustHex(t, block))
+		assert.ErrorIs(t, err, ErrCompression, name)
+	}
+
+	// Test: Oversized header lists are rejected but still update the table
+	d := NewDecoder()
+	d.MaxHeaderListSize = 40
+	_, err := d.Decode(mustHex(t, "400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65"))
+	assert.ErrorIs(t, err, ErrHeaderListTooLarge)
+	assert.Len(t, d.table.entries, 1)
+}
+
+func TestHPACKEncode(t *testing.T) {
+	// Test: Huffman coding matches RFC 7541 C.4.1
+	assert.Equal(t, mustHex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff"), appendHuffman(nil, "www.example.com"))
+
+	// Test: Encoded blocks round trip and reuse the dynamic table
+	e, d := NewEncoder(), NewDecoder()
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "x-custom", Value: strings.Repeat("v", 50)},
+		{Name: "set-cookie", Value: "a=b", Sensitive: true},
+	}
+	first := e.Encode(nil, fields)
+	got, err := d.Decode(first)
+	require.NoError(t, err)
+	assert.Equal(t, fields, got)
+
+	second := e.Encode(nil, fields)
+	assert.Less(t, len(second), len(first)/2)
+	got, err = d.Decode(second)
+	require.NoError(t, err)
+	assert.Equal(t, fields, got)
+
+	// Test: Shrinking the table is signalled before the next block
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(100)
+	block := e.Encode(nil, fields[:1])
+	assert.Equal(t, mustHex(t, "20 3f45 88"), block)
+	got, err = d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields[:1], got)
+	assert.Equal(t, 100, d.table.maxSize)
+}
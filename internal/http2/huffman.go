@@ -0,0 +1,118 @@
+package http2
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type huffmanCode struct {
+	code uint32
+	bits uint8
+}
+
+const huffmanEOS = 256
+
+// huffmanNode is a node of the decoding tree. Leaves have no children and
+// hold a symbol.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      int
+}
+
+var (
+	huffmanRoot     *huffmanNode
+	huffmanRootOnce sync.Once
+)
+
+func huffmanTree() *huffmanNode {
+	huffmanRootOnce.Do(func() {
+		huffmanRoot = &huffmanNode{sym: -1}
+		for sym, c := range huffmanCodes {
+			n := huffmanRoot
+			for i := int(c.bits) - 1; i >= 0; i-- {
+				bit := (c.code >> uint(i)) & 1
+				if n.children[bit] == nil {
+					n.children[bit] = &huffmanNode{sym: -1}
+				}
+				n = n.children[bit]
+			}
+			n.sym = sym
+		}
+	})
+	return huffmanRoot
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// appendHuffman appends the Huffman coding of s, padded with the most
+// significant bits of EOS (RFC 7541 section 5.2).
+func appendHuffman(dst []byte, s string) []byte {
+	var (
+		acc   uint64
+		nbits uint
+	)
+
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		nbits += uint(c.bits)
+		for nbits >= 8 {
+			nbits -= 8
+			dst = append(dst, byte(acc>>nbits))
+		}
+	}
+
+	if nbits > 0 {
+		pad := 8 - nbits
+		dst = append(dst, byte(acc<<pad)|byte(1<<pad-1))
+	}
+	return dst
+}
+
+// decodeHuffman decodes p, rejecting EOS, padding longer than 7 bits or
+// padding that is not all ones, and output longer than maxLen.
+func decodeHuffman(p []byte, maxLen int) (string, error) {
+	root := huffmanTree()
+
+	var b strings.Builder
+	n := root
+	// padBits counts bits consumed since the last symbol; all of them are
+	// ones while ones is true.
+	padBits, ones := 0, true
+
+	for _, octet := range p {
+		for i := 7; i >= 0; i-- {
+			bit := (octet >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", fmt.Errorf("%w: invalid Huffman code", ErrCompression)
+			}
+			padBits++
+			ones = ones && bit == 1
+
+			if n.sym < 0 {
+				continue
+			}
+			if n.sym == huffmanEOS {
+				return "", fmt.Errorf("%w: EOS in Huffman string", ErrCompression)
+			}
+			if b.Len() >= maxLen {
+				return "", ErrHeaderListTooLarge
+			}
+			b.WriteByte(byte(n.sym))
+			n, padBits, ones = root, 0, true
+		}
+	}
+
+	if padBits > 7 || !ones {
+		return "", fmt.Errorf("%w: invalid Huffman padding", ErrCompression)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,1202 @@
+package http2
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMaxConcurrentStreams = 100
+
+// maxUnreadBodies is how many MaxBodyBytes of request bodies a connection
+// holds before their handlers start. Flow control credit is returned as
+// data arrives, so without it every stream could buffer a full body.
+const maxUnreadBodies = 4
+
+var (
+	ErrBadPreface   = errors.New("http2: invalid connection preface")
+	errStreamClosed = errors.New("http2: stream closed")
+	errClientGoAway = errors.New("http2: client sent GOAWAY")
+)
+
+// connectionSpecificHeaders must not appear in HTTP/2 messages
+// (RFC 9113 section 8.2.2).
+var connectionSpecificHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+type Handler func(w *response.Writer, req *request.Request)
+
+// Server holds the settings shared by every HTTP/2 connection it serves.
+type Server struct {
+	Handler Handler
+	// MaxConcurrentStreams is advertised to clients; streams beyond it are
+	// refused. Zero means 100.
+	MaxConcurrentStreams uint32
+	// Limits bounds each request's header list and body, as for HTTP/1.x.
+	Limits request.Limits
+	// IdleTimeout closes a connection with no open streams after this long.
+	// Zero disables it.
+	IdleTimeout time.Duration
+	// Shutdown, once closed, makes every connection send GOAWAY, finish the
+	// streams already started and close.
+	Shutdown <-chan struct{}
+}
+
+type ServeConnOpts struct {
+	// Reader supplies the bytes received on the connection, including any
+	// read ahead while detecting the protocol. It defaults to the
+	// connection itself.
+	Reader io.Reader
+	// Upgrade is an HTTP/1.1 request that switched to h2c. It is answered
+	// on stream 1. The 101 response must already have been sent.
+	Upgrade *request.Request
+	// Settings is the decoded HTTP2-Settings header of Upgrade.
+	Settings []byte
+}
+
+// UpgradeSettings reports whether req asks to switch to h2c
+// (RFC 7540 section 3.2) and returns its decoded HTTP2-Settings. Requests
+// with a missing or malformed HTTP2-Settings are not upgrades.
+func UpgradeSettings(req *request.Request) ([]byte, bool) {
+	if req.RequestLine.HttpVersion != "1.1" ||
+		!headers.HasToken(req.Headers.Get("Upgrade"), "h2c") ||
+		!headers.HasToken(req.Headers.Get("Connection"), "upgrade") ||
+		!headers.HasToken(req.Headers.Get("Connection"), "http2-settings") {
+		return nil, false
+	}
+
+	value, ok := req.Headers["http2-settings"]
+	if !ok || strings.Contains(value, ",") {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil || len(payload)%6 != 0 {
+		return nil, false
+	}
+	return payload, true
+}
+
+// ServeConn speaks HTTP/2 on conn until the client goes away, the
+// connection idles out or Shutdown is closed. It returns once every handler
+// has finished. Clean shutdowns return nil.
+func (s *Server) ServeConn(conn net.Conn, opts ServeConnOpts) error {
+	r := opts.Reader
+	if r == nil {
+		r = conn
+	}
+
+	sc := &serverConn{
+		srv:               s,
+		conn:              conn,
+		fr:                NewFramer(conn, r),
+		dec:               NewDecoder(),
+		enc:               NewEncoder(),
+		streams:           make(map[uint32]*stream),
+		connSendWindow:    defaultWindowSize,
+		connRecvWindow:    defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+		maxStreams:        s.MaxConcurrentStreams,
+		limits:            s.Limits,
+		done:              make(chan struct{}),
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	if sc.maxStreams == 0 {
+		sc.maxStreams = defaultMaxConcurrentStreams
+	}
+	if sc.limits == (request.Limits{}) {
+		sc.limits = request.DefaultLimits
+	}
+	sc.dec.MaxHeaderListSize = sc.limits.MaxHeaderBytes
+
+	return sc.serve(opts)
+}
+
+type serverConn struct {
+	srv        *Server
+	conn       net.Conn
+	fr         *Framer
+	dec        *Decoder
+	maxStreams uint32
+	limits     request.Limits
+	done       chan struct{}
+	handlers   sync.WaitGroup
+
+	// wmu serialises frame writes and keeps header blocks in the order the
+	// encoder produced them.
+	wmu sync.Mutex
+	enc *Encoder
+
+	// mu guards stream bookkeeping and send flow control. cond is signalled
+	// when a send window grows or a stream or the connection goes away.
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	maxStreamID       uint32
+	connSendWindow    int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	goingAway         bool
+	closed            bool
+	// detached counts handlers still running for streams that are already
+	// gone, typically reset by the client. They hold on to their
+	// concurrency slot until they return.
+	detached int
+	// resets counts streams the client cancelled before they completed,
+	// less those that completed since.
+	resets uint32
+	// unread is the body data buffered for streams still receiving it.
+	unread int64
+
+	// Owned by the reading goroutine.
+	connRecvWindow  int64
+	headerStreamID  uint32
+	headerBlock     []byte
+	headerEndStream bool
+}
+
+// stream is one request/response exchange. It implements response.Stream.
+type stream struct {
+	sc            *serverConn
+	id            uint32
+	req           *request.Request
+	body          []byte
+	contentLength int64
+	recvWindow    int64
+	headersSent   bool
+
+	// Guarded by sc.mu.
+	// unread is this stream's share of sc.unread.
+	unread       int64
+	sendWindow   int64
+	remoteClosed bool
+	localClosed  bool
+	reset        bool
+	running      bool
+	detached     bool
+}
+
+func (sc *serverConn) serve(opts ServeConnOpts) error {
+	defer close(sc.done)
+	defer sc.closeAndWait()
+
+	err := sc.writeFrames(func(fr *Framer) error {
+		return fr.WriteSettings(
+			Setting{SettingMaxConcurrentStreams, sc.maxStreams},
+			Setting{SettingMaxHeaderListSize, uint32(sc.limits.MaxHeaderBytes)},
+		)
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.Upgrade != nil {
+		if err := sc.startUpgradeStream(opts.Upgrade, opts.Settings); err != nil {
+			return sc.fail(err)
+		}
+	}
+
+	sc.setIdleDeadline()
+	var preface [len(ClientPreface)]byte
+	if _, err := io.ReadFull(sc.fr.r, preface[:]); err != nil {
+		return err
+	}
+	if string(preface[:]) != ClientPreface {
+		return ErrBadPreface
+	}
+
+	go sc.watchShutdown()
+
+	for first := true; ; first = false {
+		h, payload, err := sc.fr.ReadFrame()
+		if err != nil {
+			return sc.readError(err)
+		}
+
+		if first && h.Type != FrameSettings {
+			return sc.fail(connError(ErrCodeProtocol, "first frame is %d, not SETTINGS", h.Type))
+		}
+
+		err = sc.processFrame(h, payload)
+		var se StreamError
+		switch {
+		case err == nil:
+		case errors.Is(err, errClientGoAway):
+			return nil
+		case errors.As(err, &se):
+			sc.resetStreamID(se.StreamID, se.Code)
+		default:
+			return sc.fail(err)
+		}
+	}
+}
+
+// readError decides whether a failed read ends the connection cleanly.
+func (sc *serverConn) readError(err error) error {
+	var ce ConnError
+	if errors.As(err, &ce) {
+		return sc.fail(err)
+	}
+
+	sc.mu.Lock()
+	goingAway := sc.goingAway
+	sc.mu.Unlock()
+
+	switch {
+	case goingAway, errors.Is(err, io.EOF):
+		return nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		sc.goAway(ErrCodeNo, "idle timeout")
+		return nil
+	}
+	return err
+}
+
+// fail sends GOAWAY for a connection error and returns it.
+func (sc *serverConn) fail(err error) error {
+	code := ErrCodeInternal
+	var ce ConnError
+	if errors.As(err, &ce) {
+		code = ce.Code
+	}
+	sc.goAway(code, err.Error())
+	return err
+}
+
+func (sc *serverConn) closeAndWait() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	sc.conn.Close()
+	sc.handlers.Wait()
+}
+
+func (sc *serverConn) watchShutdown() {
+	select {
+	case <-sc.srv.Shutdown:
+		sc.goAway(ErrCodeNo, "server shutting down")
+		sc.closeIfDrained()
+	case <-sc.done:
+	}
+}
+
+// goAway stops new streams and tells the client which ones will still be
+// processed.
+func (sc *serverConn) goAway(code ErrCode, debug string) {
+	sc.writeFrames(func(fr *Framer) error {
+		sc.mu.Lock()
+		sc.goingAway = true
+		last := sc.maxStreamID
+		sc.mu.Unlock()
+
+		return fr.WriteGoAway(last, code, debug)
+	})
+}
+
+// closeIfDrained closes the connection once GOAWAY has been sent and the
+// last stream has finished, which also ends the read loop. Holding wmu
+// keeps it from closing while GOAWAY is still being written.
+func (sc *serverConn) closeIfDrained() {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	sc.mu.Lock()
+	drained := sc.goingAway && len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	if drained {
+		sc.conn.Close()
+	}
+}
+
+func (sc *serverConn) setIdleDeadline() {
+	if sc.srv.IdleTimeout > 0 {
+		sc.conn.SetReadDeadline(time.Now().Add(sc.srv.IdleTimeout))
+	}
+}
+
+func (sc *serverConn) writeFrames(write func(fr *Framer) error) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	if err := write(sc.fr); err != nil {
+		return err
+	}
+	return sc.fr.Flush()
+}
+
+func (sc *serverConn) processFrame(h FrameHeader, payload []byte) error {
+	if sc.headerStreamID != 0 && (h.Type != FrameContinuation || h.StreamID != sc.headerStreamID) {
+		return connError(ErrCodeProtocol, "expected CONTINUATION for stream %d", sc.headerStreamID)
+	}
+
+	switch h.Type {
+	case FrameData:
+		return sc.processData(h, payload)
+	case FrameHeaders:
+		return sc.processHeaders(h, payload)
+	case FrameContinuation:
+		return sc.processContinuation(h, payload)
+	case FramePriority:
+		if h.StreamID == 0 {
+			return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(payload) != 5 {
+			return streamError(h.StreamID, ErrCodeFrameSize, "PRIORITY length %d", len(payload))
+		}
+		return nil
+	case FrameRSTStream:
+		return sc.processRSTStream(h, payload)
+	case FrameSettings:
+		return sc.processSettings(h, payload)
+	case FramePushPromise:
+		return connError(ErrCodeProtocol, "PUSH_PROMISE from client")
+	case FramePing:
+		return sc.processPing(h, payload)
+	case FrameGoAway:
+		return sc.processGoAway(h)
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(h, payload)
+	}
+
+	// Unknown frame types are ignored (RFC 9113 section 4.1).
+	return nil
+}
+
+func (sc *serverConn) stream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.streams[id]
+}
+
+func (sc *serverConn) isIdleStream(id uint32) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return id > sc.maxStreamID
+}
+
+func (sc *serverConn) processData(h FrameHeader, payload []byte) error {
+	if h.StreamID == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+
+	// Padding counts against flow control too.
+	n := int64(len(payload))
+	if n > sc.connRecvWindow {
+		return connError(ErrCodeFlowControl, "DATA exceeds connection window")
+	}
+	sc.connRecvWindow -= n
+
+	data, err := stripPadding(h, payload)
+	if err != nil {
+		return err
+	}
+
+	// The connection window is returned at once: bodies are bounded by
+	// MaxBodyBytes and the connection's unread cap rather than by
+	// backpressure.
+	if err := sc.sendWindowUpdate(0, n); err != nil {
+		return err
+	}
+
+	st := sc.stream(h.StreamID)
+	if st == nil {
+		if sc.isIdleStream(h.StreamID) {
+			return connError(ErrCodeProtocol, "DATA on idle stream %d", h.StreamID)
+		}
+		return streamError(h.StreamID, ErrCodeStreamClosed, "DATA on closed stream")
+	}
+
+	sc.mu.Lock()
+	remoteClosed := st.remoteClosed
+	unread := sc.unread
+	sc.mu.Unlock()
+	if remoteClosed {
+		return streamError(h.StreamID, ErrCodeStreamClosed, "DATA after END_STREAM")
+	}
+
+	if n > st.recvWindow {
+		return streamError(h.StreamID, ErrCodeFlowControl, "DATA exceeds stream window")
+	}
+	st.recvWindow -= n
+
+	if len(st.body)+len(data) > sc.limits.MaxBodyBytes {
+		sc.rejectStream(st, response.PayloadTooLarge)
+		return nil
+	}
+	// The request has not reached a handler, so the client may retry it.
+	if unread+int64(len(data)) > maxUnreadBodies*int64(sc.limits.MaxBodyBytes) {
+		return streamError(h.StreamID, ErrCodeRefusedStream, "connection has too much unread request data")
+	}
+	st.body = append(st.body, data...)
+
+	sc.mu.Lock()
+	st.unread += int64(len(data))
+	sc.unread += int64(len(data))
+	sc.mu.Unlock()
+
+	if st.contentLength >= 0 && int64(len(st.body)) > st.contentLength {
+		return streamError(h.StreamID, ErrCodeProtocol, "body exceeds content-length")
+	}
+
+	if h.Has(FlagEndStream) {
+		return sc.endRequest(st)
+	}
+
+	if n > 0 {
+		st.recvWindow += n
+		return sc.sendWindowUpdate(st.id, n)
+	}
+	return nil
+}
+
+func (sc *serverConn) sendWindowUpdate(streamID uint32, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if streamID == 0 {
+		sc.connRecvWindow += n
+	}
+	return sc.writeFrames(func(fr *Framer) error {
+		return fr.WriteWindowUpdate(streamID, uint32(n))
+	})
+}
+
+func (sc *serverConn) processHeaders(h FrameHeader, payload []byte) error {
+	if h.StreamID == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream 0")
+	}
+
+	block, err := stripPadding(h, payload)
+	if err != nil {
+		return err
+	}
+	if h.Has(FlagPriority) {
+		if len(block) < 5 {
+			return connError(ErrCodeFrameSize, "HEADERS too short for priority")
+		}
+		block = block[5:]
+	}
+
+	sc.headerStreamID = h.StreamID
+	sc.headerBlock = sc.headerBlock[:0]
+	sc.headerEndStream = h.Has(FlagEndStream)
+	if err := sc.appendHeaderBlock(block); err != nil {
+		return err
+	}
+
+	if h.Has(FlagEndHeaders) {
+		return sc.processHeaderBlock()
+	}
+	return nil
+}
+
+func (sc *serverConn) processContinuation(h FrameHeader, payload []byte) error {
+	if sc.headerStreamID == 0 {
+		return connError(ErrCodeProtocol, "CONTINUATION without HEADERS")
+	}
+
+	if err := sc.appendHeaderBlock(payload); err != nil {
+		return err
+	}
+
+	if h.Has(FlagEndHeaders) {
+		return sc.processHeaderBlock()
+	}
+	return nil
+}
+
+// appendHeaderBlock collects a fragment of a header block. The compressed
+// size is checked before anything is decoded; a block this large cannot be
+// skipped without losing HPACK state, so it ends the connection.
+func (sc *serverConn) appendHeaderBlock(frag []byte) error {
+	sc.headerBlock = append(sc.headerBlock, frag...)
+	if len(sc.headerBlock) > sc.limits.MaxHeaderBytes {
+		return connError(ErrCodeEnhanceYourCalm, "header block exceeds %d bytes", sc.limits.MaxHeaderBytes)
+	}
+	return nil
+}
+
+func (sc *serverConn) processHeaderBlock() error {
+	id := sc.headerStreamID
+	endStream := sc.headerEndStream
+	sc.headerStreamID = 0
+
+	// The block is always decoded, even for streams that will be refused,
+	// to keep the HPACK table in sync with the client.
+	fields, err := sc.dec.Decode(sc.headerBlock)
+	tooLarge := errors.Is(err, ErrHeaderListTooLarge)
+	if err != nil && !tooLarge {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+
+	if st := sc.stream(id); st != nil {
+		return sc.processTrailers(st, fields, endStream, tooLarge)
+	}
+
+	if id%2 == 0 {
+		return connError(ErrCodeProtocol, "client opened even stream %d", id)
+	}
+
+	sc.mu.Lock()
+	if id <= sc.maxStreamID {
+		sc.mu.Unlock()
+		return connError(ErrCodeStreamClosed, "HEADERS on closed stream %d", id)
+	}
+	sc.maxStreamID = id
+	goingAway := sc.goingAway
+	active := uint32(len(sc.streams) + sc.detached)
+	sc.mu.Unlock()
+
+	if goingAway {
+		return nil
+	}
+	if active >= sc.maxStreams {
+		return streamError(id, ErrCodeRefusedStream, "too many concurrent streams")
+	}
+
+	var (
+		req           *request.Request
+		contentLength int64 = -1
+	)
+	if !tooLarge {
+		req, contentLength, err = newRequest(fields)
+		if err != nil {
+			return streamError(id, ErrCodeProtocol, "%v", err)
+		}
+	}
+
+	st := sc.openStream(id, req, contentLength)
+	if tooLarge {
+		sc.rejectStream(st, response.RequestHeaderFieldsTooLarge)
+		return nil
+	}
+	if endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processTrailers(st *stream, fields []HeaderField, endStream, tooLarge bool) error {
+	sc.mu.Lock()
+	remoteClosed := st.remoteClosed
+	sc.mu.Unlock()
+
+	if remoteClosed {
+		return streamError(st.id, ErrCodeStreamClosed, "HEADERS after END_STREAM")
+	}
+	if !endStream {
+		return streamError(st.id, ErrCodeProtocol, "trailers without END_STREAM")
+	}
+	if tooLarge {
+		sc.rejectStream(st, response.RequestHeaderFieldsTooLarge)
+		return nil
+	}
+
+	trailers := headers.NewHeaders()
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			return streamError(st.id, ErrCodeProtocol, "pseudo-header %s in trailers", f.Name)
+		}
+		if err := validateField(f); err != nil {
+			return streamError(st.id, ErrCodeProtocol, "%v", err)
+		}
+		trailers.Set(f.Name, f.Value)
+	}
+	st.req.Trailers = trailers
+
+	return sc.endRequest(st)
+}
+
+func (sc *serverConn) openStream(id uint32, req *request.Request, contentLength int64) *stream {
+	st := &stream{
+		sc:            sc,
+		id:            id,
+		req:           req,
+		contentLength: contentLength,
+		recvWindow:    defaultWindowSize,
+	}
+
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	sc.mu.Unlock()
+
+	sc.conn.SetReadDeadline(time.Time{})
+	return st
+}
+
+// endRequest runs the handler once the whole request has arrived.
+func (sc *serverConn) endRequest(st *stream) error {
+	if st.contentLength >= 0 && int64(len(st.body)) != st.contentLength {
+		return streamError(st.id, ErrCodeProtocol, "body of %d bytes does not match content-length %d", len(st.body), st.contentLength)
+	}
+	st.req.Body = st.body
+
+	sc.mu.Lock()
+	st.remoteClosed = true
+	st.running = true
+	sc.releaseUnreadLocked(st)
+	sc.mu.Unlock()
+
+	sc.handlers.Add(1)
+	go sc.runHandler(st)
+	return nil
+}
+
+func (sc *serverConn) runHandler(st *stream) {
+	defer sc.handlers.Done()
+	defer sc.handlerDone(st)
+
+	w := response.NewStreamWriter(st)
+	sc.srv.Handler(w, st.req)
+	w.HandlerDone()
+
+	sc.mu.Lock()
+	finished := st.localClosed || st.reset
+	sc.mu.Unlock()
+	if finished {
+		return
+	}
+
+	// A handler that never wrote a response is an error; one that wrote
+	// headers but did not end the body gets the body it wrote.
+	if !st.headersSent {
+		sc.resetStream(st, ErrCodeInternal)
+		return
+	}
+	st.WriteData(nil, true)
+}
+
+// rejectStream answers a request that broke a limit with an error status
+// and resets the stream so the client stops sending. The response is
+// written from its own goroutine since it may wait on flow control.
+func (sc *serverConn) rejectStream(st *stream, status response.StatusCode) {
+	sc.mu.Lock()
+	st.remoteClosed = true
+	st.running = true
+	sc.releaseUnreadLocked(st)
+	sc.mu.Unlock()
+
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		defer sc.handlerDone(st)
+
+		body := []byte(response.StatusText(status) + "\n")
+		w := response.NewStreamWriter(st)
+		w.WriteStatusLine(status)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		sc.resetStream(st, ErrCodeNo)
+	}()
+}
+
+// handlerDone frees the slot held by a detached stream once its handler
+// returns, and credits the connection for a stream that completed.
+func (sc *serverConn) handlerDone(st *stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	st.running = false
+	if st.detached {
+		st.detached = false
+		sc.detached--
+	}
+	if st.localClosed && sc.resets > 0 {
+		sc.resets--
+	}
+}
+
+func (sc *serverConn) resetStreamID(id uint32, code ErrCode) {
+	if st := sc.stream(id); st != nil {
+		sc.resetStream(st, code)
+		return
+	}
+	sc.writeFrames(func(fr *Framer) error {
+		return fr.WriteRSTStream(id, code)
+	})
+}
+
+func (sc *serverConn) resetStream(st *stream, code ErrCode) {
+	sc.writeFrames(func(fr *Framer) error {
+		sc.mu.Lock()
+		st.reset = true
+		sc.removeStreamLocked(st)
+		sc.mu.Unlock()
+
+		return fr.WriteRSTStream(st.id, code)
+	})
+
+	sc.closeIfDrained()
+}
+
+func (sc *serverConn) removeStreamLocked(st *stream) {
+	if _, ok := sc.streams[st.id]; !ok {
+		return
+	}
+	delete(sc.streams, st.id)
+	sc.releaseUnreadLocked(st)
+	// A handler that already sent its whole response is just returning.
+	if st.running && !st.localClosed {
+		st.detached = true
+		sc.detached++
+	}
+	sc.cond.Broadcast()
+
+	if len(sc.streams) == 0 && !sc.goingAway {
+		sc.setIdleDeadline()
+	}
+}
+
+// releaseUnreadLocked stops counting st's body as unread, once it has gone
+// to a handler or been dropped.
+func (sc *serverConn) releaseUnreadLocked(st *stream) {
+	sc.unread -= st.unread
+	st.unread = 0
+}
+
+func (sc *serverConn) processRSTStream(h FrameHeader, payload []byte) error {
+	if h.StreamID == 0 {
+		return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(payload) != 4 {
+		return connError(ErrCodeFrameSize, "RST_STREAM length %d", len(payload))
+	}
+	if sc.isIdleStream(h.StreamID) {
+		return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", h.StreamID)
+	}
+
+	st := sc.stream(h.StreamID)
+	if st == nil {
+		return nil
+	}
+
+	sc.mu.Lock()
+	st.reset = true
+	sc.removeStreamLocked(st)
+	// Opening streams and cancelling them at once costs the client
+	// nothing and keeps the server busy (CVE-2023-44487), so a client
+	// that cancels far more streams than it completes is sent away.
+	sc.resets++
+	tooMany := sc.resets > 2*sc.maxStreams
+	sc.mu.Unlock()
+
+	if tooMany {
+		return connError(ErrCodeEnhanceYourCalm, "too many streams reset by the client")
+	}
+	sc.closeIfDrained()
+	return nil
+}
+
+func (sc *serverConn) processSettings(h FrameHeader, payload []byte) error {
+	if h.StreamID != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on stream %d", h.StreamID)
+	}
+	if h.Has(FlagAck) {
+		if len(payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ACK with payload")
+		}
+		return nil
+	}
+
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+
+	return sc.writeFrames(func(fr *Framer) error {
+		return fr.WriteFrame(FrameSettings, FlagAck, 0, nil)
+	})
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	for _, s := range settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			sc.wmu.Lock()
+			sc.enc.SetMaxTableSize(int(s.Value))
+			sc.wmu.Unlock()
+		case SettingEnablePush:
+			if s.Value > 1 {
+				return connError(ErrCodeProtocol, "ENABLE_PUSH of %d", s.Value)
+			}
+		case SettingInitialWindowSize:
+			if s.Value > maxWindowSize {
+				return connError(ErrCodeFlowControl, "INITIAL_WINDOW_SIZE of %d", s.Value)
+			}
+			if err := sc.setInitialWindow(int64(s.Value)); err != nil {
+				return err
+			}
+		case SettingMaxFrameSize:
+			if s.Value < defaultMaxFrameSize || s.Value > maxFrameSizeLimit {
+				return connError(ErrCodeProtocol, "MAX_FRAME_SIZE of %d", s.Value)
+			}
+			sc.mu.Lock()
+			sc.peerMaxFrameSize = s.Value
+			sc.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// setInitialWindow adjusts every open stream's send window by the change
+// in SETTINGS_INITIAL_WINDOW_SIZE (RFC 9113 section 6.9.2).
+func (sc *serverConn) setInitialWindow(size int64) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	delta := size - sc.peerInitialWindow
+	sc.peerInitialWindow = size
+	for _, st := range sc.streams {
+		st.sendWindow += delta
+		if st.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "stream %d window overflow", st.id)
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processPing(h FrameHeader, payload []byte) error {
+	if h.StreamID != 0 {
+		return connError(ErrCodeProtocol, "PING on stream %d", h.StreamID)
+	}
+	if len(payload) != 8 {
+		return connError(ErrCodeFrameSize, "PING length %d", len(payload))
+	}
+	if h.Has(FlagAck) {
+		return nil
+	}
+
+	data := append([]byte(nil), payload...)
+	return sc.writeFrames(func(fr *Framer) error {
+		return fr.WriteFrame(FramePing, FlagAck, 0, data)
+	})
+}
+
+func (sc *serverConn) processGoAway(h FrameHeader) error {
+	if h.StreamID != 0 {
+		return connError(ErrCodeProtocol, "GOAWAY on stream %d", h.StreamID)
+	}
+
+	sc.mu.Lock()
+	sc.goingAway = true
+	drained := len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	if drained {
+		return errClientGoAway
+	}
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(h FrameHeader, payload []byte) error {
+	if len(payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE length %d", len(payload))
+	}
+	inc := int64(binary.BigEndian.Uint32(payload) & (1<<31 - 1))
+
+	if h.StreamID == 0 {
+		if inc == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		sc.connSendWindow += inc
+		if sc.connSendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window overflow")
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st := sc.stream(h.StreamID)
+	if st == nil {
+		if sc.isIdleStream(h.StreamID) {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", h.StreamID)
+		}
+		return nil
+	}
+	if inc == 0 {
+		return streamError(h.StreamID, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.sendWindow += inc
+	if st.sendWindow > maxWindowSize {
+		return streamError(h.StreamID, ErrCodeFlowControl, "stream window overflow")
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// startUpgradeStream applies the HTTP2-Settings of an h2c upgrade and
+// serves the upgrading request as stream 1, which the client has already
+// half-closed.
+func (sc *serverConn) startUpgradeStream(req *request.Request, settings []byte) error {
+	parsed, err := parseSettings(settings)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(parsed); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"connection", "upgrade", "http2-settings", "keep-alive", "proxy-connection", "transfer-encoding"} {
+		req.Headers.Del(name)
+	}
+	req.RequestLine.HttpVersion = "2.0"
+
+	sc.mu.Lock()
+	sc.maxStreamID = 1
+	sc.mu.Unlock()
+
+	st := sc.openStream(1, req, -1)
+	st.body = req.Body
+	return sc.endRequest(st)
+}
+
+// newRequest builds a request from a decoded header block, enforcing the
+// rules of RFC 9113 section 8.3. It returns the declared content-length,
+// or -1.
+func newRequest(fields []HeaderField) (*request.Request, int64, error) {
+	var (
+		method, scheme, path, authority string
+		seen                            = map[string]bool{}
+		regular                         bool
+	)
+
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, 0, fmt.Errorf("pseudo-header %s after regular fields", f.Name)
+			}
+			if seen[f.Name] {
+				return nil, 0, fmt.Errorf("duplicate pseudo-header %s", f.Name)
+			}
+			seen[f.Name] = true
+
+			switch f.Name {
+			case ":method":
+				method = f.Value
+			case ":scheme":
+				scheme = f.Value
+			case ":path":
+				path = f.Value
+			case ":authority":
+				authority = f.Value
+			default:
+				return nil, 0, fmt.Errorf("invalid pseudo-header %s", f.Name)
+			}
+			continue
+		}
+
+		regular = true
+		if err := validateField(f); err != nil {
+			return nil, 0, err
+		}
+
+		// Cookie crumbs are rejoined with "; " (RFC 9113 section 8.2.3).
+		if f.Name == "cookie" && h.Get("cookie") != "" {
+			h.Override("cookie", h.Get("cookie")+"; "+f.Value)
+			continue
+		}
+		h.Set(f.Name, f.Value)
+	}
+
+	if method == "" {
+		return nil, 0, fmt.Errorf("missing :method")
+	}
+
+	target := path
+	if method == "CONNECT" {
+		if authority == "" || scheme != "" || path != "" {
+			return nil, 0, fmt.Errorf("CONNECT requires only :authority")
+		}
+		target = authority
+	} else if scheme == "" || path == "" {
+		return nil, 0, fmt.Errorf("missing :scheme or :path")
+	}
+
+	if authority != "" {
+		h.Override("host", authority)
+	}
+
+	contentLength := int64(-1)
+	if v := h.Get("content-length"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("invalid content-length %q", v)
+		}
+		contentLength = n
+	}
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: target,
+			HttpVersion:   "2.0",
+		},
+		Headers: h,
+		State:   request.DoneState,
+	}
+	return req, contentLength, nil
+}
+
+func validateField(f HeaderField) error {
+	if strings.ToLower(f.Name) != f.Name {
+		return fmt.Errorf("uppercase field name %q", f.Name)
+	}
+	if err := headers.ValidateField(f.Name, f.Value); err != nil {
+		return err
+	}
+	if connectionSpecificHeaders[f.Name] {
+		return fmt.Errorf("connection-specific field %q", f.Name)
+	}
+	if f.Name == "te" && f.Value != "trailers" {
+		return fmt.Errorf("te other than trailers")
+	}
+	return nil
+}
+
+func (st *stream) WriteHeaders(status response.StatusCode, h headers.Headers, endStream bool) error {
+	fields := []HeaderField{{Name: ":status", Value: strconv.Itoa(int(status))}}
+	st.headersSent = true
+	return st.writeHeaderBlock(append(fields, responseFields(h)...), endStream)
+}
+
+func (st *stream) WriteTrailers(h headers.Headers) error {
+	return st.writeHeaderBlock(responseFields(h), true)
+}
+
+// responseFields converts response headers to sorted header fields,
+// dropping those HTTP/2 forbids.
+func responseFields(h headers.Headers) []HeaderField {
+	fields := make([]HeaderField, 0, len(h))
+	for name, value := range h {
+		name = strings.ToLower(name)
+		if connectionSpecificHeaders[name] {
+			continue
+		}
+		fields = append(fields, HeaderField{Name: name, Value: value})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+func (st *stream) writeHeaderBlock(fields []HeaderField, endStream bool) error {
+	sc := st.sc
+
+	sc.mu.Lock()
+	if st.reset || st.localClosed || sc.closed {
+		sc.mu.Unlock()
+		return errStreamClosed
+	}
+	maxFrameSize := sc.peerMaxFrameSize
+	sc.mu.Unlock()
+
+	err := sc.writeFrames(func(fr *Framer) error {
+		if endStream {
+			st.closeLocal()
+		}
+		block := sc.enc.Encode(nil, fields)
+		return fr.WriteHeaders(st.id, block, endStream, maxFrameSize)
+	})
+	if endStream {
+		sc.closeIfDrained()
+	}
+	return err
+}
+
+// WriteData sends p as DATA frames, waiting for flow-control window as
+// needed.
+func (st *stream) WriteData(p []byte, endStream bool) error {
+	sc := st.sc
+
+	for len(p) > 0 || endStream {
+		sc.mu.Lock()
+		for {
+			if st.reset || st.localClosed || sc.closed {
+				sc.mu.Unlock()
+				return errStreamClosed
+			}
+			if len(p) == 0 || (st.sendWindow > 0 && sc.connSendWindow > 0) {
+				break
+			}
+			sc.cond.Wait()
+		}
+
+		n := int64(len(p))
+		n = min(n, st.sendWindow, sc.connSendWindow, int64(sc.peerMaxFrameSize))
+		st.sendWindow -= n
+		sc.connSendWindow -= n
+		sc.mu.Unlock()
+
+		chunk := p[:n]
+		p = p[n:]
+		end := endStream && len(p) == 0
+
+		var flags uint8
+		if end {
+			flags = FlagEndStream
+		}
+		err := sc.writeFrames(func(fr *Framer) error {
+			if end {
+				st.closeLocal()
+			}
+			return fr.WriteFrame(FrameData, flags, st.id, chunk)
+		})
+		if end {
+			sc.closeIfDrained()
+		}
+		if err != nil || end {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *stream) Flush() error {
+	return st.sc.writeFrames(func(fr *Framer) error { return nil })
+}
+
+// closeLocal records that the stream's last frame is being written. It is
+// called under wmu before that frame, so a client that opens a new stream
+// once it sees END_STREAM never finds this one still counted.
+func (st *stream) closeLocal() {
+	sc := st.sc
+
+	sc.mu.Lock()
+	st.localClosed = true
+	if st.remoteClosed {
+		sc.removeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+}
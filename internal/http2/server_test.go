@@ -0,0 +1,556 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testFrame struct {
+	FrameHeader
+	Payload []byte
+}
+
+// testClient speaks raw HTTP/2 to a server on the other end of a pipe.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	fr     *Framer
+	enc    *Encoder
+	dec    *Decoder
+	frames chan testFrame
+}
+
+type testResponse struct {
+	Headers  map[string]string
+	Body     string
+	Trailers map[string]string
+	Reset    ErrCode
+}
+
+func testHandler(release <-chan struct{}) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		var body string
+		switch req.RequestLine.RequestTarget {
+		case "/empty":
+			return
+		case "/big":
+			body = strings.Repeat("x", 200000)
+		case "/block":
+			<-release
+			body = "released"
+		case "/trailers":
+			body = req.Trailers.Get("x-check")
+		default:
+			body = fmt.Sprintf("%s %s %s %s %s", req.RequestLine.Method, req.RequestLine.RequestTarget,
+				req.Headers.Get("host"), req.RequestLine.HttpVersion, req.Body)
+		}
+
+		h := response.GetDefaultHeaders(len(body))
+		h.Override("Connection", "keep-alive")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+// dialTestConn starts srv on a pipe and reads its SETTINGS, leaving the
+// client preface unsent.
+func dialTestConn(t *testing.T, srv *Server, opts ServeConnOpts) (*testClient, <-chan error) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ServeConn(serverConn, opts) }()
+
+	c := &testClient{
+		t:      t,
+		conn:   clientConn,
+		fr:     NewFramer(clientConn, clientConn),
+		enc:    NewEncoder(),
+		dec:    NewDecoder(),
+		frames: make(chan testFrame, 1024),
+	}
+	c.fr.MaxReadFrameSize = maxFrameSizeLimit
+	t.Cleanup(func() { clientConn.Close() })
+
+	go func() {
+		defer close(c.frames)
+		for {
+			h, payload, err := c.fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			c.frames <- testFrame{h, append([]byte(nil), payload...)}
+		}
+	}()
+
+	settings := c.next()
+	require.Equal(t, FrameSettings, settings.Type)
+	assert.False(t, settings.Has(FlagAck))
+	return c, errc
+}
+
+func startTestConn(t *testing.T, srv *Server, opts ServeConnOpts) (*testClient, <-chan error) {
+	t.Helper()
+
+	c, errc := dialTestConn(t, srv, opts)
+	c.write(func(fr *Framer) error {
+		if _, err := c.conn.Write([]byte(ClientPreface)); err != nil {
+			return err
+		}
+		return fr.WriteSettings()
+	})
+	return c, errc
+}
+
+func startTestServer(t *testing.T, srv *Server) (*testClient, <-chan error) {
+	t.Helper()
+
+	c, errc := startTestConn(t, srv, ServeConnOpts{})
+	ack := c.next()
+	require.Equal(t, FrameSettings, ack.Type)
+	assert.True(t, ack.Has(FlagAck))
+	return c, errc
+}
+
+func (c *testClient) write(write func(fr *Framer) error) {
+	c.t.Helper()
+	require.NoError(c.t, write(c.fr))
+	require.NoError(c.t, c.fr.Flush())
+}
+
+func (c *testClient) next() testFrame {
+	c.t.Helper()
+	select {
+	case f, ok := <-c.frames:
+		require.True(c.t, ok, "connection closed")
+		return f
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("timed out waiting for a frame")
+		return testFrame{}
+	}
+}
+
+// nextOf skips frames until one of type typ arrives.
+func (c *testClient) nextOf(typ FrameType) testFrame {
+	c.t.Helper()
+	for {
+		if f := c.next(); f.Type == typ {
+			return f
+		}
+	}
+}
+
+func (c *testClient) headers(streamID uint32, endStream bool, fields ...HeaderField) {
+	c.t.Helper()
+	block := c.enc.Encode(nil, fields)
+	c.write(func(fr *Framer) error {
+		return fr.WriteHeaders(streamID, block, endStream, defaultMaxFrameSize)
+	})
+}
+
+func (c *testClient) get(streamID uint32, path string) {
+	c.t.Helper()
+	c.headers(streamID, true, requestFields("GET", path)...)
+}
+
+func requestFields(method, path string, extra ...HeaderField) []HeaderField {
+	return append([]HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "example.com"},
+	}, extra...)
+}
+
+// responses reads until n streams have ended or been reset, returning the
+// flow-control window for every DATA frame received.
+func (c *testClient) responses(n int) map[uint32]*testResponse {
+	c.t.Helper()
+
+	resps := map[uint32]*testResponse{}
+	get := func(id uint32) *testResponse {
+		if resps[id] == nil {
+			resps[id] = &testResponse{}
+		}
+		return resps[id]
+	}
+
+	for ended := 0; ended < n; {
+		f := c.next()
+		switch f.Type {
+		case FrameHeaders:
+			fields, err := c.dec.Decode(f.Payload)
+			require.NoError(c.t, err)
+			m := map[string]string{}
+			for _, field := range fields {
+				m[field.Name] = field.Value
+			}
+			resp := get(f.StreamID)
+			if resp.Headers == nil {
+				resp.Headers = m
+			} else {
+				resp.Trailers = m
+			}
+		case FrameData:
+			get(f.StreamID).Body += string(f.Payload)
+			// The server may already have closed a draining connection,
+			// so failed window updates are ignored.
+			if len(f.Payload) > 0 {
+				c.fr.WriteWindowUpdate(0, uint32(len(f.Payload)))
+				c.fr.WriteWindowUpdate(f.StreamID, uint32(len(f.Payload)))
+				c.fr.Flush()
+			}
+		case FrameRSTStream:
+			get(f.StreamID).Reset = ErrCode(binary.BigEndian.Uint32(f.Payload))
+			ended++
+			continue
+		default:
+			continue
+		}
+		if f.Has(FlagEndStream) {
+			ended++
+		}
+	}
+	return resps
+}
+
+func (c *testClient) goAway() (uint32, ErrCode) {
+	c.t.Helper()
+	f := c.nextOf(FrameGoAway)
+	return binary.BigEndian.Uint32(f.Payload), ErrCode(binary.BigEndian.Uint32(f.Payload[4:]))
+}
+
+func waitServe(t *testing.T, errc <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeConn did not return")
+		return nil
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	c, _ := startTestServer(t, &Server{Handler: testHandler(nil)})
+
+	// Test: GET is answered with pseudo-headers and no connection headers
+	c.get(1, "/hello")
+	resp := c.responses(1)[1]
+	assert.Equal(t, "200", resp.Headers[":status"])
+	assert.Equal(t, "GET /hello example.com 2.0 ", resp.Body)
+	assert.Equal(t, "27", resp.Headers["content-length"])
+	assert.NotContains(t, resp.Headers, "connection")
+
+	// Test: Request bodies are collected across DATA frames
+	c.headers(3, false, requestFields("POST", "/echo", HeaderField{Name: "content-length", Value: "11"})...)
+	c.write(func(fr *Framer) error {
+		if err := fr.WriteFrame(FrameData, 0, 3, []byte("hello ")); err != nil {
+			return err
+		}
+		return fr.WriteFrame(FrameData, FlagEndStream, 3, []byte("world"))
+	})
+	assert.Equal(t, "POST /echo example.com 2.0 hello world", c.responses(1)[3].Body)
+
+	// Test: Streams are multiplexed and large bodies wait for WINDOW_UPDATE
+	c.get(5, "/big")
+	c.get(7, "/one")
+	resps := c.responses(2)
+	assert.Len(t, resps[5].Body, 200000)
+	assert.Equal(t, "GET /one example.com 2.0 ", resps[7].Body)
+
+	// Test: Request trailers reach the handler
+	c.headers(9, false, requestFields("POST", "/trailers")...)
+	c.write(func(fr *Framer) error { return fr.WriteFrame(FrameData, 0, 9, []byte("x")) })
+	c.headers(9, true, HeaderField{Name: "x-check", Value: "ok"})
+	assert.Equal(t, "ok", c.responses(1)[9].Body)
+
+	// Test: Handlers that write nothing reset the stream
+	c.get(11, "/empty")
+	assert.Equal(t, ErrCodeInternal, c.responses(1)[11].Reset)
+
+	// Test: Malformed requests are reset with PROTOCOL_ERROR
+	malformed := [][]HeaderField{
+		requestFields("GET", "/", HeaderField{Name: "X-Upper", Value: "1"}),
+		requestFields("GET", "/", HeaderField{Name: "connection", Value: "close"}),
+		{{Name: ":method", Value: "GET"}, {Name: ":path", Value: "/"}},
+		{{Name: "accept", Value: "*/*"}, {Name: ":method", Value: "GET"}},
+	}
+	for i, fields := range malformed {
+		id := uint32(13 + 2*i)
+		c.headers(id, true, fields...)
+		assert.Equal(t, ErrCodeProtocol, c.responses(1)[id].Reset, "case %d", i)
+	}
+
+	// Test: PING is acknowledged with the same payload
+	c.write(func(fr *Framer) error { return fr.WriteFrame(FramePing, 0, 0, []byte("12345678")) })
+	ping := c.nextOf(FramePing)
+	assert.True(t, ping.Has(FlagAck))
+	assert.Equal(t, "12345678", string(ping.Payload))
+
+	// Test: Content-length mismatches reset the stream
+	c.headers(21, false, requestFields("POST", "/", HeaderField{Name: "content-length", Value: "5"})...)
+	c.write(func(fr *Framer) error { return fr.WriteFrame(FrameData, FlagEndStream, 21, []byte("abc")) })
+	assert.Equal(t, ErrCodeProtocol, c.responses(1)[21].Reset)
+}
+
+func TestServeConnLimits(t *testing.T) {
+	release := make(chan struct{})
+	srv := &Server{
+		Handler:              testHandler(release),
+		MaxConcurrentStreams: 1,
+		Limits:               request.Limits{MaxHeaderBytes: 1024, MaxBodyBytes: 8},
+	}
+	c, _ := startTestServer(t, srv)
+
+	// Test: Streams over MaxConcurrentStreams are refused
+	c.get(1, "/block")
+	c.get(3, "/one")
+	assert.Equal(t, ErrCodeRefusedStream, c.responses(1)[3].Reset)
+	close(release)
+	assert.Equal(t, "released", c.responses(1)[1].Body)
+
+	// Test: Oversized bodies get 413 and the stream is reset
+	c.headers(5, false, requestFields("POST", "/")...)
+	c.write(func(fr *Framer) error { return fr.WriteFrame(FrameData, 0, 5, []byte("too much data")) })
+	resp := c.responses(1)[5]
+	assert.Equal(t, "413", resp.Headers[":status"])
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(c.nextOf(FrameRSTStream).Payload)))
+
+	// Test: Oversized header lists get 431
+	c.headers(7, true, requestFields("GET", "/", HeaderField{Name: "x-big", Value: strings.Repeat("a", 1200)})...)
+	assert.Equal(t, "431", c.responses(1)[7].Headers[":status"])
+
+	// Test: A header block over the limit ends the connection undecoded
+	c.headers(9, true, requestFields("GET", "/", HeaderField{Name: "x-big", Value: strings.Repeat("~", 2000)})...)
+	_, code := c.goAway()
+	assert.Equal(t, ErrCodeEnhanceYourCalm, code)
+}
+
+func TestServeConnUnreadLimit(t *testing.T) {
+	srv := &Server{
+		Handler: testHandler(nil),
+		Limits:  request.Limits{MaxHeaderBytes: 1024, MaxBodyBytes: 8},
+	}
+	c, _ := startTestServer(t, srv)
+	data := func(id uint32, p string, end bool) {
+		flags := uint8(0)
+		if end {
+			flags = FlagEndStream
+		}
+		c.write(func(fr *Framer) error { return fr.WriteFrame(FrameData, flags, id, []byte(p)) })
+	}
+
+	// Test: Streams are refused once the connection holds too much unread body
+	for id := uint32(1); id <= 2*maxUnreadBodies; id += 2 {
+		c.headers(id, false, requestFields("POST", "/")...)
+		data(id, "12345678", false)
+	}
+	c.headers(2*maxUnreadBodies+1, false, requestFields("POST", "/")...)
+	data(2*maxUnreadBodies+1, "x", false)
+	assert.Equal(t, ErrCodeRefusedStream, c.responses(1)[2*maxUnreadBodies+1].Reset)
+
+	// Test: A body handed to its handler frees room for others
+	data(1, "", true)
+	assert.Equal(t, "POST / example.com 2.0 12345678", c.responses(1)[1].Body)
+	c.headers(2*maxUnreadBodies+3, false, requestFields("POST", "/")...)
+	data(2*maxUnreadBodies+3, "ok", true)
+	assert.Equal(t, "POST / example.com 2.0 ok", c.responses(1)[2*maxUnreadBodies+3].Body)
+}
+
+func TestServeConnRapidReset(t *testing.T) {
+	release := make(chan struct{})
+	srv := &Server{Handler: testHandler(release), MaxConcurrentStreams: 2}
+	c, _ := startTestServer(t, srv)
+	reset := func(id uint32) {
+		c.write(func(fr *Framer) error { return fr.WriteRSTStream(id, ErrCodeCancel) })
+	}
+
+	// Test: Handlers of streams the client reset still count as concurrent
+	c.get(1, "/block")
+	reset(1)
+	c.get(3, "/block")
+	reset(3)
+	c.get(5, "/one")
+	assert.Equal(t, ErrCodeRefusedStream, c.responses(1)[5].Reset)
+
+	// Test: Their slots free up once the handlers return
+	close(release)
+	for id := uint32(7); ; id += 2 {
+		require.Less(t, id, uint32(200), "slots never freed")
+		c.get(id, "/one")
+		if resp := c.responses(1)[id]; resp.Reset == 0 {
+			assert.Equal(t, "GET /one example.com 2.0 ", resp.Body)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Test: A client that keeps cancelling streams is sent GOAWAY
+	c, errc := startTestServer(t, srv)
+	for id := uint32(1); id <= 9; id += 2 {
+		c.headers(id, false, requestFields("POST", "/")...)
+		reset(id)
+	}
+	_, code := c.goAway()
+	assert.Equal(t, ErrCodeEnhanceYourCalm, code)
+	var ce ConnError
+	assert.ErrorAs(t, waitServe(t, errc), &ce)
+}
+
+func TestServeConnErrors(t *testing.T) {
+	cases := map[string]struct {
+		send func(c *testClient)
+		code ErrCode
+	}{
+		"DATA on stream 0": {
+			send: func(c *testClient) {
+				c.write(func(fr *Framer) error { return fr.WriteFrame(FrameData, 0, 0, []byte("x")) })
+			},
+			code: ErrCodeProtocol,
+		},
+		"even stream id": {
+			send: func(c *testClient) { c.get(2, "/") },
+			code: ErrCodeProtocol,
+		},
+		"PUSH_PROMISE": {
+			send: func(c *testClient) {
+				c.write(func(fr *Framer) error { return fr.WriteFrame(FramePushPromise, FlagEndHeaders, 1, make([]byte, 4)) })
+			},
+			code: ErrCodeProtocol,
+		},
+		"interrupted header block": {
+			send: func(c *testClient) {
+				c.write(func(fr *Framer) error {
+					if err := fr.WriteFrame(FrameHeaders, 0, 1, []byte{0x82}); err != nil {
+						return err
+					}
+					return fr.WriteFrame(FramePing, 0, 0, make([]byte, 8))
+				})
+			},
+			code: ErrCodeProtocol,
+		},
+		"window overflow": {
+			send: func(c *testClient) {
+				c.write(func(fr *Framer) error { return fr.WriteWindowUpdate(0, maxWindowSize) })
+			},
+			code: ErrCodeFlowControl,
+		},
+		"bad HPACK": {
+			send: func(c *testClient) {
+				c.write(func(fr *Framer) error {
+					return fr.WriteFrame(FrameHeaders, FlagEndHeaders|FlagEndStream, 1, []byte{0x80})
+				})
+			},
+			code: ErrCodeCompression,
+		},
+	}
+
+	for name, tc := range cases {
+		c, errc := startTestServer(t, &Server{Handler: testHandler(nil)})
+		tc.send(c)
+		_, code := c.goAway()
+		assert.Equal(t, tc.code, code, name)
+
+		var ce ConnError
+		assert.ErrorAs(t, waitServe(t, errc), &ce, name)
+	}
+
+	// Test: The first frame must be SETTINGS
+	c, errc := dialTestConn(t, &Server{Handler: testHandler(nil)}, ServeConnOpts{})
+	c.write(func(fr *Framer) error {
+		if _, err := c.conn.Write([]byte(ClientPreface)); err != nil {
+			return err
+		}
+		return fr.WriteFrame(FramePing, 0, 0, make([]byte, 8))
+	})
+	_, code := c.goAway()
+	assert.Equal(t, ErrCodeProtocol, code)
+	assert.Error(t, waitServe(t, errc))
+}
+
+func TestServeConnShutdown(t *testing.T) {
+	release := make(chan struct{})
+	shutdown := make(chan struct{})
+	c, errc := startTestServer(t, &Server{Handler: testHandler(release), Shutdown: shutdown})
+
+	// Test: Shutdown sends GOAWAY and finishes streams already started
+	c.get(1, "/block")
+	time.Sleep(20 * time.Millisecond)
+	close(shutdown)
+	last, code := c.goAway()
+	assert.Equal(t, uint32(1), last)
+	assert.Equal(t, ErrCodeNo, code)
+
+	c.get(3, "/one")
+	close(release)
+	resps := c.responses(1)
+	assert.Equal(t, "released", resps[1].Body)
+	assert.NotContains(t, resps, uint32(3))
+	assert.NoError(t, waitServe(t, errc))
+
+	// Test: Idle connections are closed after IdleTimeout
+	c, errc = startTestServer(t, &Server{Handler: testHandler(nil), IdleTimeout: 50 * time.Millisecond})
+	_, code = c.goAway()
+	assert.Equal(t, ErrCodeNo, code)
+	assert.NoError(t, waitServe(t, errc))
+
+	// Test: A client GOAWAY ends the connection cleanly
+	c, errc = startTestServer(t, &Server{Handler: testHandler(nil)})
+	c.write(func(fr *Framer) error { return fr.WriteGoAway(0, ErrCodeNo, "") })
+	assert.NoError(t, waitServe(t, errc))
+}
+
+func TestServeConnUpgrade(t *testing.T) {
+	newUpgrade := func(settings string) *request.Request {
+		h := headers.NewHeaders()
+		h.Set("Host", "example.com")
+		h.Set("Connection", "Upgrade, HTTP2-Settings")
+		h.Set("Upgrade", "h2c")
+		h.Set("HTTP2-Settings", settings)
+		return &request.Request{
+			RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/up", HttpVersion: "1.1"},
+			Headers:     h,
+		}
+	}
+
+	// Test: Upgrade requests are recognised and their settings decoded
+	settings, ok := UpgradeSettings(newUpgrade("AAMAAABkAAQAoAAA"))
+	require.True(t, ok)
+	parsed, err := parseSettings(settings)
+	require.NoError(t, err)
+	assert.Equal(t, []Setting{{SettingMaxConcurrentStreams, 100}, {SettingInitialWindowSize, 10485760}}, parsed)
+
+	_, ok = UpgradeSettings(newUpgrade("AAMAAABk="))
+	assert.True(t, ok)
+	for _, bad := range []string{"AAMAAA", "!!!", "AAMAAABk, AAMAAABk"} {
+		_, ok = UpgradeSettings(newUpgrade(bad))
+		assert.False(t, ok, bad)
+	}
+	req := newUpgrade("")
+	req.Headers.Override("Connection", "Upgrade")
+	_, ok = UpgradeSettings(req)
+	assert.False(t, ok)
+
+	// Test: The upgrading request is answered on stream 1
+	req = newUpgrade("AAMAAABk")
+	settings, _ = UpgradeSettings(req)
+	c, _ := startTestConn(t, &Server{Handler: testHandler(nil)}, ServeConnOpts{Upgrade: req, Settings: settings})
+	resp := c.responses(1)[1]
+	assert.Equal(t, "GET /up example.com 2.0 ", resp.Body)
+
+	// Test: Later streams continue after stream 1
+	c.get(3, "/next")
+	assert.Equal(t, "GET /next example.com 2.0 ", c.responses(1)[3].Body)
+}
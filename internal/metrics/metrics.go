@@ -0,0 +1,270 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Collector is a metric that can render itself in the Prometheus text
+// exposition format.
+type Collector interface {
+	writeText(w io.Writer, name string) error
+	metricType() string
+}
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+func (c *Counter) metricType() string {
+	return "counter"
+}
+
+func (c *Counter) writeText(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", name, c.Value())
+	return err
+}
+
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+func (g *Gauge) metricType() string {
+	return "gauge"
+}
+
+func (g *Gauge) writeText(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", name, g.Value())
+	return err
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	labels []string
+
+	mu       sync.RWMutex
+	counters map[string]*Counter
+}
+
+func NewCounterVec(labels ...string) *CounterVec {
+	return &CounterVec{
+		labels:   labels,
+		counters: make(map[string]*Counter),
+	}
+}
+
+// With returns the counter for the given label values, which must match the
+// label names passed to NewCounterVec in number and order.
+func (v *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(v.labels), len(values)))
+	}
+
+	key := formatLabels(v.labels, values)
+
+	v.mu.RLock()
+	c, ok := v.counters[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.counters[key]; !ok {
+		c = &Counter{}
+		v.counters[key] = c
+	}
+	return c
+}
+
+func (v *CounterVec) metricType() string {
+	return "counter"
+}
+
+func (v *CounterVec) writeText(w io.Writer, name string) error {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.counters))
+	for key := range v.counters {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		c := v.counters[key]
+		v.mu.RUnlock()
+		if _, err := fmt.Fprintf(w, "%s%s %d\n", name, key, c.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultBuckets are latency buckets in seconds suited to request handling.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sumBits atomic.Uint64
+}
+
+// NewHistogram returns a histogram with the given upper bounds, which must
+// be sorted in increasing order. The +Inf bucket is implicit.
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64frombits(old) + v
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+func (h *Histogram) metricType() string {
+	return "histogram"
+}
+
+func (h *Histogram) writeText(w io.Writer, name string) error {
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i].Load()
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, le, cumulative); err != nil {
+			return err
+		}
+	}
+
+	count := h.count.Load()
+	sum := math.Float64frombits(h.sumBits.Load())
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n",
+		name, count, name, strconv.FormatFloat(sum, 'g', -1, 64), name, count)
+	return err
+}
+
+type registered struct {
+	name      string
+	help      string
+	collector Collector
+}
+
+// Registry holds named collectors and renders them in registration order.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []registered
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(name, help string, c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, registered{name: name, help: help, collector: c})
+}
+
+// WriteText renders every collector in the Prometheus text exposition
+// format, version 0.0.4.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]registered(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n",
+			c.name, escapeHelp(c.help), c.name, c.collector.metricType()); err != nil {
+			return err
+		}
+		if err := c.collector.writeText(w, c.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ContentType is the media type of WriteText output.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func formatLabels(names, values []string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	requests := NewCounterVec("method", "status")
+	requests.With("GET", "200").Add(3)
+	requests.With("POST", "500").Inc()
+	requests.With("GET", "200").Inc()
+	r.Register("requests_total", "Requests served.", requests)
+
+	active := &Gauge{}
+	active.Inc()
+	active.Inc()
+	active.Dec()
+	r.Register("active", "Open connections.", active)
+
+	latency := NewHistogram([]float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(0.5)
+	latency.Observe(3)
+	r.Register("latency_seconds", "Latency.", latency)
+
+	weird := NewCounterVec("kind")
+	weird.With("a\"b\\c\nd").Inc()
+	r.Register("weird_total", "Help with \\ and\nnewline.", weird)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+
+	// Test: Exposition output, including escaping and cumulative buckets
+	assert.Equal(t, `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 4
+requests_total{method="POST",status="500"} 1
+# HELP active Open connections.
+# TYPE active gauge
+active 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.65
+latency_seconds_count 4
+# HELP weird_total Help with \\ and\nnewline.
+# TYPE weird_total counter
+weird_total{kind="a\"b\\c\nd"} 1
+`, buf.String())
+
+	// Test: Wrong number of label values panics
+	assert.Panics(t, func() { requests.With("GET") })
+}
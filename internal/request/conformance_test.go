@@ -0,0 +1,298 @@
+package request
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conformanceCorpus is fed to both RequestFromReader and net/http's
+// ReadRequest. Names are referenced by knownDifferences.
+var conformanceCorpus = []struct {
+	name string
+	raw  string
+}{
+	// Valid requests
+	{"simple get", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"curl", "GET /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"},
+	{"query string", "GET /search?q=a+b&x=%20 HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"fragment-free absolute path", "GET /a/b/../c HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"absolute form", "GET http://example.com/x?y=1 HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"asterisk form", "OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"authority form", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"},
+	{"http/1.0 without host", "GET / HTTP/1.0\r\n\r\n"},
+	{"http/1.0 with host", "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n"},
+	{"head", "HEAD /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"delete", "DELETE /item/1 HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"custom method", "PURGE /cache HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"post with content-length", "POST /form HTTP/1.1\r\nHost: example.com\r\nContent-Length: 13\r\n\r\nname=a&age=42"},
+	{"put empty body", "PUT /x HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n"},
+	{"chunked", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"},
+	{"chunked uppercase hex", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\nA\r\n0123456789\r\n0\r\n\r\n"},
+	{"chunked with extension", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5;name=value\r\nhello\r\n0\r\n\r\n"},
+	{"chunked with trailers", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n5\r\nhello\r\n0\r\nX-Checksum: abc\r\n\r\n"},
+	{"chunked empty", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"},
+	{"transfer-encoding case", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: Chunked\r\n\r\n0\r\n\r\n"},
+	{"repeated header", "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: a\r\nAccept: b\r\n\r\n"},
+	{"header case folding", "GET / HTTP/1.1\r\nhOsT: example.com\r\nX-MiXeD: v\r\n\r\n"},
+	{"optional whitespace", "GET / HTTP/1.1\r\nHost:    example.com   \r\nX-Tab:\tv\t\r\n\r\n"},
+	{"empty header value", "GET / HTTP/1.1\r\nHost: example.com\r\nX-Empty:\r\n\r\n"},
+	{"header value with colon", "GET / HTTP/1.1\r\nHost: example.com\r\nX-Time: 12:30:00\r\n\r\n"},
+	{"token punctuation in name", "GET / HTTP/1.1\r\nHost: example.com\r\nX!#$%&'*+.^_`|~-: v\r\n\r\n"},
+	{"utf-8 header value", "GET / HTTP/1.1\r\nHost: example.com\r\nX-Name: caf\xc3\xa9\r\n\r\n"},
+	{"duplicate identical content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc"},
+	{"leading zero content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 003\r\n\r\nabc"},
+	{"connection close", "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"},
+	{"cookie headers", "GET / HTTP/1.1\r\nHost: example.com\r\nCookie: a=1\r\nCookie: b=2\r\n\r\n"},
+	{"long target", "GET /" + strings.Repeat("a", 4000) + " HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"many headers", "GET / HTTP/1.1\r\nHost: example.com\r\n" + strings.Repeat("X-Many: v\r\n", 100) + "\r\n"},
+	{"pipelined first", "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\nGET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+
+	// Malformed request lines
+	{"empty", ""},
+	{"blank line", "\r\n"},
+	{"missing version", "GET /\r\nHost: example.com\r\n\r\n"},
+	{"extra field", "GET / HTTP/1.1 extra\r\nHost: example.com\r\n\r\n"},
+	{"double space", "GET  / HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"lowercase method", "get / HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"method with separator", "GE(T / HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"lowercase version", "GET / http/1.1\r\nHost: example.com\r\n\r\n"},
+	{"version 2.0", "GET / HTTP/2.0\r\nHost: example.com\r\n\r\n"},
+	{"version 0.9", "GET / HTTP/0.9\r\n\r\n"},
+	{"version garbage", "GET / HTTP/1.x\r\nHost: example.com\r\n\r\n"},
+	{"version multiple digits", "GET / HTTP/1.10\r\nHost: example.com\r\n\r\n"},
+	{"relative target", "GET index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"asterisk with get", "GET * HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"connect with path", "CONNECT /path HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"connect without port", "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	{"bare lf line endings", "GET / HTTP/1.1\nHost: example.com\n\n"},
+	{"truncated request line", "GET / HTTP/1.1"},
+	{"nul in target", "GET /a\x00b HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+
+	// Malformed headers
+	{"missing host", "GET / HTTP/1.1\r\n\r\n"},
+	{"duplicate host", "GET / HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n\r\n"},
+	{"empty duplicate host", "GET / HTTP/1.1\r\nHost:\r\nHost: b.example\r\n\r\n"},
+	{"space before colon", "GET / HTTP/1.1\r\nHost : example.com\r\n\r\n"},
+	{"space in name", "GET / HTTP/1.1\r\nHost: example.com\r\nX Bad: v\r\n\r\n"},
+	{"no colon", "GET / HTTP/1.1\r\nHost: example.com\r\nNoColon\r\n\r\n"},
+	{"empty name", "GET / HTTP/1.1\r\nHost: example.com\r\n: v\r\n\r\n"},
+	{"obs-fold", "GET / HTTP/1.1\r\nHost: example.com\r\nX-Folded: a\r\n b\r\n\r\n"},
+	{"leading whitespace first header", "GET / HTTP/1.1\r\n Host: example.com\r\n\r\n"},
+	{"non-token name", "GET / HTTP/1.1\r\nHost: example.com\r\nX\xc3\xa9: v\r\n\r\n"},
+	{"nul in value", "GET / HTTP/1.1\r\nHost: example.com\r\nX-Nul: a\x00b\r\n\r\n"},
+	{"bare cr in value", "GET / HTTP/1.1\r\nHost: example.com\r\nX-Cr: a\rb\r\n\r\n"},
+	{"folded chunked trailer", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n X-Sum: a\r\n\r\n"},
+	{"truncated headers", "GET / HTTP/1.1\r\nHost: example.com\r\n"},
+
+	// Framing and smuggling
+	{"content-length and chunked", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"},
+	{"conflicting content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd"},
+	{"comma content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3, 3\r\n\r\nabc"},
+	{"negative content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: -1\r\n\r\n"},
+	{"plus content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: +3\r\n\r\nabc"},
+	{"hex content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0x3\r\n\r\nabc"},
+	{"huge content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 99999999999999999999\r\n\r\n"},
+	{"empty content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length:\r\n\r\nabc"},
+	{"empty then valid content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length:\r\nContent-Length: 3\r\n\r\nabc"},
+	{"empty transfer-encoding with content-length", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding:\r\nContent-Length: 3\r\n\r\nabc"},
+	{"short body", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10\r\n\r\nabc"},
+	{"gzip then chunked", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n"},
+	{"chunked then identity", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n"},
+	{"unknown transfer-encoding", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: foo\r\n\r\n"},
+	{"chunked twice", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"},
+	{"bad chunk size", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n"},
+	{"overflowing chunk size", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\nfffffffffffffffff\r\n"},
+	{"chunk longer than size", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcdef\r\n0\r\n\r\n"},
+	{"missing chunk crlf", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc0\r\n\r\n"},
+	{"truncated chunked body", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel"},
+	{"missing last chunk", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"},
+	{"signed chunk size", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n+5\r\nhello\r\n0\r\n\r\n"},
+	{"chunk size with space", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5 \r\nhello\r\n0\r\n\r\n"},
+	{"bad trailer", "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nBad Trailer: x\r\n\r\n"},
+}
+
+// knownDifferences are deliberate departures from net/http, keyed by case
+// name. Each must still disagree, so stale entries are reported.
+var knownDifferences = map[string]string{
+	// Stricter request line
+	"lowercase method":     "methods are limited to uppercase letters",
+	"version 2.0":          "only HTTP/1.x is served by this parser",
+	"version 0.9":          "only HTTP/1.x is served by this parser",
+	"asterisk with get":    "asterisk-form is only allowed for OPTIONS",
+	"connect with path":    "CONNECT requires authority-form",
+	"connect without port": "CONNECT requires a port",
+	"bare lf line endings": "lines must end in CRLF",
+
+	// Stricter fields (RFC 9112 section 5)
+	"space before colon": "whitespace before the colon is rejected",
+	"space in name":      "field names must be tokens",
+	"obs-fold":           "obsolete line folding is rejected",
+	"bad trailer":        "trailer fields are parsed like header fields",
+
+	// Framing
+	"content-length and chunked":  "both framing headers is a smuggling vector and is rejected",
+	"comma content-length":        "a list of identical lengths is allowed (RFC 9110 section 8.6)",
+	"leading zero content-length": "the length is normalised",
+
+	// Left to later stages or kept as sent
+	"duplicate host":         "multiple Host fields are merged and rejected by ValidateHost",
+	"empty duplicate host":   "multiple Host fields are merged and rejected by ValidateHost",
+	"transfer-encoding case": "field values are kept as sent",
+}
+
+// parsedRequest is the subset of a request both parsers produce.
+type parsedRequest struct {
+	method   string
+	target   string
+	version  string
+	host     string
+	headers  map[string]string
+	body     string
+	trailers map[string]string
+}
+
+func parseOurs(raw string) (*parsedRequest, error) {
+	r, err := RequestFromReader(strings.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parsedRequest{
+		method:   r.RequestLine.Method,
+		target:   r.RequestLine.RequestTarget,
+		version:  r.RequestLine.HttpVersion,
+		host:     r.Headers.Get("host"),
+		headers:  map[string]string{},
+		body:     string(r.Body),
+		trailers: map[string]string{},
+	}
+	for key, value := range r.Headers {
+		p.headers[key] = value
+	}
+	for key, value := range r.Trailers {
+		p.trailers[key] = value
+	}
+	return p, nil
+}
+
+func parseNetHTTP(raw string) (*parsedRequest, error) {
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parsedRequest{
+		method:   r.Method,
+		target:   r.RequestURI,
+		version:  fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor),
+		host:     r.Host,
+		headers:  map[string]string{},
+		body:     string(body),
+		trailers: map[string]string{},
+	}
+	for key, values := range r.Header {
+		p.headers[strings.ToLower(key)] = strings.Join(values, ", ")
+	}
+	// net/http moves these out of Header.
+	if r.Host != "" {
+		p.headers["host"] = r.Host
+	}
+	if len(r.TransferEncoding) > 0 {
+		p.headers["transfer-encoding"] = strings.Join(r.TransferEncoding, ", ")
+	}
+	for key, values := range r.Trailer {
+		p.trailers[strings.ToLower(key)] = strings.Join(values, ", ")
+	}
+	return p, nil
+}
+
+// differences lists how the two parsers disagree about raw.
+func differences(raw string) []string {
+	ours, ourErr := parseOurs(raw)
+	theirs, theirErr := parseNetHTTP(raw)
+
+	if (ourErr == nil) != (theirErr == nil) {
+		return []string{fmt.Sprintf("accept/reject: ours %v, net/http %v", ourErr, theirErr)}
+	}
+	if ourErr != nil {
+		return nil
+	}
+
+	var diffs []string
+	compare := func(what, a, b string) {
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("%s: ours %q, net/http %q", what, a, b))
+		}
+	}
+	compare("method", ours.method, theirs.method)
+	compare("target", ours.target, theirs.target)
+	compare("version", ours.version, theirs.version)
+	compare("host", ours.host, theirs.host)
+	compare("body", ours.body, theirs.body)
+	compareFields := func(what string, a, b map[string]string) {
+		// Trailer is consumed by net/http's framing logic.
+		delete(a, "trailer")
+		delete(b, "trailer")
+		for _, key := range unionKeys(a, b) {
+			compare(what+" "+key, a[key], b[key])
+		}
+	}
+	compareFields("header", ours.headers, theirs.headers)
+	compareFields("trailer", ours.trailers, theirs.trailers)
+	return diffs
+}
+
+func unionKeys(a, b map[string]string) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, m := range []map[string]string{a, b} {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestConformance(t *testing.T) {
+	names := map[string]bool{}
+	for _, tc := range conformanceCorpus {
+		assert.False(t, names[tc.name], "duplicate case %q", tc.name)
+		names[tc.name] = true
+
+		diffs := differences(tc.raw)
+		if reason, ok := knownDifferences[tc.name]; ok {
+			assert.NotEmpty(t, diffs, "%s: listed as a known difference (%s) but the parsers agree", tc.name, reason)
+			continue
+		}
+		for _, d := range diffs {
+			t.Errorf("%s: %s", tc.name, d)
+		}
+	}
+
+	for name := range knownDifferences {
+		assert.True(t, names[name], "known difference %q has no corpus entry", name)
+	}
+
+	// Test: Transfer-Encoding in HTTP/1.0 is faulty framing, whichever way
+	// it is read, so the connection closes after the request even if the
+	// client asked to keep it open (RFC 9112 section 6.1)
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.0\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+}
@@ -1,19 +1,58 @@
 package request
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"httpfromtcp/internal/chunked"
 	"httpfromtcp/internal/headers"
 	"io"
+	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
+	Trailers    headers.Headers
 	State       RequestState
 	Body        []byte
+
+	// RemoteAddr is the network address of the client, set by the server.
+	RemoteAddr string
+
+	// TLS holds the negotiated connection state when the request arrived
+	// over TLS, and is nil otherwise.
+	TLS *tls.ConnectionState
+
+	limits         Limits
+	headerBytes    int
+	hostFields     int
+	contentLength  int
+	chunkRemaining int
+	// source is the Reader still receiving the body of a request returned
+	// by ReadRequestHeader. bodyRead counts the body bytes already handed
+	// out and dropped from Body, and bodyOff how much of Body has been.
+	source   *Reader
+	bodyRead int
+	bodyOff  int
+	bodyErr  error
+}
+
+// Limits bounds how much of a request RequestFromReaderWithLimits will
+// buffer before giving up.
+type Limits struct {
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+}
+
+var DefaultLimits = Limits{
+	MaxHeaderBytes: 1 << 20,
+	MaxBodyBytes:   10 << 20,
 }
 
 type RequestLine struct {
@@ -25,134 +64,438 @@ type RequestLine struct {
 type RequestState string
 
 const (
-	InitialState RequestState = "Initial"
-	HeadersState RequestState = "Headers"
-	BodyState    RequestState = "Body"
-	DoneState    RequestState = "Done"
+	InitialState   RequestState = "Initial"
+	HeadersState   RequestState = "Headers"
+	BodyState      RequestState = "Body"
+	ChunkSizeState RequestState = "ChunkSize"
+	ChunkDataState RequestState = "ChunkData"
+	TrailersState  RequestState = "Trailers"
+	DoneState      RequestState = "Done"
+)
+
+// Parse errors. Callers should match these with errors.Is; the wrapped
+// message carries the offending input and is meant for logs only.
+var (
+	ErrMalformedRequestLine = errors.New("malformed request line")
+	ErrUnsupportedVersion   = errors.New("unsupported HTTP version")
+	ErrHeaderTooLarge       = errors.New("request header too large")
+	ErrBodyTooLarge         = errors.New("request body too large")
+	ErrIncompleteRequest    = errors.New("incomplete request")
+	ErrTimeout              = errors.New("timed out reading request")
+	ErrMissingHost          = errors.New("missing host header")
+	ErrMultipleHost         = errors.New("multiple host headers")
+	ErrInvalidTarget        = errors.New("invalid request target")
+)
+
+// Framing errors. Each one identifies a distinct way a request could be
+// interpreted differently by two parsers, so they are always rejected.
+var (
+	ErrWhitespaceAfterStartLine          = errors.New("whitespace between request line and first header")
+	ErrInvalidContentLength              = errors.New("invalid content-length")
+	ErrConflictingContentLength          = errors.New("conflicting content-length values")
+	ErrContentLengthWithTransferEncoding = errors.New("both content-length and transfer-encoding present")
+	ErrInvalidTransferEncoding           = errors.New("invalid transfer-encoding")
+	ErrUnsupportedTransferEncoding       = errors.New("unsupported transfer-encoding")
+	ErrChunkedNotFinal                   = errors.New("chunked is not the final transfer-coding")
+	ErrInvalidChunk                      = errors.New("invalid chunked encoding")
+)
+
+const (
+	bufferSize = 1024
+	// maxPooledBuffer keeps buffers grown by unusually large requests out
+	// of the pool.
+	maxPooledBuffer = 64 << 10
+	maxBodyPrealloc = 64 << 10
+)
+
+var (
+	readerPool = sync.Pool{
+		New: func() any {
+			return &Reader{buf: make([]byte, bufferSize)}
+		},
+	}
+	requestPool = sync.Pool{
+		New: func() any {
+			return &Request{
+				Headers:  headers.NewHeaders(),
+				Trailers: headers.NewHeaders(),
+			}
+		},
+	}
 )
 
-const bufferSize = 1024
+var crlf = []byte("\r\n")
+
+// Reader parses successive requests from a single connection. Bytes read
+// past the end of one request, such as a pipelined follow-up, are kept for
+// the next call to ReadRequest.
+type Reader struct {
+	Limits Limits
+
+	reader io.Reader
+	buf    []byte
+	// Unparsed input is buf[start:end].
+	start, end int
+	// pending is the request being parsed, once its first byte arrived.
+	pending *Request
+	// streaming means pending was returned by ReadRequestHeader and now
+	// belongs to the caller.
+	streaming bool
+}
+
+// NewReader returns a Reader from a pool shared by all connections. Call
+// Release once the connection is done with it.
+func NewReader(reader io.Reader) *Reader {
+	rr := readerPool.Get().(*Reader)
+	rr.Limits = DefaultLimits
+	rr.reader = reader
+	return rr
+}
+
+// Buffered returns the bytes that have been read from the underlying reader
+// but not yet consumed by a request. The slice is only valid until the next
+// call to ReadRequest or Release.
+func (rr *Reader) Buffered() []byte {
+	return rr.buf[rr.start:rr.end]
+}
+
+// Release resets the Reader, dropping any buffered bytes, and returns it to
+// the pool. Neither the Reader nor slices from Buffered may be used
+// afterwards.
+func (rr *Reader) Release() {
+	rr.discard()
+	rr.reader = nil
+	if cap(rr.buf) <= maxPooledBuffer {
+		readerPool.Put(rr)
+	}
+}
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := newRequest()
+	return RequestFromReaderWithLimits(reader, DefaultLimits)
+}
 
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
+func RequestFromReaderWithLimits(reader io.Reader, limits Limits) (*Request, error) {
+	rr := NewReader(reader)
+	defer rr.Release()
+	rr.Limits = limits
+	return rr.ReadRequest()
+}
 
-	for !request.isDone() {
-		if readToIndex == len(buf) {
-			newBuf := make([]byte, len(buf)*2)
+// ReadRequest parses the next request. It returns io.EOF if the reader is
+// exhausted before the first byte of a new request arrives.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	return rr.read(nil)
+}
+
+// ReadRequestHeader parses the next request up to the end of its header
+// section, leaving the body to be read with BodyReader as it arrives. The
+// request's Body then holds only the part received but not yet read, and
+// the Reader must not be used for another request until the body has been
+// read to the end.
+func (rr *Reader) ReadRequestHeader() (*Request, error) {
+	request, err := rr.read(func(r *Request) bool { return !r.inFields() })
+	if request != nil && !request.isDone() {
+		request.source = rr
+		rr.streaming = true
+	}
+	return request, err
+}
 
-			copy(newBuf, buf[:readToIndex])
+// read parses the pending request, reading more input until it is done or
+// ready reports true for it.
+func (rr *Reader) read(ready func(*Request) bool) (*Request, error) {
+	var readErr error
+	for {
+		request, numBytesParsed, err := rr.next(ready)
+		if err != nil || request != nil {
+			return request, err
+		}
 
-			buf = newBuf
+		if readErr != nil {
+			return nil, rr.InputError(readErr)
 		}
 
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+		rr.reserve(1)
+
+		var numBytesRead int
+		numBytesRead, readErr = rr.reader.Read(rr.buf[rr.end:])
 		if numBytesRead > 0 {
-			readToIndex += numBytesRead
+			rr.end += numBytesRead
 		}
 
-		numBytesParsed, pErr := request.parse(buf[:readToIndex])
-		if pErr != nil {
-			return nil, pErr
+		if numBytesRead == 0 && numBytesParsed == 0 && readErr == nil {
+			return nil, io.ErrNoProgress
 		}
+	}
+}
 
-		if numBytesParsed > 0 {
-			copy(buf, buf[numBytesParsed:readToIndex])
-			readToIndex -= numBytesParsed
-		}
+// Write appends p to the input, for callers that read the connection
+// themselves and collect requests with Next instead of ReadRequest.
+func (rr *Reader) Write(p []byte) (int, error) {
+	rr.reserve(len(p))
+	rr.end += copy(rr.buf[rr.end:], p)
+	return len(p), nil
+}
+
+// Next parses a request from the input already received, without reading.
+// It returns nil and no error while the request is incomplete.
+func (rr *Reader) Next() (*Request, error) {
+	request, _, err := rr.next(nil)
+	return request, err
+}
+
+// Pending reports whether part of a request has been received.
+func (rr *Reader) Pending() bool {
+	return rr.pending != nil || rr.start < rr.end
+}
+
+// InputError returns the error ReadRequest reports when reading the
+// connection fails with err. Between requests, both the end of input and an
+// expired deadline are io.EOF: an idle keep-alive connection timing out is
+// its ordinary end. In the middle of a request they are
+// ErrIncompleteRequest and ErrTimeout. Other errors are returned as is. Any
+// partly received request is discarded.
+func (rr *Reader) InputError(err error) error {
+	pending, state := rr.Pending(), InitialState
+	if rr.pending != nil {
+		state = rr.pending.State
+	}
+	rr.discard()
 
-		if request.isDone() {
-			return request, nil
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, os.ErrDeadlineExceeded):
+		if !pending {
+			return io.EOF
 		}
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: in state %s", ErrIncompleteRequest, state)
+		}
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
 
-		if err != nil {
-			fmt.Printf("Error reading from reader: %v\n", err)
-			if errors.Is(err, io.EOF) {
-				if request.State != DoneState {
-					return nil, fmt.Errorf("incomplete request")
-				}
-				break
-			}
-			return nil, err
+// next advances the pending request over the buffered input and returns it
+// once complete, or once ready reports true, along with the number of bytes
+// consumed.
+func (rr *Reader) next(ready func(*Request) bool) (*Request, int, error) {
+	if rr.pending == nil {
+		if rr.start == rr.end {
+			return nil, 0, nil
 		}
+		rr.pending = newRequest()
+		rr.pending.limits = rr.Limits
+	}
+	request := rr.pending
 
-		if numBytesRead == 0 && numBytesParsed == 0 {
-			return nil, io.ErrNoProgress
+	n, err := request.parse(rr.buf[rr.start:rr.end])
+	if err != nil {
+		rr.discard()
+		return nil, 0, err
+	}
+
+	rr.start += n
+	if rr.start == rr.end {
+		rr.start, rr.end = 0, 0
+	}
+
+	if request.isDone() {
+		rr.pending, rr.streaming = nil, false
+		return request, n, nil
+	}
+
+	if request.inFields() && request.headerBytes+rr.end-rr.start > rr.Limits.MaxHeaderBytes {
+		rr.discard()
+		return nil, n, fmt.Errorf("%w: more than %d bytes", ErrHeaderTooLarge, rr.Limits.MaxHeaderBytes)
+	}
+
+	if ready != nil && ready(request) {
+		return request, n, nil
+	}
+
+	return nil, n, nil
+}
+
+// discard drops the pending request and all unparsed input, once the
+// connection cannot carry another request. A request being streamed is left
+// to its owner to release.
+func (rr *Reader) discard() {
+	if rr.pending != nil && !rr.streaming {
+		rr.pending.Release()
+	}
+	rr.pending, rr.streaming = nil, false
+	rr.start, rr.end = 0, 0
+}
+
+// reserve ensures there is room for n more bytes, first by moving unparsed
+// bytes to the front and only then by growing the buffer.
+func (rr *Reader) reserve(n int) {
+	if len(rr.buf)-rr.end >= n {
+		return
+	}
+
+	if rr.start > 0 {
+		rr.end = copy(rr.buf, rr.buf[rr.start:rr.end])
+		rr.start = 0
+		if len(rr.buf)-rr.end >= n {
+			return
 		}
 	}
 
-	return request, nil
+	size := len(rr.buf) * 2
+	for size-rr.end < n {
+		size *= 2
+	}
+	newBuf := make([]byte, size)
+	copy(newBuf, rr.buf[:rr.end])
+	rr.buf = newBuf
 }
 
-func parseRequestLine(request string) (*RequestLine, int, error) {
-	i := strings.Index(request, "\r\n")
+func parseRequestLine(data []byte) (RequestLine, int, error) {
+	i := bytes.Index(data, crlf)
 	if i == -1 {
-		return nil, 0, nil
+		return RequestLine{}, 0, nil
 	}
 
-	requestLine := request[:i]
+	line := data[:i]
 
-	fields := strings.Fields(requestLine)
-	if len(fields) != 3 {
-		return nil, 0, fmt.Errorf("invalid request line: %s", requestLine)
+	// Exactly one SP between the parts (RFC 9112 section 3).
+	method, rest, ok1 := bytes.Cut(line, []byte(" "))
+	target, version, ok2 := bytes.Cut(rest, []byte(" "))
+	if !ok1 || !ok2 || bytes.IndexByte(version, ' ') != -1 {
+		return RequestLine{}, 0, fmt.Errorf("%w: %q", ErrMalformedRequestLine, line)
 	}
 
-	method, requestTarget, httpVersion := fields[0], fields[1], fields[2]
-
 	if !isUppercase(method) {
-		return nil, 0, fmt.Errorf("invalid method: %s", method)
+		return RequestLine{}, 0, fmt.Errorf("%w: invalid method %q", ErrMalformedRequestLine, method)
 	}
 
-	cleanedVersion, err := parseHTTPVersion(httpVersion)
+	cleanedVersion, err := parseHTTPVersion(version)
 	if err != nil {
-		return nil, 0, fmt.Errorf("invalid HTTP version: %s", httpVersion)
+		return RequestLine{}, 0, err
 	}
 
-	return &RequestLine{
-		Method:        method,
-		RequestTarget: requestTarget,
+	requestLine := RequestLine{
+		Method:        methodString(method),
+		RequestTarget: string(target),
 		HttpVersion:   cleanedVersion,
-	}, len(request[:i]) + len("\r\n"), nil
+	}
+	if err := validateTarget(requestLine.Method, requestLine.RequestTarget); err != nil {
+		return RequestLine{}, 0, err
+	}
+
+	return requestLine, i + len(crlf), nil
 }
 
-func parseHTTPVersion(version string) (string, error) {
-	const pfx = "HTTP/"
-	if !strings.HasPrefix(version, pfx) {
-		return "", fmt.Errorf("invalid HTTP version: %s", version)
+// methodString avoids allocating for the standard methods.
+func methodString(method []byte) string {
+	switch string(method) {
+	case "GET":
+		return "GET"
+	case "HEAD":
+		return "HEAD"
+	case "POST":
+		return "POST"
+	case "PUT":
+		return "PUT"
+	case "DELETE":
+		return "DELETE"
+	case "CONNECT":
+		return "CONNECT"
+	case "OPTIONS":
+		return "OPTIONS"
+	case "TRACE":
+		return "TRACE"
+	case "PATCH":
+		return "PATCH"
 	}
+	return string(method)
+}
 
-	v := version[len(pfx):]
-	if len(v) == 0 {
-		return "", fmt.Errorf("invalid HTTP version: %s", version)
+// validateTarget checks that the request-target has the form the method
+// allows (RFC 9112 section 3.2): authority-form only and always for CONNECT,
+// asterisk-form only for OPTIONS, otherwise origin-form or absolute-form.
+func validateTarget(method, target string) error {
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] == 0x7f {
+			return fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+		}
 	}
 
-	parts := strings.Split(v, ".")
-	if len(parts) > 2 {
-		return "", fmt.Errorf("invalid HTTP version: %s", version)
+	switch {
+	case method == "CONNECT":
+		if _, _, err := ParseAuthority(target); err != nil {
+			return err
+		}
+	case target == "*":
+		if method != "OPTIONS" {
+			return fmt.Errorf("%w: %q for %s", ErrInvalidTarget, target, method)
+		}
+	case strings.HasPrefix(target, "/"), strings.Contains(target, "://"):
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidTarget, target)
 	}
 
-	if _, err := strconv.Atoi(parts[0]); err != nil {
-		return "", fmt.Errorf("invalid HTTP version: %s", version)
+	return nil
+}
+
+// ParseAuthority splits an authority-form target such as "example.com:443"
+// or "[::1]:8080" into host and port. The port is required.
+func ParseAuthority(target string) (host, port string, err error) {
+	if strings.ContainsAny(target, "/?#@") {
+		return "", "", fmt.Errorf("%w: %q is not host:port", ErrInvalidTarget, target)
 	}
 
-	if len(parts) == 2 {
-		if _, err := strconv.Atoi(parts[1]); err != nil {
-			return "", fmt.Errorf("invalid HTTP version: %s", version)
-		}
+	host, port, err = net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return "", "", fmt.Errorf("%w: %q is not host:port", ErrInvalidTarget, target)
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 || port[0] == '+' {
+		return "", "", fmt.Errorf("%w: invalid port in %q", ErrInvalidTarget, target)
+	}
+
+	return host, port, nil
+}
+
+// parseHTTPVersion accepts only the RFC 9112 form HTTP/DIGIT.DIGIT. Any
+// major version other than 1 is well-formed but unsupported.
+func parseHTTPVersion(version []byte) (string, error) {
+	const pfx = "HTTP/"
+	if !bytes.HasPrefix(version, []byte(pfx)) {
+		return "", fmt.Errorf("%w: invalid HTTP version %q", ErrMalformedRequestLine, version)
+	}
+
+	v := version[len(pfx):]
+	if len(v) != 3 || !isDigit(v[0]) || v[1] != '.' || !isDigit(v[2]) {
+		return "", fmt.Errorf("%w: invalid HTTP version %q", ErrMalformedRequestLine, version)
+	}
+
+	if v[0] != '1' {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
 	}
 
-	return v, nil
+	switch v[2] {
+	case '0':
+		return "1.0", nil
+	case '1':
+		return "1.1", nil
+	}
+	return string(v), nil
 }
 
-func isUppercase(str string) bool {
-	if len(str) == 0 {
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isUppercase(b []byte) bool {
+	if len(b) == 0 {
 		return false
 	}
 
-	for _, r := range str {
-		if r < 'A' || r > 'Z' {
+	for _, c := range b {
+		if c < 'A' || c > 'Z' {
 			return false
 		}
 	}
@@ -165,7 +508,7 @@ func (r *Request) parse(data []byte) (int, error) {
 	for {
 		switch r.State {
 		case InitialState:
-			requestLine, n, err := parseRequestLine(string(data[read:]))
+			requestLine, n, err := parseRequestLine(data[read:])
 			if err != nil {
 				return 0, err
 			}
@@ -174,91 +517,135 @@ func (r *Request) parse(data []byte) (int, error) {
 				return read, nil
 			}
 
-			r.RequestLine = *requestLine
+			r.RequestLine = requestLine
 			r.State = HeadersState
 
 			read += n
+			r.headerBytes += n
 		case HeadersState:
+			if len(r.Headers) == 0 && read < len(data) && (data[read] == ' ' || data[read] == '\t') {
+				return 0, ErrWhitespaceAfterStartLine
+			}
+
 			n, done, err := r.Headers.Parse(data[read:])
 			if err != nil {
 				return 0, err
 			}
 
-			if done {
-				read += n
-				r.State = BodyState
+			if n == 0 {
 				return read, nil
 			}
 
-			if n == 0 {
-				return read, nil
+			if isHostField(data[read : read+n]) {
+				r.hostFields++
 			}
 
 			read += n
+			r.headerBytes += n
 
-			if clStr := r.Headers.Get("content-length"); clStr != "" {
-				cl, err := strconv.Atoi(clStr)
-				if err != nil || cl < 0 {
-					return 0, fmt.Errorf("invalid content-length: %q", clStr)
-				}
-				if cl == 0 {
-					r.State = DoneState
-					return read, nil
+			if r.headerBytes > r.limits.MaxHeaderBytes {
+				return 0, fmt.Errorf("%w: more than %d bytes", ErrHeaderTooLarge, r.limits.MaxHeaderBytes)
+			}
+
+			if done {
+				state, err := r.bodyFraming()
+				if err != nil {
+					return 0, err
 				}
+				r.State = state
+			}
+		case BodyState:
+			need := r.contentLength - r.bodyRead - len(r.Body)
+			if need == 0 {
+				r.State = DoneState
+				return read, nil
+			}
 
-				r.State = BodyState
-				continue
+			take := len(data[read:])
+			if take == 0 {
+				return read, nil
+			}
+
+			if take > need {
+				take = need
+			}
+
+			r.Body = append(r.Body, data[read:read+take]...)
+			read += take
+
+			if r.bodyRead+len(r.Body) == r.contentLength {
+				r.State = DoneState
 			}
 
-			r.State = DoneState
 			return read, nil
-		case BodyState:
-			fmt.Printf("Reading body, current length: %d, data length: %d\n", len(r.Body), len(data[read:]))
-			if exists := r.Headers.Get("content-length"); exists != "" {
-				contentLength, err := strconv.Atoi(exists)
-				if err != nil {
-					return 0, fmt.Errorf("invalid content-length: %s", exists)
-				}
+		case ChunkSizeState:
+			size, n, err := chunked.ParseSize(data[read:])
+			if err != nil {
+				return 0, fmt.Errorf("%w: %v", ErrInvalidChunk, err)
+			}
 
-				need := contentLength - len(r.Body)
-				if need < 0 {
-					return 0, fmt.Errorf("body length exceeds content-length: %d > %d", len(r.Body), contentLength)
-				}
+			if n == 0 {
+				return read, nil
+			}
 
-				if need == 0 {
-					fmt.Printf("Content length matches body length, setting state to done\n")
-					r.State = DoneState
-					return read, nil
-				}
+			read += n
+			r.chunkRemaining = size
+
+			if r.bodyRead+len(r.Body)+size > r.limits.MaxBodyBytes {
+				return 0, fmt.Errorf("%w: chunked body exceeds %d", ErrBodyTooLarge, r.limits.MaxBodyBytes)
+			}
 
+			if size == 0 {
+				r.State = TrailersState
+			} else {
+				r.State = ChunkDataState
+			}
+		case ChunkDataState:
+			if r.chunkRemaining > 0 {
 				take := len(data[read:])
 				if take == 0 {
 					return read, nil
 				}
 
-				if take > need {
-					take = need
+				if take > r.chunkRemaining {
+					take = r.chunkRemaining
 				}
 
 				r.Body = append(r.Body, data[read:read+take]...)
 				read += take
+				r.chunkRemaining -= take
+				continue
+			}
 
-				if len(r.Body) == contentLength {
-					fmt.Printf("Body length matches content-length, setting state to done\n")
-					r.State = DoneState
-				}
+			if len(data[read:]) < 2 {
+				return read, nil
+			}
+
+			if data[read] != '\r' || data[read+1] != '\n' {
+				return 0, ErrInvalidChunk
+			}
+
+			read += 2
+			r.State = ChunkSizeState
+		case TrailersState:
+			n, done, err := r.Trailers.Parse(data[read:])
+			if err != nil {
+				return 0, err
+			}
 
+			if n == 0 {
 				return read, nil
-			} else {
-				avail := len(data[read:])
-				if avail > 0 {
-					r.Body = append(r.Body, data[read:read+avail]...)
-					read += avail
-					return read, nil
-				}
+			}
 
+			read += n
+			r.headerBytes += n
+
+			if r.headerBytes > r.limits.MaxHeaderBytes {
+				return 0, fmt.Errorf("%w: more than %d bytes", ErrHeaderTooLarge, r.limits.MaxHeaderBytes)
+			}
+
+			if done {
 				r.State = DoneState
-				return read, nil
 			}
 		case DoneState:
 			return read, nil
@@ -266,13 +653,226 @@ func (r *Request) parse(data []byte) (int, error) {
 	}
 }
 
+// bodyFraming decides how the message body is delimited once all header
+// fields have been read, following the rules in RFC 9112 section 6.3.
+func (r *Request) bodyFraming() (RequestState, error) {
+	// A CONNECT request has no content; anything after the header section
+	// is tunnel data.
+	if r.RequestLine.Method == "CONNECT" {
+		return DoneState, nil
+	}
+
+	// Presence decides framing, not the value: an empty field is still a
+	// field, and ignoring it would let a body be read as the next request.
+	te, hasTE := r.Headers["transfer-encoding"]
+	cl, hasCL := r.Headers["content-length"]
+
+	if hasTE {
+		if hasCL {
+			return "", ErrContentLengthWithTransferEncoding
+		}
+
+		codings := strings.Split(te, ",")
+		for i, coding := range codings {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				return "", fmt.Errorf("%w: %q", ErrInvalidTransferEncoding, te)
+			}
+			if coding != "chunked" {
+				return "", fmt.Errorf("%w: %q", ErrUnsupportedTransferEncoding, coding)
+			}
+			if i != len(codings)-1 {
+				return "", ErrChunkedNotFinal
+			}
+		}
+
+		return ChunkSizeState, nil
+	}
+
+	if !hasCL {
+		return DoneState, nil
+	}
+
+	contentLength, err := parseContentLength(cl)
+	if err != nil {
+		return "", err
+	}
+
+	if contentLength > r.limits.MaxBodyBytes {
+		return "", fmt.Errorf("%w: content-length %d exceeds %d", ErrBodyTooLarge, contentLength, r.limits.MaxBodyBytes)
+	}
+
+	if normalized := strconv.Itoa(contentLength); normalized != cl {
+		r.Headers.Override("content-length", normalized)
+	}
+	r.contentLength = contentLength
+
+	if contentLength == 0 {
+		return DoneState, nil
+	}
+
+	// The declared length is not trusted for more than a modest
+	// preallocation until the bytes actually arrive.
+	r.Body = make([]byte, 0, min(contentLength, maxBodyPrealloc))
+
+	return BodyState, nil
+}
+
+// parseContentLength validates a Content-Length value. Repeated fields are
+// merged into a comma-separated list by the header parser; they are only
+// accepted when every member is the same valid length.
+func parseContentLength(value string) (int, error) {
+	contentLength := -1
+
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || strings.TrimLeft(v, "0123456789") != "" {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+		}
+
+		if contentLength != -1 && n != contentLength {
+			return 0, fmt.Errorf("%w: %q", ErrConflictingContentLength, value)
+		}
+		contentLength = n
+	}
+
+	return contentLength, nil
+}
+
+// IsHTTP10 reports whether the client spoke HTTP/1.0, which has no chunked
+// transfer coding and closes connections by default.
+func (r *Request) IsHTTP10() bool {
+	return r.RequestLine.HttpVersion == "1.0"
+}
+
+// KeepAlive reports whether the client asked for the connection to stay open
+// after this request.
+func (r *Request) KeepAlive() bool {
+	if r.IsHTTP10() {
+		// HTTP/1.0 has no Transfer-Encoding, so an intermediary may have
+		// framed this body differently; nothing after it can be trusted
+		// (RFC 9112 section 6.1).
+		if _, ok := r.Headers["transfer-encoding"]; ok {
+			return false
+		}
+		return headers.HasToken(r.Headers.Get("connection"), "keep-alive")
+	}
+	return !headers.HasToken(r.Headers.Get("connection"), "close")
+}
+
+// ValidateHost enforces RFC 9112 section 3.2: an HTTP/1.1 request must carry
+// exactly one Host field.
+func (r *Request) ValidateHost() error {
+	host, ok := r.Headers["host"]
+	if !ok {
+		if r.IsHTTP10() {
+			return nil
+		}
+		return ErrMissingHost
+	}
+
+	if r.hostFields > 1 {
+		return fmt.Errorf("%w: %q", ErrMultipleHost, host)
+	}
+
+	return nil
+}
+
+// isHostField reports whether a field line parsed without error is a Host
+// field. Such a line starts with its name, as leading whitespace and
+// whitespace before the colon are rejected.
+func isHostField(line []byte) bool {
+	return len(line) >= 5 && bytes.EqualFold(line[:5], []byte("host:"))
+}
+
+// inFields reports whether the parser is in the request line, header
+// section or trailer section, which all count against MaxHeaderBytes.
+func (r *Request) inFields() bool {
+	return r.State == InitialState || r.State == HeadersState || r.State == TrailersState
+}
+
+// BodyReader returns the request body. For a request from
+// ReadRequestHeader it reads the body from the connection as it arrives,
+// and fails with the error ReadRequest would have returned for a body that
+// is cut off, malformed or over the limit.
+func (r *Request) BodyReader() io.Reader {
+	if r.source == nil {
+		return bytes.NewReader(r.Body)
+	}
+	return bodyReader{r}
+}
+
+// ContentLength returns the length of the body, or -1 for a chunked body
+// that is still being read.
+func (r *Request) ContentLength() int {
+	if r.source == nil {
+		return len(r.Body)
+	}
+	if _, chunked := r.Headers["transfer-encoding"]; chunked {
+		return -1
+	}
+	return r.contentLength
+}
+
+type bodyReader struct {
+	r *Request
+}
+
+func (b bodyReader) Read(p []byte) (int, error) {
+	r := b.r
+	for {
+		if r.bodyOff < len(r.Body) {
+			n := copy(p, r.Body[r.bodyOff:])
+			r.bodyOff += n
+			return n, nil
+		}
+		if r.isDone() {
+			return 0, io.EOF
+		}
+		if r.bodyErr != nil {
+			return 0, r.bodyErr
+		}
+
+		// Everything received has been read; make room and wait for more.
+		r.bodyRead += len(r.Body)
+		r.Body, r.bodyOff = r.Body[:0], 0
+		if _, err := r.source.read(func(r *Request) bool { return len(r.Body) > 0 }); err != nil {
+			r.bodyErr = err
+			return 0, err
+		}
+	}
+}
+
 func (r *Request) isDone() bool {
 	return r.State == DoneState
 }
 
 func newRequest() *Request {
-	return &Request{
-		Headers: headers.NewHeaders(),
-		State:   InitialState,
+	r := requestPool.Get().(*Request)
+	if r.Headers == nil {
+		r.Headers = headers.NewHeaders()
 	}
+	if r.Trailers == nil {
+		r.Trailers = headers.NewHeaders()
+	}
+	r.State = InitialState
+	r.limits = DefaultLimits
+	return r
+}
+
+// Release clears r and returns it to the pool ReadRequest draws from. The
+// server releases each request once its handler has returned, so handlers
+// must not keep the request or its header maps beyond that. The body is
+// never reused and may be retained.
+func (r *Request) Release() {
+	h, t := r.Headers, r.Trailers
+	clear(h)
+	clear(t)
+	*r = Request{Headers: h, Trailers: t}
+	requestPool.Put(r)
 }
@@ -1,8 +1,12 @@
 package request
 
 import (
+	"bytes"
 	"fmt"
+	"httpfromtcp/internal/headers"
 	"io"
+	"math/rand"
+	"os"
 	"strings"
 	"testing"
 
@@ -182,7 +186,7 @@ func TestRequestLineParse(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Empty(t, r.Body)
 
-	// Test: No Content-Length with body
+	// Test: No Content-Length with body (RFC 9112: no framing means no body)
 	reader = &chunkReader{
 		data: "POST /submit HTTP/1.1\r\n" +
 			"Host: localhost:42069\r\n" +
@@ -193,7 +197,7 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Empty(t, r.Body)
 
 	// Test: JSON Body
 	body := `{"type": "dark mode", "size": "medium"}`
@@ -220,6 +224,514 @@ func TestRequestLineParse(t *testing.T) {
 	assert.Equal(t, []byte(body), r.Body)
 }
 
+func TestRequestFraming(t *testing.T) {
+	// Test: Identical duplicate Content-Length is collapsed
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "5", r.Headers.Get("content-length"))
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: Differing duplicate Content-Length
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!"))
+	require.ErrorIs(t, err, ErrConflictingContentLength)
+
+	// Test: Non-numeric Content-Length
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: +5\r\n\r\nhello"))
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: An empty Content-Length before a valid one is not dropped
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length:\r\nContent-Length: 5\r\n\r\nhello"))
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: A lone empty Content-Length does not mean "no body"
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length:\r\n\r\nGET /smuggled HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: An empty Transfer-Encoding still conflicts with Content-Length
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding:\r\nContent-Length: 5\r\n\r\nhello"))
+	require.ErrorIs(t, err, ErrContentLengthWithTransferEncoding)
+
+	// Test: An empty Transfer-Encoding on its own is invalid
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding:\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidTransferEncoding)
+
+	// Test: Content-Length and Transfer-Encoding together
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrContentLengthWithTransferEncoding)
+
+	// Test: chunked is not the final coding
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrChunkedNotFinal)
+
+	// Test: Unknown transfer coding
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip\r\n\r\n"))
+	require.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+
+	// Test: Whitespace before colon
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\nContent-Length : 0\r\n\r\n"))
+	require.ErrorIs(t, err, headers.ErrWhitespaceBeforeColon)
+
+	// Test: Obsolete line folding
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\nX-Folded: a\r\n b\r\n\r\n"))
+	require.ErrorIs(t, err, headers.ErrObsFold)
+
+	// Test: Whitespace between request line and first header
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n Host: x\r\n\r\n"))
+	require.ErrorIs(t, err, ErrWhitespaceAfterStartLine)
+
+	// Test: Chunked body with extension and trailers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5;name=value\r\nhello\r\n" +
+			"7\r\n world!\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 2,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "abc", r.Trailers.Get("x-checksum"))
+
+	// Test: Chunk data longer than its declared size
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidChunk)
+
+	// Test: Invalid chunk size
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidChunk)
+
+	// Test: Signed chunk size
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n+5\r\nhello\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidChunk)
+}
+
+func TestRequestErrors(t *testing.T) {
+	// Test: Malformed request line
+	_, err := RequestFromReader(strings.NewReader("/coffee HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
+
+	// Test: Parts separated by more than one space
+	_, err = RequestFromReader(strings.NewReader("GET  / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
+	_, err = RequestFromReader(strings.NewReader("GET\t/ HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
+
+	// Test: Malformed version
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/Test\r\nHost: x\r\n\r\n"))
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
+
+	// Test: Unsupported major version
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/2.0\r\nHost: x\r\n\r\n"))
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// Test: Malformed header
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost x\r\n\r\n"))
+	require.ErrorIs(t, err, headers.ErrMalformedHeader)
+
+	// Test: Header section over the limit
+	limits := Limits{MaxHeaderBytes: 64, MaxBodyBytes: 64}
+	_, err = RequestFromReaderWithLimits(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\nX-Pad: "+strings.Repeat("a", 100)+"\r\n\r\n"), limits)
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Trailers count against the header limit, complete or not
+	chunkedHead := "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n"
+	_, err = RequestFromReaderWithLimits(strings.NewReader(chunkedHead+"X-Pad: "+strings.Repeat("a", 100)+"\r\n\r\n"), limits)
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	_, err = RequestFromReaderWithLimits(strings.NewReader(chunkedHead+"X-Pad: "+strings.Repeat("a", 100)), limits)
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Content-Length over the limit
+	_, err = RequestFromReaderWithLimits(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 65\r\n\r\n"), limits)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body over the limit
+	_, err = RequestFromReaderWithLimits(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n41\r\n"), limits)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Connection closed mid-body
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nhi"))
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+
+	// Test: Read deadline exceeded
+	_, err = RequestFromReader(&timeoutReader{data: "GET / HTTP/1.1\r\n"})
+	require.ErrorIs(t, err, ErrTimeout)
+
+	// Test: Read deadline exceeded before any byte arrived
+	_, err = RequestFromReader(&timeoutReader{})
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestRequestVersion(t *testing.T) {
+	// Test: HTTP/1.0 is accepted
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.True(t, r.IsHTTP10())
+
+	// Test: Versions that are not DIGIT.DIGIT are malformed
+	for _, v := range []string{"HTTP/7", "HTTP/1.99", "HTTP/1", "HTTP/1.1.1", "HTTP/01.1", "http/1.1"} {
+		_, err = RequestFromReader(strings.NewReader("GET / " + v + "\r\nHost: x\r\n\r\n"))
+		require.ErrorIs(t, err, ErrMalformedRequestLine, v)
+	}
+
+	// Test: Other major versions are unsupported
+	for _, v := range []string{"HTTP/0.9", "HTTP/2.0", "HTTP/7.0"} {
+		_, err = RequestFromReader(strings.NewReader("GET / " + v + "\r\nHost: x\r\n\r\n"))
+		require.ErrorIs(t, err, ErrUnsupportedVersion, v)
+	}
+
+	// Test: Keep-alive defaults
+	cases := []struct {
+		raw       string
+		keepAlive bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: x\r\n\r\n", true},
+		{"GET / HTTP/1.1\r\nHost: x\r\nConnection: Close\r\n\r\n", false},
+		{"GET / HTTP/1.0\r\n\r\n", false},
+		{"GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", true},
+		{"POST / HTTP/1.0\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false},
+	}
+	for _, c := range cases {
+		r, err = RequestFromReader(strings.NewReader(c.raw))
+		require.NoError(t, err)
+		assert.Equal(t, c.keepAlive, r.KeepAlive(), c.raw)
+	}
+
+	// Test: Host is required for HTTP/1.1 only
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ValidateHost(), ErrMissingHost)
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n"))
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ValidateHost(), ErrMultipleHost)
+
+	// Test: An empty Host does not hide a second one
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost:\r\nHost: y\r\n\r\n"))
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ValidateHost(), ErrMultipleHost)
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+}
+
+func TestRequestTarget(t *testing.T) {
+	// Test: Each method accepts only its request-target forms
+	valid := []string{
+		"GET /path?q=1 HTTP/1.1",
+		"GET http://example.com/path HTTP/1.1",
+		"OPTIONS * HTTP/1.1",
+		"CONNECT example.com:443 HTTP/1.1",
+		"CONNECT [::1]:8080 HTTP/1.1",
+	}
+	for _, line := range valid {
+		_, err := RequestFromReader(strings.NewReader(line + "\r\nHost: x\r\n\r\n"))
+		require.NoError(t, err, line)
+	}
+
+	invalid := []string{
+		"GET * HTTP/1.1",
+		"GET example.com:443 HTTP/1.1",
+		"GET path HTTP/1.1",
+		"CONNECT /path HTTP/1.1",
+		"CONNECT example.com HTTP/1.1",
+		"CONNECT example.com:0 HTTP/1.1",
+		"CONNECT example.com:99999 HTTP/1.1",
+		"CONNECT user@example.com:443 HTTP/1.1",
+		"CONNECT :443 HTTP/1.1",
+		"GET /a\x00b HTTP/1.1",
+		"GET /a\x7fb HTTP/1.1",
+	}
+	for _, line := range invalid {
+		_, err := RequestFromReader(strings.NewReader(line + "\r\nHost: x\r\n\r\n"))
+		require.ErrorIs(t, err, ErrInvalidTarget, line)
+	}
+
+	// Test: ParseAuthority splits host and port
+	host, port, err := ParseAuthority("[::1]:8080")
+	require.NoError(t, err)
+	assert.Equal(t, "::1", host)
+	assert.Equal(t, "8080", port)
+
+	// Test: CONNECT has no body, so bytes after the headers stay buffered
+	rr := NewReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nContent-Length: 5\r\n\r\nhello"))
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	assert.Equal(t, "hello", string(rr.Buffered()))
+}
+
+func TestReaderPipelining(t *testing.T) {
+	// Test: Two pipelined requests arriving in the same read
+	reader := NewReader(strings.NewReader(
+		"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc" +
+			"GET /b HTTP/1.1\r\nHost: x\r\n\r\n",
+	))
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	assert.Equal(t, "abc", string(r.Body))
+	assert.NotEmpty(t, reader.Buffered())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	assert.Empty(t, reader.Buffered())
+
+	// Test: Clean EOF between requests
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Pipelined requests spanning many buffer refills
+	var stream strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&stream, "POST /%d HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nbody%d", i, i%10)
+	}
+	reader = NewReader(&chunkReader{data: stream.String(), numBytesPerRead: 100})
+	defer reader.Release()
+	for i := 0; i < 50; i++ {
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("/%d", i), r.RequestLine.RequestTarget)
+		assert.Equal(t, fmt.Sprintf("body%d", i%10), string(r.Body))
+	}
+}
+
+func TestReaderFeed(t *testing.T) {
+	// Test: Requests fed one byte at a time complete on the last byte
+	first := "POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc"
+	raw := first + "GET /b HTTP/1.1\r\nHost: x\r\n\r\n"
+	reader := NewReader(nil)
+	defer reader.Release()
+	assert.False(t, reader.Pending())
+
+	var got []*Request
+	for i := 0; i < len(raw); i++ {
+		reader.Write([]byte{raw[i]})
+		r, err := reader.Next()
+		require.NoError(t, err)
+		if r != nil {
+			got = append(got, r)
+			assert.Contains(t, []int{len(first) - 1, len(raw) - 1}, i)
+		}
+	}
+	require.Len(t, got, 2)
+	assert.Equal(t, "abc", string(got[0].Body))
+	assert.Equal(t, "/b", got[1].RequestLine.RequestTarget)
+	assert.False(t, reader.Pending())
+
+	// Test: Pipelined requests written at once come out one per Next
+	reader.Write([]byte(raw))
+	r, err := reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	assert.True(t, reader.Pending())
+	r, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	r, err = reader.Next()
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	// Test: InputError tells a clean end from a truncated request
+	assert.ErrorIs(t, reader.InputError(io.EOF), io.EOF)
+	reader.Write([]byte("GET / HTTP/1.1\r\nHo"))
+	_, err = reader.Next()
+	require.NoError(t, err)
+	assert.True(t, reader.Pending())
+	assert.ErrorIs(t, reader.InputError(io.EOF), ErrIncompleteRequest)
+	reader.Write([]byte("GET / HTTP/1.1\r\nHo"))
+	assert.ErrorIs(t, reader.InputError(os.ErrDeadlineExceeded), ErrTimeout)
+
+	// Test: An expired deadline between requests is a clean end
+	assert.False(t, reader.Pending())
+	assert.ErrorIs(t, reader.InputError(os.ErrDeadlineExceeded), io.EOF)
+
+	// Test: Parse errors are reported by Next
+	reader = NewReader(nil)
+	defer reader.Release()
+	reader.Write([]byte("GET / HTTP/1.1\r\nBad Header: x\r\n\r\n"))
+	_, err = reader.Next()
+	require.ErrorIs(t, err, headers.ErrInvalidFieldName)
+}
+
+func TestReaderReadRequestHeader(t *testing.T) {
+	// Test: The header comes back before the body, which streams after it
+	body := strings.Repeat("x", 10000)
+	raw := "POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 10000\r\n\r\n" + body +
+		"POST /b HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 1\r\n\r\n"
+	reader := NewReader(&splitReader{data: []byte(raw)})
+	defer reader.Release()
+	r, err := reader.ReadRequestHeader()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	assert.Equal(t, BodyState, r.State)
+	assert.Equal(t, 10000, r.ContentLength())
+	got, err := io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, body, string(got))
+
+	// Test: A chunked body ends with its trailers, and the reader moves on
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	assert.Equal(t, -1, r.ContentLength())
+	got, err = io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(got))
+	assert.Equal(t, "1", r.Trailers.Get("x-sum"))
+	_, err = reader.ReadRequestHeader()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A body cut off or over the limit fails the read
+	reader = NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nab"))
+	defer reader.Release()
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader())
+	assert.ErrorIs(t, err, ErrIncompleteRequest)
+	_, err = r.BodyReader().Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrIncompleteRequest)
+
+	reader = NewReader(&splitReader{data: []byte("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"8\r\n12345678\r\n8\r\n12345678\r\n0\r\n\r\n")})
+	defer reader.Release()
+	reader.Limits.MaxBodyBytes = 10
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader())
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: A request without a body is complete straight away
+	reader = NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	defer reader.Release()
+	r, err = reader.ReadRequestHeader()
+	require.NoError(t, err)
+	assert.Equal(t, DoneState, r.State)
+	assert.Zero(t, r.ContentLength())
+}
+
+func TestRequestRelease(t *testing.T) {
+	// Test: Pooled requests and readers carry nothing over once released
+	r, err := RequestFromReader(strings.NewReader(
+		"POST /first HTTP/1.1\r\nHost: x\r\nX-First: secret\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nfirst\r\n0\r\nX-Checksum: abc\r\n\r\n"))
+	require.NoError(t, err)
+	r.RemoteAddr = "192.0.2.1:1234"
+	body := r.Body
+	r.Release()
+	assert.Equal(t, "first", string(body), "released bodies are not reused")
+
+	reader := NewReader(strings.NewReader("GET /left HTTP/1.1\r\nHost: x\r\n\r\nGET /over"))
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	reader.Release()
+
+	for i := 0; i < 10; i++ {
+		reader = NewReader(strings.NewReader("GET /second HTTP/1.1\r\nHost: y\r\n\r\n"))
+		assert.Empty(t, reader.Buffered())
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, RequestLine{Method: "GET", RequestTarget: "/second", HttpVersion: "1.1"}, r.RequestLine)
+		assert.Equal(t, headers.Headers{"host": "y"}, r.Headers)
+		assert.Empty(t, r.Trailers)
+		assert.Empty(t, r.Body)
+		assert.Empty(t, r.RemoteAddr)
+		r.Release()
+		reader.Release()
+	}
+}
+
+var benchmarkRequests = map[string]string{
+	"minimal": "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	"browser": "GET /index.html?lang=en HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0\r\n" +
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+		"Accept-Language: en-US,en;q=0.5\r\n" +
+		"Accept-Encoding: gzip, deflate, br\r\n" +
+		"Connection: keep-alive\r\n" +
+		"Cookie: session=0123456789abcdef; theme=dark\r\n" +
+		"Cache-Control: max-age=0\r\n\r\n",
+	"post": "POST /api/items HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/json\r\nContent-Length: 27\r\n\r\n" +
+		`{"name":"item","count":42}` + "\n",
+	"chunked": "POST /upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"10\r\n0123456789abcdef\r\n10\r\n0123456789abcdef\r\n0\r\n\r\n",
+}
+
+func BenchmarkRequestFromReader(b *testing.B) {
+	for name, raw := range benchmarkRequests {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(raw)))
+			r := strings.NewReader(raw)
+			for i := 0; i < b.N; i++ {
+				r.Reset(raw)
+				req, err := RequestFromReader(r)
+				if err != nil {
+					b.Fatal(err)
+				}
+				req.Release()
+			}
+		})
+	}
+}
+
+// BenchmarkReaderKeepAlive parses requests from one long-lived Reader, as
+// the server does on a keep-alive connection.
+func BenchmarkReaderKeepAlive(b *testing.B) {
+	for name, raw := range benchmarkRequests {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(raw)))
+			stream := strings.Repeat(raw, 100)
+			r := strings.NewReader(stream)
+			reader := NewReader(r)
+			defer reader.Release()
+			for i := 0; i < b.N; i++ {
+				if i%100 == 0 {
+					r.Reset(stream)
+				}
+				req, err := reader.ReadRequest()
+				if err != nil {
+					b.Fatal(err)
+				}
+				req.Release()
+			}
+		})
+	}
+}
+
+type timeoutReader struct {
+	data string
+}
+
+func (tr *timeoutReader) Read(p []byte) (int, error) {
+	if tr.data == "" {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n := copy(p, tr.data)
+	tr.data = tr.data[n:]
+	return n, nil
+}
+
 func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	if cr.pos > len(cr.data) {
 		return 0, io.EOF
@@ -236,3 +748,84 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	}
 	return n, nil
 }
+
+// splitReader returns data in reads of random sizes drawn from rng, or one
+// byte at a time when rng is nil.
+type splitReader struct {
+	data []byte
+	rng  *rand.Rand
+}
+
+func (sr *splitReader) Read(p []byte) (int, error) {
+	if len(sr.data) == 0 {
+		return 0, io.EOF
+	}
+
+	n := 1
+	if sr.rng != nil {
+		n += sr.rng.Intn(min(len(sr.data), len(p)))
+	}
+	n = copy(p, sr.data[:n])
+	sr.data = sr.data[n:]
+	return n, nil
+}
+
+var fuzzRequestSeeds = []string{
+	// Real-world requests
+	"GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+	"GET /search?q=go+fuzz&lang=en HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0\r\nAccept: text/html,application/xhtml+xml;q=0.9,*/*;q=0.8\r\nAccept-Language: en-US,en;q=0.5\r\nAccept-Encoding: gzip, deflate, br\r\nCookie: a=1\r\nCookie: b=2\r\nConnection: keep-alive\r\n\r\n",
+	"POST /form HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 13\r\n\r\nname=a&age=42",
+	"POST /upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n",
+	"GET /old HTTP/1.0\r\n\r\n",
+	"GET /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\n",
+	"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+	"OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	"GET http://example.com/abs HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	// Malicious and malformed requests
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nContent-Length: 5\r\n\r\nabcde",
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: -1\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nffffffffffffffffff\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcdef\r\n0\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: x\r\nX-Folded: a\r\n b\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost : x\r\n\r\n",
+	"GET / HTTP/1.1\nHost: x\n\n",
+	"GET / HTTP/1.1\r\nHost: x\x00y\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n",
+	"GET / HTTP/9.9\r\n\r\n",
+	"GET  /  HTTP/1.1\r\n\r\n",
+	"get / HTTP/1.1\r\n\r\n",
+	"\r\n\r\n",
+	"",
+}
+
+func FuzzRequestFromReader(f *testing.F) {
+	for i, seed := range fuzzRequestSeeds {
+		f.Add([]byte(seed), int64(i))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, seed int64) {
+		want, wantErr := RequestFromReader(bytes.NewReader(data))
+
+		readers := []io.Reader{
+			&splitReader{data: data},
+			&splitReader{data: data, rng: rand.New(rand.NewSource(seed))},
+		}
+		for _, r := range readers {
+			got, err := RequestFromReader(r)
+			if wantErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, wantErr.Error(), err.Error())
+				continue
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, want.RequestLine, got.RequestLine)
+			assert.Equal(t, want.Headers, got.Headers)
+			assert.Equal(t, want.Trailers, got.Trailers)
+			assert.Equal(t, want.Body, got.Body)
+		}
+	})
+}
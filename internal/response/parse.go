@@ -0,0 +1,462 @@
+package response
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/chunked"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Response is a response parsed off the wire by a Reader.
+type Response struct {
+	StatusLine StatusLine
+	// Interim holds any 1xx responses that preceded the final one.
+	Interim  []StatusLine
+	Headers  headers.Headers
+	Trailers headers.Headers
+	// ContentLength is the length of the body, or -1 when it is chunked or
+	// runs until the connection closes.
+	ContentLength int64
+	State         ResponseState
+	Body          []byte
+
+	chunkRemaining int
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+type ResponseState string
+
+const (
+	ResponseStateStatusLine     ResponseState = "status-line"
+	ResponseStateHeaders        ResponseState = "headers"
+	ResponseStateBody           ResponseState = "body"
+	ResponseStateCloseDelimited ResponseState = "close-delimited"
+	ResponseStateChunkSize      ResponseState = "chunk-size"
+	ResponseStateChunkData      ResponseState = "chunk-data"
+	ResponseStateTrailers       ResponseState = "trailers"
+	ResponseStateDone           ResponseState = "done"
+)
+
+var (
+	ErrMalformedStatusLine  = errors.New("malformed status line")
+	ErrInvalidContentLength = errors.New("invalid content-length")
+	ErrInvalidChunk         = errors.New("invalid chunked encoding")
+	ErrIncompleteResponse   = errors.New("incomplete response")
+	ErrHeaderTooLarge       = errors.New("response header too large")
+	ErrBodyTooLarge         = errors.New("response body too large")
+	ErrTooManyInterim       = errors.New("too many 1xx responses")
+)
+
+// maxInterimResponses is how many 1xx responses may precede the final one,
+// as in net/http.
+const maxInterimResponses = 5
+
+// Limits bounds how much of a response a Reader accepts. MaxHeaderBytes
+// covers the status line and fields of a response together with any 1xx
+// responses before it, and separately its trailers; MaxBodyBytes only
+// applies to ReadResponse, which buffers the body.
+type Limits struct {
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+}
+
+var DefaultLimits = Limits{
+	MaxHeaderBytes: 1 << 20,
+	MaxBodyBytes:   10 << 20,
+}
+
+// Reader parses responses from a connection, one after another.
+type Reader struct {
+	Limits Limits
+
+	br *bufio.Reader
+}
+
+// NewReader returns a Reader for r. If r is a *bufio.Reader it is read
+// directly, so bytes that arrive after a response stay in it for the
+// caller; otherwise they can be found with Buffered.
+func NewReader(r io.Reader) *Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{Limits: DefaultLimits, br: br}
+}
+
+// Buffered returns the bytes read from the connection but not yet parsed.
+// They stay valid until the next read.
+func (rr *Reader) Buffered() []byte {
+	b, _ := rr.br.Peek(rr.br.Buffered())
+	return b
+}
+
+// ResponseFromReader parses one response. Use ResponseFromReaderForMethod
+// for responses to HEAD, which never carry a body.
+//
+// Bytes past the end of the response are lost unless reader is a
+// *bufio.Reader; use a Reader to parse several responses from one
+// connection.
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return ResponseFromReaderForMethod(reader, "GET")
+}
+
+func ResponseFromReaderForMethod(reader io.Reader, method string) (*Response, error) {
+	return NewReader(reader).ReadResponse(method)
+}
+
+// ReadResponse reads a whole response to a request with the given method,
+// buffering the body.
+func (rr *Reader) ReadResponse(method string) (*Response, error) {
+	r, err := rr.ReadHeader(method)
+	if err != nil {
+		return nil, err
+	}
+
+	max := int64(rr.Limits.MaxBodyBytes)
+	if r.ContentLength > max {
+		return nil, fmt.Errorf("%w: content-length %d exceeds %d", ErrBodyTooLarge, r.ContentLength, max)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(rr.BodyReader(r), max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, fmt.Errorf("%w: body exceeds %d", ErrBodyTooLarge, max)
+	}
+	r.Body = body
+
+	return r, nil
+}
+
+// ReadHeader reads the status line and fields of the next final response,
+// recording any 1xx interim responses before it, and works out how the
+// body is framed. Read the body with BodyReader.
+func (rr *Reader) ReadHeader(method string) (*Response, error) {
+	r := &Response{
+		Headers:       headers.NewHeaders(),
+		Trailers:      headers.NewHeaders(),
+		ContentLength: -1,
+		State:         ResponseStateStatusLine,
+	}
+
+	budget := rr.Limits.MaxHeaderBytes
+	for r.State == ResponseStateStatusLine {
+		line, err := rr.readLine(&budget, ErrHeaderTooLarge)
+		if err != nil {
+			return nil, r.inputError(err)
+		}
+		statusLine, err := parseStatusLine(string(line))
+		if err != nil {
+			return nil, err
+		}
+		r.StatusLine = *statusLine
+		r.State = ResponseStateHeaders
+
+		if err := rr.readFields(r.Headers, &budget); err != nil {
+			return nil, r.inputError(err)
+		}
+
+		if err := r.bodyFraming(method); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// BodyReader returns the body of r, which must have come from ReadHeader.
+// A chunked body fills in r.Trailers once it has been read to the end.
+func (rr *Reader) BodyReader(r *Response) io.Reader {
+	switch r.State {
+	case ResponseStateBody:
+		return &lengthReader{br: rr.br, r: r, remaining: r.ContentLength}
+	case ResponseStateCloseDelimited:
+		return &closeReader{br: rr.br, r: r}
+	case ResponseStateChunkSize:
+		return &chunkedReader{rr: rr, r: r}
+	}
+	return eofReader{}
+}
+
+// readLine reads one line, counting it against budget. Lines can be
+// longer than the bufio buffer.
+func (rr *Reader) readLine(budget *int, tooLarge error) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := rr.br.ReadSlice('\n')
+		if len(frag) > *budget {
+			return nil, tooLarge
+		}
+		*budget -= len(frag)
+
+		if err == bufio.ErrBufferFull {
+			line = append(line, frag...)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line != nil {
+			return append(line, frag...), nil
+		}
+		return frag, nil
+	}
+}
+
+// readFields feeds field lines to headers.Parse up to the blank line.
+func (rr *Reader) readFields(h headers.Headers, budget *int) error {
+	for {
+		line, err := rr.readLine(budget, ErrHeaderTooLarge)
+		if err != nil {
+			return err
+		}
+
+		n, done, err := h.Parse(line)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%w: %q is not terminated by CRLF", headers.ErrMalformedHeader, line)
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// inputError turns the connection ending early into ErrIncompleteResponse.
+func (r *Response) inputError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: in state %s", ErrIncompleteResponse, r.State)
+	}
+	return err
+}
+
+func parseStatusLine(data string) (*StatusLine, error) {
+	line, ok := strings.CutSuffix(data, "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is not terminated by CRLF", ErrMalformedStatusLine, data)
+	}
+
+	version, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrMalformedStatusLine, line)
+	}
+
+	v := strings.TrimPrefix(version, "HTTP/")
+	if v == version || len(v) != 3 || v[0] != '1' || v[1] != '.' || v[2] < '0' || v[2] > '9' {
+		return nil, fmt.Errorf("%w: version %q", ErrMalformedStatusLine, version)
+	}
+
+	code, reason, _ := strings.Cut(rest, " ")
+	statusCode, err := strconv.Atoi(code)
+	if len(code) != 3 || err != nil || statusCode < 100 {
+		return nil, fmt.Errorf("%w: status code %q", ErrMalformedStatusLine, code)
+	}
+
+	return &StatusLine{
+		HttpVersion:  v,
+		StatusCode:   StatusCode(statusCode),
+		ReasonPhrase: reason,
+	}, nil
+}
+
+// bodyFraming decides how the body is delimited once the header section is
+// complete (RFC 9112 section 6.3). A 1xx response is interim: it is recorded
+// and parsing starts over with the next status line.
+func (r *Response) bodyFraming(method string) error {
+	code := r.StatusLine.StatusCode
+
+	if code < 200 && code != SwitchingProtocols {
+		if len(r.Interim) == maxInterimResponses {
+			return fmt.Errorf("%w: more than %d", ErrTooManyInterim, maxInterimResponses)
+		}
+		r.Interim = append(r.Interim, r.StatusLine)
+		r.StatusLine = StatusLine{}
+		r.Headers = headers.NewHeaders()
+		r.State = ResponseStateStatusLine
+		return nil
+	}
+
+	if method == "HEAD" || code < 200 || code == NoContent || code == NotModified {
+		r.ContentLength = 0
+		r.State = ResponseStateDone
+		return nil
+	}
+
+	// Transfer-Encoding overrides Content-Length. Unless chunked is the
+	// final coding the body can only end when the connection does.
+	if te, ok := r.Headers["transfer-encoding"]; ok {
+		r.State = ResponseStateCloseDelimited
+		if finalCoding(te) == "chunked" {
+			r.State = ResponseStateChunkSize
+		}
+		return nil
+	}
+
+	cl, ok := r.Headers["content-length"]
+	if !ok {
+		r.State = ResponseStateCloseDelimited
+		return nil
+	}
+
+	contentLength, err := parseContentLength(cl)
+	if err != nil {
+		return err
+	}
+
+	r.ContentLength = contentLength
+	r.State = ResponseStateBody
+	if contentLength == 0 {
+		r.State = ResponseStateDone
+	}
+	return nil
+}
+
+// finalCoding returns the last transfer coding listed in te, lowercased.
+func finalCoding(te string) string {
+	codings := strings.Split(te, ",")
+	return strings.ToLower(strings.TrimSpace(codings[len(codings)-1]))
+}
+
+func parseContentLength(value string) (int64, error) {
+	v := strings.TrimSpace(value)
+	if v == "" || len(v) > 18 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < '0' || v[i] > '9' {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+		}
+	}
+
+	n, _ := strconv.ParseInt(v, 10, 64)
+	return n, nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// lengthReader reads a body of known length and reports
+// ErrIncompleteResponse if the connection ends first.
+type lengthReader struct {
+	br        *bufio.Reader
+	r         *Response
+	remaining int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.br.Read(p)
+	l.remaining -= int64(n)
+
+	if l.remaining == 0 {
+		l.r.State = ResponseStateDone
+		return n, io.EOF
+	}
+	return n, l.r.inputError(err)
+}
+
+type closeReader struct {
+	br *bufio.Reader
+	r  *Response
+}
+
+func (c *closeReader) Read(p []byte) (int, error) {
+	n, err := c.br.Read(p)
+	if err == io.EOF {
+		c.r.State = ResponseStateDone
+	}
+	return n, err
+}
+
+type chunkedReader struct {
+	rr  *Reader
+	r   *Response
+	err error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.read(p)
+	if err != nil && c.r.State != ResponseStateDone {
+		c.err = c.r.inputError(err)
+		return n, c.err
+	}
+	return n, err
+}
+
+func (c *chunkedReader) read(p []byte) (int, error) {
+	r := c.r
+	for {
+		switch r.State {
+		case ResponseStateChunkSize:
+			budget := chunked.MaxLineBytes + len("\r\n")
+			line, err := c.rr.readLine(&budget, ErrInvalidChunk)
+			if err != nil {
+				return 0, err
+			}
+			size, n, err := chunked.ParseSize(line)
+			if err != nil {
+				return 0, fmt.Errorf("%w: %v", ErrInvalidChunk, err)
+			}
+			if n == 0 {
+				return 0, fmt.Errorf("%w: size line %q is not terminated by CRLF", ErrInvalidChunk, line)
+			}
+
+			r.chunkRemaining = size
+			r.State = ResponseStateChunkData
+			if size == 0 {
+				r.State = ResponseStateTrailers
+			}
+		case ResponseStateChunkData:
+			if r.chunkRemaining > 0 {
+				if len(p) > r.chunkRemaining {
+					p = p[:r.chunkRemaining]
+				}
+				n, err := c.rr.br.Read(p)
+				r.chunkRemaining -= n
+				return n, err
+			}
+
+			crlf := make([]byte, 2)
+			if _, err := io.ReadFull(c.rr.br, crlf); err != nil {
+				return 0, err
+			}
+			if crlf[0] != '\r' || crlf[1] != '\n' {
+				return 0, ErrInvalidChunk
+			}
+			r.State = ResponseStateChunkSize
+		case ResponseStateTrailers:
+			budget := c.rr.Limits.MaxHeaderBytes
+			if err := c.rr.readFields(r.Trailers, &budget); err != nil {
+				return 0, err
+			}
+			r.State = ResponseStateDone
+		case ResponseStateDone:
+			return 0, io.EOF
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+func TestResponseFromReader(t *testing.T) {
+	// Test: Status line, headers and Content-Length body, one byte at a time
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nhello world!",
+		numBytesPerRead: 1,
+	}
+	r, err := ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, OK, r.StatusLine.StatusCode)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "text/plain", r.Headers.Get("content-type"))
+	assert.Equal(t, "hello world!", string(r.Body))
+
+	// Test: Empty and multi-word reason phrases
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 599 \r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(599), r.StatusLine.StatusCode)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 404 Not Found\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "Not Found", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+
+	// Test: Chunked body with trailers
+	reader = &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+			"6;ext=1\r\nhello \r\n6\r\nworld!\r\n0\r\nX-Checksum: abc\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "abc", r.Trailers.Get("x-checksum"))
+
+	// Test: Interim 1xx responses are recorded and skipped
+	reader = &chunkReader{
+		data: "HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\n" +
+			"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+		numBytesPerRead: 4,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, Created, r.StatusLine.StatusCode)
+	require.Len(t, r.Interim, 2)
+	assert.Equal(t, StatusCode(100), r.Interim[0].StatusCode)
+	assert.Equal(t, StatusCode(103), r.Interim[1].StatusCode)
+	assert.Empty(t, r.Headers.Get("link"))
+	assert.Equal(t, "ok", string(r.Body))
+
+	// Test: 204 and 304 never have a body, even with Content-Length
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 204 No Content\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 304 Not Modified\r\nContent-Length: 50\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	// Test: Responses to HEAD have no body
+	r, err = ResponseFromReaderForMethod(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 50\r\n\r\n"), "HEAD")
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	// Test: No framing means the body runs until the connection closes
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 200 OK\r\n\r\nall of the rest"))
+	require.NoError(t, err)
+	assert.Equal(t, "all of the rest", string(r.Body))
+
+	// Test: Transfer-Encoding without chunked last runs until close, even
+	// with a Content-Length
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\nContent-Length: 3\r\n\r\nall of the rest"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), r.ContentLength)
+	assert.Equal(t, "all of the rest", string(r.Body))
+
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked, gzip\r\n\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "0\r\n\r\n", string(r.Body))
+
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip, Chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(r.Body))
+
+	// Test: Malformed status lines
+	for _, line := range []string{"HTTP/1.1200 OK", "HTTP/2.0 200 OK", "HTTP/1.1 20 OK", "HTTP/1.1 abc OK", "ICY 200 OK"} {
+		_, err = ResponseFromReader(strings.NewReader(line + "\r\n\r\n"))
+		require.ErrorIs(t, err, ErrMalformedStatusLine, line)
+	}
+
+	// Test: Truncated body
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort"))
+	require.ErrorIs(t, err, ErrIncompleteResponse)
+
+	// Test: Invalid chunk
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nxyz\r\n"))
+	require.ErrorIs(t, err, ErrInvalidChunk)
+}
+
+func TestReaderLimits(t *testing.T) {
+	// Test: A field line longer than the read buffer is still accepted
+	long := strings.Repeat("a", 10000)
+	r, err := ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nX-Long: " + long + "\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, long, r.Headers.Get("x-long"))
+
+	// Test: Status line, header and trailer sizes are bounded
+	rr := NewReader(strings.NewReader("HTTP/1.1 200 " + long + "\r\n\r\n"))
+	rr.Limits.MaxHeaderBytes = 1024
+	_, err = rr.ReadResponse("GET")
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	rr = NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nX-Long: " + long + "\r\n\r\n"))
+	rr.Limits.MaxHeaderBytes = 1024
+	_, err = rr.ReadResponse("GET")
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	rr = NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Long: " + long + "\r\n\r\n"))
+	rr.Limits.MaxHeaderBytes = 1024
+	_, err = rr.ReadResponse("GET")
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Interim responses share the final response's header budget
+	rr = NewReader(strings.NewReader(strings.Repeat("HTTP/1.1 100 Continue\r\n\r\n", 3) + "HTTP/1.1 204 No Content\r\n\r\n"))
+	rr.Limits.MaxHeaderBytes = 64
+	_, err = rr.ReadResponse("GET")
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	rr = NewReader(strings.NewReader(strings.Repeat("HTTP/1.1 100 Continue\r\n\r\n", 3) + "HTTP/1.1 204 No Content\r\n\r\n"))
+	rr.Limits.MaxHeaderBytes = 128
+	r, err = rr.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Len(t, r.Interim, 3)
+
+	// Test: At most five interim responses are accepted
+	_, err = ResponseFromReader(strings.NewReader(strings.Repeat("HTTP/1.1 100 Continue\r\n\r\n", 6) + "HTTP/1.1 204 No Content\r\n\r\n"))
+	require.ErrorIs(t, err, ErrTooManyInterim)
+
+	// Test: Chunk-size lines are bounded, extensions included
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;" + long + "\r\nhello\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidChunk)
+
+	// Test: Bodies are bounded, declared or not
+	rr = NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"))
+	rr.Limits.MaxBodyBytes = 10
+	_, err = rr.ReadResponse("GET")
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	rr = NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n20\r\n" + strings.Repeat("x", 32) + "\r\n0\r\n\r\n"))
+	rr.Limits.MaxBodyBytes = 10
+	_, err = rr.ReadResponse("GET")
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	rr = NewReader(strings.NewReader("HTTP/1.0 200 OK\r\n\r\n" + strings.Repeat("x", 32)))
+	rr.Limits.MaxBodyBytes = 10
+	_, err = rr.ReadResponse("GET")
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Invalid Content-Length values
+	for _, cl := range []string{"", "+5", "-1", "5, 5", "0x10"} {
+		_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: " + cl + "\r\n\r\n"))
+		require.ErrorIs(t, err, ErrInvalidContentLength, cl)
+	}
+}
+
+func TestReaderReadAhead(t *testing.T) {
+	pipelined := "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\none" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\ntwo\r\n0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nthree"
+
+	// Test: A Reader parses pipelined responses that arrived together
+	rr := NewReader(strings.NewReader(pipelined))
+	for _, want := range []string{"one", "two", "three"} {
+		r, err := rr.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, want, string(r.Body))
+	}
+
+	// Test: Bytes past a response stay in the caller's bufio.Reader
+	br := bufio.NewReader(strings.NewReader(pipelined))
+	for _, want := range []string{"one", "two", "three"} {
+		r, err := ResponseFromReader(br)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(r.Body))
+	}
+
+	// Test: Bytes after a 101 are handed back with Buffered
+	rr = NewReader(strings.NewReader("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x02hi"))
+	r, err := rr.ReadHeader("GET")
+	require.NoError(t, err)
+	assert.Equal(t, SwitchingProtocols, r.StatusLine.StatusCode)
+	assert.Equal(t, "\x81\x02hi", string(rr.Buffered()))
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	// Test: Writer output parses back to the same response
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	h := GetDefaultHeaders(0)
+	h.Del("Content-Length")
+	h.Override("Transfer-Encoding", "chunked")
+	h.Override("Trailer", "X-Count")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("not "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("here"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.Headers{"x-count": "2"}))
+
+	r, err := ResponseFromReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, NotFound, r.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "not here", string(r.Body))
+	assert.Equal(t, "2", r.Trailers.Get("x-count"))
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := cr.pos + cr.numBytesPerRead
+	if endIndex > len(cr.data) {
+		endIndex = len(cr.data)
+	}
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
@@ -5,42 +5,110 @@ import (
 	"httpfromtcp/internal/headers"
 	"io"
 	"strconv"
+	"strings"
 )
 
 type StatusCode int
 
 const (
-	OK            StatusCode = 200
-	BadRequest    StatusCode = 400
-	Unauthorized  StatusCode = 401
-	Forbidden     StatusCode = 403
-	NotFound      StatusCode = 404
-	InternalError StatusCode = 500
+	SwitchingProtocols          StatusCode = 101
+	OK                          StatusCode = 200
+	Created                     StatusCode = 201
+	NoContent                   StatusCode = 204
+	MovedPermanently            StatusCode = 301
+	Found                       StatusCode = 302
+	NotModified                 StatusCode = 304
+	TemporaryRedirect           StatusCode = 307
+	PermanentRedirect           StatusCode = 308
+	BadRequest                  StatusCode = 400
+	Unauthorized                StatusCode = 401
+	Forbidden                   StatusCode = 403
+	NotFound                    StatusCode = 404
+	MethodNotAllowed            StatusCode = 405
+	ProxyAuthRequired           StatusCode = 407
+	RequestTimeout              StatusCode = 408
+	PayloadTooLarge             StatusCode = 413
+	UpgradeRequired             StatusCode = 426
+	RequestHeaderFieldsTooLarge StatusCode = 431
+	InternalError               StatusCode = 500
+	NotImplemented              StatusCode = 501
+	BadGateway                  StatusCode = 502
+	ServiceUnavailable          StatusCode = 503
+	GatewayTimeout              StatusCode = 504
+	HTTPVersionNotSupported     StatusCode = 505
 )
 
+var statusText = map[StatusCode]string{
+	SwitchingProtocols:          "Switching Protocols",
+	OK:                          "OK",
+	Created:                     "Created",
+	NoContent:                   "No Content",
+	MovedPermanently:            "Moved Permanently",
+	Found:                       "Found",
+	NotModified:                 "Not Modified",
+	TemporaryRedirect:           "Temporary Redirect",
+	PermanentRedirect:           "Permanent Redirect",
+	BadRequest:                  "Bad Request",
+	Unauthorized:                "Unauthorized",
+	Forbidden:                   "Forbidden",
+	NotFound:                    "Not Found",
+	MethodNotAllowed:            "Method Not Allowed",
+	ProxyAuthRequired:           "Proxy Authentication Required",
+	RequestTimeout:              "Request Timeout",
+	PayloadTooLarge:             "Content Too Large",
+	UpgradeRequired:             "Upgrade Required",
+	RequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	InternalError:               "Internal Server Error",
+	NotImplemented:              "Not Implemented",
+	BadGateway:                  "Bad Gateway",
+	ServiceUnavailable:          "Service Unavailable",
+	GatewayTimeout:              "Gateway Timeout",
+	HTTPVersionNotSupported:     "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for a supported status code, or an
+// empty string if the code is unknown.
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
+
+// statusLine always advertises HTTP/1.1, the highest version this server
+// implements, even when answering an HTTP/1.0 client (RFC 9110 section 6.2).
+// Codes without a known reason phrase, such as those relayed by a proxy,
+// are sent with an empty one.
+func statusLine(statusCode StatusCode) (string, error) {
+	if statusCode < 100 || statusCode > 999 {
+		return "", fmt.Errorf("unsupported status code: %d", statusCode)
+	}
+
+	if line, ok := statusLines[statusCode]; ok {
+		return line, nil
+	}
+	return fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, statusText[statusCode]), nil
+}
+
+// statusLines holds the status line of every code in statusText.
+var statusLines = func() map[StatusCode]string {
+	m := make(map[StatusCode]string, len(statusText))
+	for code, text := range statusText {
+		m[code] = fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, text)
+	}
+	return m
+}()
+
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	var line string
-	switch statusCode {
-	case OK:
-		line = "HTTP/1.1 200 OK\r\n"
-	case BadRequest:
-		line = "HTTP/1.1 400 Bad Request\r\n"
-	case NotFound:
-		line = "HTTP/1.1 404 Not Found\r\n"
-	case InternalError:
-		line = "HTTP/1.1 500 Internal Server Error\r\n"
-	default:
-		return fmt.Errorf("unsupported status code: %d", statusCode)
-	}
-
-	_, err := io.WriteString(w, line)
+	line, err := statusLine(statusCode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, line)
 	return err
 }
 
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	defaultHeaders := headers.NewHeaders()
 	defaultHeaders.Set("Content-Length", strconv.Itoa(contentLen))
-	defaultHeaders.Set("Connection", "Close")
 	defaultHeaders.Set("Content-Type", "text/plain")
 
 	return defaultHeaders
@@ -51,13 +119,26 @@ func WriteHeaders(w io.Writer, headers headers.Headers) error {
 		return fmt.Errorf("no headers to write")
 	}
 
-	var headerLines string
+	if err := headers.Validate(); err != nil {
+		return err
+	}
+
+	size := len("\r\n")
+	for key, value := range headers {
+		size += len(key) + len(": ") + len(value) + len("\r\n")
+	}
+
+	var b strings.Builder
+	b.Grow(size)
 	for key, value := range headers {
-		headerLines += fmt.Sprintf("%s: %s\r\n", key, value)
+		b.WriteString(key)
+		b.WriteString(": ")
+		b.WriteString(value)
+		b.WriteString("\r\n")
 	}
-	headerLines += "\r\n"
+	b.WriteString("\r\n")
 
-	_, err := io.WriteString(w, headerLines)
+	_, err := io.WriteString(w, b.String())
 
 	return err
 }
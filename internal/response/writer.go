@@ -2,13 +2,24 @@ package response
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 )
 
-type Resposne struct {
-}
+var (
+	// ErrNotAttached is returned by SwitchProtocols and Hijack when the
+	// writer was not given its underlying connection with Attach.
+	ErrNotAttached = errors.New("response writer is not attached to a connection")
+	// ErrHijacked is returned by writes after the connection was taken over.
+	ErrHijacked = errors.New("connection has been hijacked")
+)
 
 type Writer struct {
 	StartLine string
@@ -17,6 +28,36 @@ type Writer struct {
 	Trailers  headers.Headers
 	State     WriterState
 	bw        *bufio.Writer
+
+	// StatusCode and BytesWritten record what was sent, for access logs.
+	// BytesWritten counts body bytes only.
+	StatusCode   StatusCode
+	BytesWritten int64
+
+	httpVersion string
+	keepAlive   bool
+	idleTimeout time.Duration
+	closeAfter  bool
+	rawChunks   bool
+
+	conn     net.Conn
+	buffered []byte
+	stream   Stream
+
+	// fields is scratch space for the header section actually sent.
+	fields headers.Headers
+	// done runs when the handler returns.
+	done []func()
+}
+
+// Stream receives a response in place of HTTP/1.1 bytes when the request
+// arrived on a multiplexed connection such as an HTTP/2 stream. The Writer
+// keeps its usual state machine and calls the Stream at each step.
+type Stream interface {
+	WriteHeaders(status StatusCode, h headers.Headers, endStream bool) error
+	WriteData(p []byte, endStream bool) error
+	WriteTrailers(h headers.Headers) error
+	Flush() error
 }
 
 type WriterState string
@@ -27,27 +68,215 @@ const (
 	WriterStateBody     WriterState = "body"
 	WriterStateTrailers WriterState = "trailers"
 	WriterStateDone     WriterState = "done"
+	// WriterStateSwitched means the connection now speaks another protocol
+	// and the writer can no longer be used.
+	WriterStateSwitched WriterState = "switched"
+	// WriterStateHijacked means the handler owns the connection; the server
+	// neither writes to nor closes it.
+	WriterStateHijacked WriterState = "hijacked"
 )
 
+var writerPool = sync.Pool{
+	New: func() any {
+		return &Writer{
+			bw:          bufio.NewWriter(nil),
+			State:       WriterStateInit,
+			httpVersion: "1.1",
+			fields:      headers.NewHeaders(),
+		}
+	},
+}
+
+// NewResponseWriter returns a Writer from a pool shared by all connections.
+// Call Release once the response is complete.
 func NewResponseWriter(w io.Writer) *Writer {
+	rw := writerPool.Get().(*Writer)
+	rw.bw.Reset(w)
+	return rw
+}
+
+// Release resets w, discarding anything not yet flushed, and returns it to
+// the pool. The Writer must not be used afterwards. Stream writers are not
+// pooled and Release does nothing for them.
+func (w *Writer) Release() {
+	if w.stream != nil {
+		return
+	}
+
+	bw, fields, done := w.bw, w.fields, w.done
+	clear(done)
+	bw.Reset(nil)
+	clear(fields)
+	*w = Writer{
+		bw:          bw,
+		State:       WriterStateInit,
+		httpVersion: "1.1",
+		fields:      fields,
+		done:        done[:0],
+	}
+	writerPool.Put(w)
+}
+
+// OnHandlerDone registers f to run once the handler has returned, before
+// the server inspects or reuses w. Helpers that write to w from their own
+// goroutines use it to stop in time.
+func (w *Writer) OnHandlerDone(f func()) {
+	w.done = append(w.done, f)
+}
+
+// HandlerDone runs the functions registered with OnHandlerDone. Whatever
+// calls the handler calls it as soon as the handler returns.
+func (w *Writer) HandlerDone() {
+	for _, f := range w.done {
+		f()
+	}
+}
+
+// NewStreamWriter returns a Writer that sends the response to s. Attach,
+// Negotiate, SwitchProtocols and Hijack do not apply to stream writers.
+func NewStreamWriter(s Stream) *Writer {
 	return &Writer{
-		bw:    bufio.NewWriter(w),
-		State: WriterStateInit,
+		stream:      s,
+		State:       WriterStateInit,
+		httpVersion: "2.0",
+	}
+}
+
+// Negotiate records the version of the request being answered and whether
+// the client asked to keep the connection open. WriteHeaders uses it to pick
+// the Connection and Keep-Alive headers and to avoid chunked responses to
+// HTTP/1.0 clients. Without a call to Negotiate the connection is closed.
+func (w *Writer) Negotiate(httpVersion string, keepAlive bool, idleTimeout time.Duration) {
+	w.httpVersion = httpVersion
+	w.keepAlive = keepAlive
+	w.idleTimeout = idleTimeout
+}
+
+// Attach gives the writer the connection it writes to and the bytes already
+// read from it past the end of the current request, so a handler can switch
+// protocols. The server calls it for every request; buffered is only copied
+// if SwitchProtocols or Hijack is used.
+func (w *Writer) Attach(conn net.Conn, buffered []byte) {
+	w.conn = conn
+	w.buffered = buffered
+}
+
+// SwitchProtocols sends a 101 Switching Protocols response with the given
+// headers and returns the connection for the new protocol. Reads from the
+// returned connection see any bytes the client sent after the request
+// before new data from the socket. The server closes the connection once
+// the handler returns.
+func (w *Writer) SwitchProtocols(h headers.Headers) (net.Conn, error) {
+	if w.State != WriterStateInit {
+		return nil, fmt.Errorf("cannot switch protocols in state: %s", w.State)
+	}
+	if w.conn == nil {
+		return nil, ErrNotAttached
+	}
+
+	// Validated before the status line so that a bad field leaves nothing
+	// on the wire.
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := w.WriteStatusLine(SwitchingProtocols); err != nil {
+		return nil, err
+	}
+	w.Headers = h
+
+	if err := writeFields(w.bw, h); err != nil {
+		return nil, fmt.Errorf("error writing headers: %v", err)
+	}
+	if err := w.bw.Flush(); err != nil {
+		return nil, fmt.Errorf("error flushing buffer: %v", err)
+	}
+
+	w.State = WriterStateSwitched
+	w.closeAfter = true
+
+	conn, buffered := w.detach()
+	if len(buffered) > 0 {
+		conn = &prefixConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(buffered), conn),
+		}
+	}
+
+	return conn, nil
+}
+
+// Hijack hands the connection over to the caller. Any response output
+// still buffered is flushed first. The returned bytes were read from the
+// connection after the current request and must be handled before reading
+// from the socket. After Hijack the server does not write to or close the
+// connection, and the writer can no longer be used.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.State == WriterStateSwitched || w.State == WriterStateHijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.conn == nil {
+		return nil, nil, ErrNotAttached
+	}
+
+	if err := w.bw.Flush(); err != nil {
+		return nil, nil, fmt.Errorf("error flushing buffer: %v", err)
 	}
+
+	w.State = WriterStateHijacked
+	w.closeAfter = true
+
+	conn, buffered := w.detach()
+	return conn, buffered, nil
+}
+
+// Hijacked reports whether the handler took over the connection with
+// Hijack.
+func (w *Writer) Hijacked() bool {
+	return w.State == WriterStateHijacked
+}
+
+// detach releases the connection and a copy of the read-ahead bytes, which
+// belong to the request reader until then.
+func (w *Writer) detach() (net.Conn, []byte) {
+	conn, buffered := w.conn, bytes.Clone(w.buffered)
+	w.conn, w.buffered = nil, nil
+	return conn, buffered
+}
+
+// prefixConn replays bytes read ahead of the protocol switch before reading
+// from the connection itself.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// KeepAlive reports whether the connection can be reused once the response
+// has been written.
+func (w *Writer) KeepAlive() bool {
+	return w.State == WriterStateDone && !w.closeAfter
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	switch statusCode {
-	case OK:
-		w.StartLine = "HTTP/1.1 200 OK\r\n"
-	case BadRequest:
-		w.StartLine = "HTTP/1.1 400 Bad Request\r\n"
-	case NotFound:
-		w.StartLine = "HTTP/1.1 404 Not Found\r\n"
-	case InternalError:
-		w.StartLine = "HTTP/1.1 500 Internal Server Error\r\n"
-	default:
-		return fmt.Errorf("unsupported status code: %d", statusCode)
+	if w.State == WriterStateSwitched || w.State == WriterStateHijacked {
+		return ErrHijacked
+	}
+
+	line, err := statusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	w.StartLine = line
+	w.StatusCode = statusCode
+
+	if w.stream != nil {
+		// The status is sent with the header block.
+		w.State = WriterStateHeaders
+		return nil
 	}
 
 	if _, err := w.bw.WriteString(w.StartLine); err != nil {
@@ -64,15 +293,21 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 		return fmt.Errorf("cannot write headers in state: %s", w.State)
 	}
 
+	if err := headers.Validate(); err != nil {
+		return err
+	}
+
 	w.Headers = headers
 
-	var headerLines string
-	for key, value := range headers {
-		headerLines += fmt.Sprintf("%s: %s\r\n", key, value)
+	if w.stream != nil {
+		if err := w.stream.WriteHeaders(w.StatusCode, headers, false); err != nil {
+			return fmt.Errorf("error writing headers: %w", err)
+		}
+		w.State = WriterStateBody
+		return nil
 	}
-	headerLines += "\r\n"
 
-	if _, err := w.bw.WriteString(headerLines); err != nil {
+	if err := writeFields(w.bw, w.connectionHeaders(headers)); err != nil {
 		return fmt.Errorf("error writing headers: %v", err)
 	}
 
@@ -81,6 +316,61 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 	return nil
 }
 
+// writeFields writes h as field lines followed by the empty line ending the
+// section. Errors from a bufio.Writer are sticky, so only the last write
+// needs checking.
+func writeFields(bw *bufio.Writer, h headers.Headers) error {
+	for key, value := range h {
+		bw.WriteString(key)
+		bw.WriteString(": ")
+		bw.WriteString(value)
+		bw.WriteString("\r\n")
+	}
+	_, err := bw.WriteString("\r\n")
+	return err
+}
+
+// connectionHeaders returns a copy of h with the connection management
+// fields the negotiated client needs. A chunked response to an HTTP/1.0
+// client is sent unframed and delimited by closing the connection. The
+// copy is the writer's scratch map and is only valid until the next call.
+func (w *Writer) connectionHeaders(h headers.Headers) headers.Headers {
+	out := w.fields
+	if out == nil {
+		out = headers.NewHeaders()
+		w.fields = out
+	}
+	clear(out)
+	for key, value := range h {
+		out[key] = value
+	}
+
+	chunked := headers.HasToken(h.Get("Transfer-Encoding"), "chunked")
+	if chunked && w.httpVersion == "1.0" {
+		out.Del("Transfer-Encoding")
+		out.Del("Trailer")
+		w.rawChunks = true
+	}
+
+	w.closeAfter = !w.keepAlive ||
+		w.rawChunks ||
+		headers.HasToken(h.Get("Connection"), "close") ||
+		(!chunked && h.Get("Content-Length") == "")
+
+	switch {
+	case w.closeAfter:
+		out.Del("Keep-Alive")
+		if !headers.HasToken(h.Get("Connection"), "close") {
+			out.Override("Connection", "close")
+		}
+	case w.httpVersion == "1.0":
+		out.Override("Connection", "keep-alive")
+		out.Override("Keep-Alive", fmt.Sprintf("timeout=%d", int(w.idleTimeout.Seconds())))
+	}
+
+	return out
+}
+
 func (w *Writer) WriteBody(body []byte) (int, error) {
 	if w.State != WriterStateBody {
 		return 0, fmt.Errorf("cannot write body in state: %s", w.State)
@@ -88,17 +378,201 @@ func (w *Writer) WriteBody(body []byte) (int, error) {
 
 	w.Body = body
 
-	if _, err := w.bw.Write(body); err != nil {
-		return 0, fmt.Errorf("error writing body: %v", err)
+	if w.stream != nil {
+		if err := w.stream.WriteData(body, true); err != nil {
+			return 0, fmt.Errorf("error writing body: %w", err)
+		}
+		w.BytesWritten += int64(len(body))
+		w.State = WriterStateDone
+		return len(body), nil
+	}
+
+	n, err := w.bw.Write(body)
+	w.BytesWritten += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("error writing body: %v", err)
 	}
 
 	w.State = WriterStateDone
 
+	if err := w.bw.Flush(); err != nil {
+		return n, fmt.Errorf("error flushing buffer: %v", err)
+	}
+
+	return n, nil
+}
+
+// WriteBodyPart sends the next part of a body whose length was declared in
+// Content-Length, for responses streamed as they are produced. The
+// response is complete once that many bytes have been sent; a part that
+// would go past it is not written. A response left short never completes,
+// so the connection is closed after it.
+func (w *Writer) WriteBodyPart(p []byte) (int, error) {
+	if w.State != WriterStateBody {
+		return 0, fmt.Errorf("cannot write body in state: %s", w.State)
+	}
+
+	n, err := strconv.ParseInt(w.Headers.Get("Content-Length"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid content-length %q", w.Headers.Get("Content-Length"))
+	}
+	remaining := n - w.BytesWritten
+	if int64(len(p)) > remaining {
+		return 0, fmt.Errorf("error writing body: %d bytes past content-length %d", int64(len(p))-remaining, n)
+	}
+	last := int64(len(p)) == remaining
+
+	if w.stream != nil {
+		if err := w.stream.WriteData(p, last); err != nil {
+			return 0, fmt.Errorf("error writing body: %w", err)
+		}
+		w.BytesWritten += int64(len(p))
+		if last {
+			w.State = WriterStateDone
+		}
+		return len(p), nil
+	}
+
+	written, err := w.bw.Write(p)
+	w.BytesWritten += int64(written)
+	if err != nil {
+		return written, fmt.Errorf("error writing body: %v", err)
+	}
+
+	if last {
+		w.State = WriterStateDone
+		if err := w.bw.Flush(); err != nil {
+			return written, fmt.Errorf("error flushing buffer: %v", err)
+		}
+	}
+
+	return written, nil
+}
+
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32<<10)
+		return &buf
+	},
+}
+
+// ReadFrom sends the body read from src. A fixed-length response is
+// completed as by WriteBody, reading no more than Content-Length bytes; if
+// the connection implements io.ReaderFrom, as *net.TCPConn does, the copy
+// is handed to it so an *os.File goes out with sendfile. A source that ends
+// early fails with io.ErrUnexpectedEOF and the connection is closed. A
+// chunked response is copied through a buffer, one chunk per read, and is
+// still ended with WriteChunkedBodyDone.
+func (w *Writer) ReadFrom(src io.Reader) (int64, error) {
+	if w.State != WriterStateBody {
+		return 0, fmt.Errorf("cannot write body in state: %s", w.State)
+	}
+
+	if headers.HasToken(w.Headers.Get("Transfer-Encoding"), "chunked") {
+		return w.copyChunks(src)
+	}
+
+	limit := int64(-1)
+	if cl := w.Headers.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid content-length %q", cl)
+		}
+		limit = n
+		src = io.LimitReader(src, n)
+	}
+
+	var n int64
+	var err error
+	if w.stream != nil {
+		n, err = w.copyData(src)
+	} else {
+		n, err = w.copyRaw(src)
+	}
+	w.BytesWritten += n
+	if err != nil {
+		return n, err
+	}
+
+	w.State = WriterStateDone
+
+	if limit >= 0 && n < limit {
+		w.closeAfter = true
+		return n, fmt.Errorf("error writing body: %w after %d of %d bytes", io.ErrUnexpectedEOF, n, limit)
+	}
+
+	return n, nil
+}
+
+// copyRaw writes src to the connection. The header section is flushed
+// first so bufio.Writer passes src on to the connection's ReadFrom.
+func (w *Writer) copyRaw(src io.Reader) (int64, error) {
 	if err := w.bw.Flush(); err != nil {
 		return 0, fmt.Errorf("error flushing buffer: %v", err)
 	}
 
-	return 0, nil
+	n, err := w.bw.ReadFrom(src)
+	if err != nil {
+		return n, fmt.Errorf("error writing body: %v", err)
+	}
+
+	if err := w.bw.Flush(); err != nil {
+		return n, fmt.Errorf("error flushing buffer: %v", err)
+	}
+
+	return n, nil
+}
+
+// copyData sends src to a Stream and ends it.
+func (w *Writer) copyData(src io.Reader) (int64, error) {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+
+	var written int64
+	for {
+		n, rerr := src.Read(*bufp)
+		if n > 0 {
+			if err := w.stream.WriteData((*bufp)[:n], false); err != nil {
+				return written, fmt.Errorf("error writing body: %w", err)
+			}
+			written += int64(n)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+
+	if err := w.stream.WriteData(nil, true); err != nil {
+		return written, fmt.Errorf("error writing body: %w", err)
+	}
+
+	return written, nil
+}
+
+// copyChunks writes each read from src as a chunk.
+func (w *Writer) copyChunks(src io.Reader) (int64, error) {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+
+	var written int64
+	for {
+		n, rerr := src.Read(*bufp)
+		if n > 0 {
+			if _, err := w.WriteChunkedBody((*bufp)[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
@@ -106,12 +580,31 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return 0, fmt.Errorf("cannot write chunked body in state: %s", w.State)
 	}
 
+	if w.stream != nil {
+		if err := w.stream.WriteData(p, false); err != nil {
+			return 0, fmt.Errorf("error writing chunk data: %w", err)
+		}
+		w.BytesWritten += int64(len(p))
+		return len(p), nil
+	}
+
+	if w.rawChunks {
+		n, err := w.bw.Write(p)
+		w.BytesWritten += int64(n)
+		if err != nil {
+			return n, fmt.Errorf("error writing body: %v", err)
+		}
+		return n, nil
+	}
+
 	chunkSize := fmt.Sprintf("%x\r\n", len(p))
 	if _, err := w.bw.WriteString(chunkSize); err != nil {
 		return 0, fmt.Errorf("error writing chunk size: %v", err)
 	}
 
-	if _, err := w.bw.Write(p); err != nil {
+	n, err := w.bw.Write(p)
+	w.BytesWritten += int64(n)
+	if err != nil {
 		return 0, fmt.Errorf("error writing chunk data: %v", err)
 	}
 
@@ -122,6 +615,24 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// Flush sends any buffered response bytes to the client. Streaming
+// handlers call it after each chunk that should not wait for the next one.
+func (w *Writer) Flush() error {
+	if w.State == WriterStateSwitched || w.State == WriterStateHijacked {
+		return ErrHijacked
+	}
+
+	if w.stream != nil {
+		return w.stream.Flush()
+	}
+
+	if err := w.bw.Flush(); err != nil {
+		return fmt.Errorf("error flushing buffer: %v", err)
+	}
+
+	return nil
+}
+
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.State != WriterStateBody {
 		return 0, fmt.Errorf("cannot write chunked body done in state: %s", w.State)
@@ -129,6 +640,32 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 
 	hasTrailers := w.Headers.Get("Trailer") != ""
 
+	if w.stream != nil {
+		if hasTrailers {
+			w.State = WriterStateTrailers
+			return 0, nil
+		}
+		if err := w.stream.WriteData(nil, true); err != nil {
+			return 0, fmt.Errorf("error ending body: %w", err)
+		}
+		w.State = WriterStateDone
+		return 0, nil
+	}
+
+	if w.rawChunks {
+		if hasTrailers {
+			w.State = WriterStateTrailers
+			return 0, nil
+		}
+
+		if err := w.bw.Flush(); err != nil {
+			return 0, fmt.Errorf("error flushing buffer: %v", err)
+		}
+
+		w.State = WriterStateDone
+		return 0, nil
+	}
+
 	doneBody := "0\r\n"
 	if _, err := w.bw.WriteString(doneBody); err != nil {
 		return 0, fmt.Errorf("error writing final chunk: %v", err)
@@ -157,15 +694,30 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 		return fmt.Errorf("cannot write trailers in state: %s", w.State)
 	}
 
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
 	w.Trailers = h
 
-	var trailerLines string
-	for key, value := range h {
-		trailerLines += fmt.Sprintf("%s: %s\r\n", key, value)
+	if w.stream != nil {
+		if err := w.stream.WriteTrailers(h); err != nil {
+			return fmt.Errorf("error writing trailers: %w", err)
+		}
+		w.State = WriterStateDone
+		return nil
+	}
+
+	if w.rawChunks {
+		if err := w.bw.Flush(); err != nil {
+			return fmt.Errorf("error flushing buffer: %v", err)
+		}
+
+		w.State = WriterStateDone
+		return nil
 	}
-	trailerLines += "\r\n"
 
-	if _, err := w.bw.WriteString(trailerLines); err != nil {
+	if err := writeFields(w.bw, h); err != nil {
 		return fmt.Errorf("error writing trailers: %v", err)
 	}
 
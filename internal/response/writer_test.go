@@ -0,0 +1,383 @@
+package response
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterHeaderInjection(t *testing.T) {
+	// Test: Header value with CRLF is rejected and nothing is written
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := GetDefaultHeaders(0)
+	h.Override("X-Echo", "hello\r\nSet-Cookie: session=stolen")
+	err := w.WriteHeaders(h)
+	require.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+	assert.Equal(t, WriterStateHeaders, w.State)
+
+	// Test: Handler can recover by writing valid headers
+	h.Override("X-Echo", "hello")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteBody(nil)
+	require.NoError(t, err)
+	assert.NotContains(t, buf.String(), "Set-Cookie")
+	assert.Contains(t, buf.String(), "x-echo: hello\r\n")
+
+	// Test: Package-level WriteHeaders validates too
+	buf.Reset()
+	err = WriteHeaders(&buf, headers.Headers{"bad name": "x"})
+	require.ErrorIs(t, err, headers.ErrInvalidFieldName)
+	assert.Empty(t, buf.String())
+
+	// Test: Trailers are validated
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = GetDefaultHeaders(0)
+	h.Del("Content-Length")
+	h.Override("Transfer-Encoding", "chunked")
+	h.Override("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	err = w.WriteTrailers(headers.Headers{"x-checksum": "abc\n"})
+	require.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+	assert.Equal(t, WriterStateTrailers, w.State)
+}
+
+func TestWriterNegotiate(t *testing.T) {
+	// Test: HTTP/1.1 keep-alive with Content-Length leaves the connection open
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	w.Negotiate("1.1", true, 5*time.Second)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err := w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	assert.True(t, w.KeepAlive())
+	assert.NotContains(t, buf.String(), "connection:")
+
+	// Test: HTTP/1.0 keep-alive gets Connection and Keep-Alive headers
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	w.Negotiate("1.0", true, 5*time.Second)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	assert.True(t, w.KeepAlive())
+	assert.Contains(t, buf.String(), "connection: keep-alive\r\n")
+	assert.Contains(t, buf.String(), "keep-alive: timeout=5\r\n")
+
+	// Test: Client asking to close gets Connection: close
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	w.Negotiate("1.1", false, 5*time.Second)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	_, err = w.WriteBody(nil)
+	require.NoError(t, err)
+	assert.False(t, w.KeepAlive())
+	assert.Contains(t, buf.String(), "connection: close\r\n")
+
+	// Test: Chunked response to HTTP/1.0 is sent unframed and closes
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	w.Negotiate("1.0", true, 5*time.Second)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := GetDefaultHeaders(0)
+	h.Del("Content-Length")
+	h.Override("Transfer-Encoding", "chunked")
+	h.Override("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.Headers{"x-checksum": "abc"}))
+	assert.False(t, w.KeepAlive())
+	out := buf.String()
+	assert.NotContains(t, out, "transfer-encoding")
+	assert.NotContains(t, out, "x-checksum")
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello world"))
+}
+
+func TestWriterSwitchProtocols(t *testing.T) {
+	// Test: Without Attach there is no connection to hand over
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	_, err := w.SwitchProtocols(headers.Headers{"upgrade": "test"})
+	require.ErrorIs(t, err, ErrNotAttached)
+
+	// Test: An invalid header is refused before the status line is written
+	client, server := net.Pipe()
+	defer client.Close()
+	w = NewResponseWriter(server)
+	w.Attach(server, nil)
+	_, err = w.SwitchProtocols(headers.Headers{"upgrade": "test\r\nx-injected: 1"})
+	require.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+	assert.Equal(t, WriterStateInit, w.State)
+	assert.Zero(t, w.bw.Buffered())
+
+	// Test: 101 is flushed and read-ahead bytes are replayed first
+	client, server = net.Pipe()
+	defer client.Close()
+	w = NewResponseWriter(server)
+	w.Attach(server, []byte("early "))
+
+	done := make(chan net.Conn)
+	go func() {
+		conn, err := w.SwitchProtocols(headers.Headers{"upgrade": "test", "connection": "Upgrade"})
+		assert.NoError(t, err)
+		done <- conn
+	}()
+
+	head := make([]byte, 512)
+	n, err := client.Read(head)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(head[:n]), "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, string(head[:n]), "upgrade: test\r\n")
+
+	conn := <-done
+	assert.Equal(t, WriterStateSwitched, w.State)
+	assert.False(t, w.KeepAlive())
+
+	go func() {
+		io.WriteString(client, "late")
+		client.Close()
+	}()
+	rest, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "early late", string(rest))
+
+	// Test: Cannot switch after the response has started
+	_, err = w.SwitchProtocols(headers.Headers{"upgrade": "test"})
+	assert.Error(t, err)
+}
+
+func TestWriterFlush(t *testing.T) {
+	// Test: Chunks stay buffered until Flush
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"transfer-encoding": "chunked"}))
+	_, err := w.WriteChunkedBody([]byte("event"))
+	require.NoError(t, err)
+	assert.Empty(t, buf.String())
+
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "5\r\nevent\r\n"))
+
+	// Test: Flush is refused once the connection is hijacked
+	client, server := net.Pipe()
+	defer client.Close()
+	w = NewResponseWriter(server)
+	w.Attach(server, nil)
+	_, _, err = w.Hijack()
+	require.NoError(t, err)
+	assert.ErrorIs(t, w.Flush(), ErrHijacked)
+}
+
+func TestWriterWriteBodyPart(t *testing.T) {
+	// Test: Parts of a declared length complete the response
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"content-length": "10"}))
+	_, err := w.WriteBodyPart([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, WriterStateBody, w.State)
+	_, err = w.WriteBodyPart([]byte("world"))
+	require.NoError(t, err)
+	assert.Equal(t, WriterStateDone, w.State)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhelloworld"))
+
+	// Test: A part past the declared length is not written
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"content-length": "3"}))
+	n, err := w.WriteBodyPart([]byte("hello"))
+	assert.Error(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, WriterStateBody, w.State)
+	assert.False(t, w.KeepAlive())
+}
+
+func TestWriterRelease(t *testing.T) {
+	// Test: A released writer drops unflushed output and starts clean
+	var first, second bytes.Buffer
+	w := NewResponseWriter(&first)
+	w.Negotiate("1.0", true, time.Minute)
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"transfer-encoding": "chunked", "x-secret": "first"}))
+	_, err := w.WriteChunkedBody([]byte("unflushed"))
+	require.NoError(t, err)
+	w.Release()
+
+	for i := 0; i < 10; i++ {
+		second.Reset()
+		w = NewResponseWriter(&second)
+		assert.Equal(t, WriterStateInit, w.State)
+		assert.Zero(t, w.StatusCode)
+		assert.Zero(t, w.BytesWritten)
+		assert.Nil(t, w.Headers)
+
+		require.NoError(t, w.WriteStatusLine(OK))
+		require.NoError(t, w.WriteHeaders(headers.Headers{"content-length": "2"}))
+		_, err = w.WriteBody([]byte("ok"))
+		require.NoError(t, err)
+		out := second.String()
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+		assert.True(t, strings.HasSuffix(out, "\r\n\r\nok"))
+		assert.Equal(t, 2, strings.Count(out, ": "))
+		assert.Contains(t, out, "content-length: 2\r\n")
+		assert.Contains(t, out, "connection: close\r\n")
+		w.Release()
+	}
+	assert.Empty(t, first.String())
+}
+
+func BenchmarkWriter(b *testing.B) {
+	body := []byte("Hello, World!\n")
+	h := GetDefaultHeaders(len(body))
+	h.Set("Cache-Control", "no-cache")
+
+	b.Run("fixed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w := NewResponseWriter(io.Discard)
+			w.Negotiate("1.1", true, time.Minute)
+			w.WriteStatusLine(OK)
+			w.WriteHeaders(h)
+			w.WriteBody(body)
+			w.Release()
+		}
+	})
+
+	b.Run("chunked", func(b *testing.B) {
+		h := headers.Headers{"transfer-encoding": "chunked", "content-type": "text/plain"}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w := NewResponseWriter(io.Discard)
+			w.Negotiate("1.1", true, time.Minute)
+			w.WriteStatusLine(OK)
+			w.WriteHeaders(h)
+			w.WriteChunkedBody(body)
+			w.WriteChunkedBodyDone()
+			w.Release()
+		}
+	})
+}
+
+// readerFromBuffer records what a Writer hands to its connection's
+// ReadFrom.
+type readerFromBuffer struct {
+	bytes.Buffer
+	src io.Reader
+}
+
+func (b *readerFromBuffer) ReadFrom(r io.Reader) (int64, error) {
+	b.src = r
+	return b.Buffer.ReadFrom(r)
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	content := strings.Repeat("frame ", 20000)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	// Test: A file in a fixed-length response is handed to the connection's ReadFrom
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var conn readerFromBuffer
+	w := NewResponseWriter(&conn)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(content))))
+	n, err := w.ReadFrom(f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, int64(len(content)), w.BytesWritten)
+	assert.Equal(t, WriterStateDone, w.State)
+	lr, ok := conn.src.(*io.LimitedReader)
+	require.True(t, ok)
+	assert.Same(t, f, lr.R)
+	assert.True(t, strings.HasSuffix(conn.String(), "\r\n\r\n"+content))
+
+	// Test: No more than Content-Length bytes are sent
+	var buf bytes.Buffer
+	w = NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	n, err = w.ReadFrom(strings.NewReader("abcdef"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nabc"))
+
+	// Test: A short source fails and closes the connection
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	w.Negotiate("1.1", true, time.Minute)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	_, err = w.ReadFrom(strings.NewReader("abc"))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.False(t, w.KeepAlive())
+
+	// Test: A chunked response is copied as chunks
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"transfer-encoding": "chunked"}))
+	n, err = w.ReadFrom(strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, WriterStateBody, w.State)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+
+	// Test: Files reach a TCP client intact
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		f, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		w := NewResponseWriter(conn)
+		w.WriteStatusLine(OK)
+		w.WriteHeaders(GetDefaultHeaders(len(content)))
+		w.ReadFrom(f)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	resp, err := ResponseFromReader(client)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(resp.Body))
+}
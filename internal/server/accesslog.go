@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogEntry describes one request and the response sent for it.
+// Requests rejected before they could be parsed have empty Method, Target
+// and Version.
+type AccessLogEntry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Target     string
+	Version    string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	UserAgent  string
+	Referer    string
+}
+
+// AccessLogger receives an entry for every response the server writes.
+// Implementations must be safe for concurrent use.
+type AccessLogger interface {
+	LogAccess(entry AccessLogEntry)
+}
+
+// WithAccessLog sends an entry to logger after each response.
+func WithAccessLog(logger AccessLogger) Option {
+	return func(s *Server) {
+		s.accessLog = logger
+	}
+}
+
+type textAccessLogger struct {
+	mu       sync.Mutex
+	w        io.Writer
+	combined bool
+}
+
+// NewCommonLogger writes entries in the Common Log Format.
+func NewCommonLogger(w io.Writer) AccessLogger {
+	return &textAccessLogger{w: w}
+}
+
+// NewCombinedLogger writes entries in the Combined Log Format, which adds
+// the Referer and User-Agent to the Common Log Format.
+func NewCombinedLogger(w io.Writer) AccessLogger {
+	return &textAccessLogger{w: w, combined: true}
+}
+
+func (l *textAccessLogger) LogAccess(e AccessLogEntry) {
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	requestLine := "-"
+	if e.Method != "" {
+		requestLine = fmt.Sprintf("%s %s HTTP/%s", e.Method, e.Target, e.Version)
+	}
+
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = fmt.Sprintf("%d", e.Bytes)
+	}
+
+	line := fmt.Sprintf("%s - - [%s] \"%s\" %d %s",
+		logField(host),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeLogString(requestLine),
+		e.Status,
+		bytes,
+	)
+	if l.combined {
+		line += fmt.Sprintf(" \"%s\" \"%s\"", escapeLogString(logField(e.Referer)), escapeLogString(logField(e.UserAgent)))
+	}
+	line += "\n"
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line)
+}
+
+func logField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escapeLogString escapes quotes, backslashes and non-printable bytes so
+// that client-supplied values cannot forge log lines.
+func escapeLogString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+type slogAccessLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogAccessLogger logs entries as structured records, for example
+// through slog.NewJSONHandler.
+func NewSlogAccessLogger(logger *slog.Logger) AccessLogger {
+	return &slogAccessLogger{logger: logger}
+}
+
+func (l *slogAccessLogger) LogAccess(e AccessLogEntry) {
+	l.logger.LogAttrs(context.Background(), slog.LevelInfo, "access",
+		slog.Time("time", e.Time),
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.String("method", e.Method),
+		slog.String("target", e.Target),
+		slog.String("version", e.Version),
+		slog.Int("status", e.Status),
+		slog.Int64("bytes", e.Bytes),
+		slog.Duration("duration", e.Duration),
+		slog.String("user_agent", e.UserAgent),
+		slog.String("referer", e.Referer),
+	)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chanAccessLogger chan AccessLogEntry
+
+func (c chanAccessLogger) LogAccess(e AccessLogEntry) {
+	c <- e
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := AccessLogEntry{
+		Time:       time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60)),
+		RemoteAddr: "127.0.0.1:5555",
+		Method:     "GET",
+		Target:     "/apache_pb.gif",
+		Version:    "1.0",
+		Status:     200,
+		Bytes:      2326,
+		Duration:   15 * time.Millisecond,
+		UserAgent:  "Mozilla/4.08 [en] (Win98; I ;Nav)",
+		Referer:    "http://www.example.com/start.html",
+	}
+
+	// Test: Common Log Format
+	var buf bytes.Buffer
+	NewCommonLogger(&buf).LogAccess(entry)
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`+"\n", buf.String())
+
+	// Test: Combined Log Format
+	buf.Reset()
+	NewCombinedLogger(&buf).LogAccess(entry)
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`+"\n", buf.String())
+
+	// Test: Client-supplied fields are escaped and empty fields are dashes
+	buf.Reset()
+	forged := entry
+	forged.UserAgent = "evil\"\n127.0.0.1 - - fake"
+	forged.Referer = ""
+	forged.Bytes = 0
+	NewCombinedLogger(&buf).LogAccess(forged)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), ` 200 - "-" "evil\"\x0a127.0.0.1 - - fake"`)
+
+	// Test: slog JSON output
+	buf.Reset()
+	NewSlogAccessLogger(slog.New(slog.NewJSONHandler(&buf, nil))).LogAccess(entry)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "access", record["msg"])
+	assert.Equal(t, "GET", record["method"])
+	assert.Equal(t, "/apache_pb.gif", record["target"])
+	assert.Equal(t, float64(200), record["status"])
+	assert.Equal(t, float64(2326), record["bytes"])
+	assert.Equal(t, entry.UserAgent, record["user_agent"])
+}
+
+func TestServerAccessLog(t *testing.T) {
+	entries := make(chanAccessLogger, 4)
+	s, err := ServeAddr("tcp", "127.0.0.1:0", echoTarget, WithAccessLog(entries))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Served request is logged with status and body size
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	go io.WriteString(conn, "GET /logged HTTP/1.1\r\nHost: x\r\nUser-Agent: test\r\nReferer: /from\r\nConnection: close\r\n\r\n")
+	readAll(t, conn)
+
+	e := <-entries
+	assert.Equal(t, "GET", e.Method)
+	assert.Equal(t, "/logged", e.Target)
+	assert.Equal(t, "1.1", e.Version)
+	assert.Equal(t, 200, e.Status)
+	assert.Equal(t, int64(len("/logged")), e.Bytes)
+	assert.Equal(t, "test", e.UserAgent)
+	assert.Equal(t, "/from", e.Referer)
+	assert.Equal(t, conn.LocalAddr().String(), e.RemoteAddr)
+
+	// Test: Unparseable request is logged with its error status
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	go io.WriteString(conn, "nonsense\r\n\r\n")
+	readAll(t, conn)
+
+	e = <-entries
+	assert.Equal(t, 400, e.Status)
+	assert.Empty(t, e.Method)
+}
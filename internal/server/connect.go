@@ -0,0 +1,255 @@
+package server
+
+import (
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultConnectDialTimeout = 10 * time.Second
+	defaultTunnelIdleTimeout  = 5 * time.Minute
+	tunnelBufferSize          = 32 << 10
+)
+
+var ErrTunnelIdle = errors.New("tunnel idle timeout")
+
+// ConnectStats counts tunnels opened by a ConnectProxy and the bytes spliced
+// through them.
+type ConnectStats struct {
+	Tunnels atomic.Int64
+	// BytesUpstream is client to destination, BytesDownstream the reverse.
+	BytesUpstream   atomic.Int64
+	BytesDownstream atomic.Int64
+}
+
+// Tunnel describes a CONNECT tunnel once it has been torn down.
+type Tunnel struct {
+	Target          string
+	RemoteAddr      string
+	BytesUpstream   int64
+	BytesDownstream int64
+	Duration        time.Duration
+	// Err is the first error that ended the tunnel, or nil if both sides
+	// closed cleanly.
+	Err error
+}
+
+// ConnectProxy answers CONNECT requests by dialing the authority-form
+// target, replying 200 and splicing bytes in both directions until both
+// sides are done. The tunnel runs inside the handler, so it counts against
+// WithMaxRequests for its whole lifetime.
+type ConnectProxy struct {
+	// Authorize, if set, is called before dialing. A non-nil result rejects
+	// the tunnel with that response, for example a 407 carrying a
+	// Proxy-Authenticate header.
+	Authorize func(req *request.Request) *HandlerError
+	// Dial opens the connection to the destination. It defaults to a
+	// net.Dialer using DialTimeout.
+	Dial        func(network, address string) (net.Conn, error)
+	DialTimeout time.Duration
+	// IdleTimeout closes the tunnel once neither side has sent anything for
+	// this long. Zero disables it.
+	IdleTimeout time.Duration
+	// OnClose, if set, is called after each tunnel is torn down. Hijacked
+	// connections are not access logged, so this is where to log tunnels.
+	OnClose func(Tunnel)
+
+	Stats ConnectStats
+}
+
+func NewConnectProxy() *ConnectProxy {
+	return &ConnectProxy{
+		DialTimeout: defaultConnectDialTimeout,
+		IdleTimeout: defaultTunnelIdleTimeout,
+	}
+}
+
+func (p *ConnectProxy) Handle(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != "CONNECT" {
+		writeProxyError(w, response.MethodNotAllowed)
+		return
+	}
+
+	// The parser only accepts authority-form targets for CONNECT.
+	target := req.RequestLine.RequestTarget
+
+	if p.Authorize != nil {
+		if herr := p.Authorize(req); herr != nil {
+			writeHandlerError(w, herr)
+			return
+		}
+	}
+
+	dst, err := p.dial(target)
+	if err != nil {
+		log.Printf("connect: dialing %s: %v", target, err)
+		status := response.BadGateway
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			status = response.GatewayTimeout
+		}
+		writeProxyError(w, status)
+		return
+	}
+	defer dst.Close()
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		log.Printf("connect: %v", err)
+		writeProxyError(w, response.InternalError)
+		return
+	}
+	defer conn.Close()
+
+	// A 2xx response to CONNECT has no content and no framing headers
+	// (RFC 9110 section 9.3.6).
+	if err := response.WriteStatusLine(conn, response.OK); err != nil {
+		return
+	}
+	if _, err := io.WriteString(conn, "\r\n"); err != nil {
+		return
+	}
+
+	p.Stats.Tunnels.Add(1)
+	tunnel := Tunnel{Target: target, RemoteAddr: req.RemoteAddr}
+	start := time.Now()
+
+	if len(buffered) > 0 {
+		n, err := dst.Write(buffered)
+		tunnel.BytesUpstream += int64(n)
+		p.Stats.BytesUpstream.Add(int64(n))
+		if err != nil {
+			tunnel.Err = err
+		}
+	}
+
+	if tunnel.Err == nil {
+		up, down, err := p.splice(conn, dst)
+		tunnel.BytesUpstream += up
+		tunnel.BytesDownstream = down
+		tunnel.Err = err
+	}
+	tunnel.Duration = time.Since(start)
+
+	if p.OnClose != nil {
+		p.OnClose(tunnel)
+	}
+}
+
+func (p *ConnectProxy) dial(target string) (net.Conn, error) {
+	if p.Dial != nil {
+		return p.Dial("tcp", target)
+	}
+
+	d := net.Dialer{Timeout: p.DialTimeout}
+	return d.Dial("tcp", target)
+}
+
+type spliceResult struct {
+	n   int64
+	err error
+}
+
+// splice copies in both directions. When one side finishes cleanly the
+// other is half-closed and left to drain; any error tears down both.
+func (p *ConnectProxy) splice(client, dst net.Conn) (up, down int64, err error) {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	upCh := make(chan spliceResult, 1)
+	downCh := make(chan spliceResult, 1)
+
+	go func() {
+		n, err := p.copyIdle(dst, client, &lastActive, &p.Stats.BytesUpstream)
+		closeWrite(dst)
+		upCh <- spliceResult{n, err}
+	}()
+	go func() {
+		n, err := p.copyIdle(client, dst, &lastActive, &p.Stats.BytesDownstream)
+		closeWrite(client)
+		downCh <- spliceResult{n, err}
+	}()
+
+	for pending := 2; pending > 0; pending-- {
+		var r spliceResult
+		select {
+		case r = <-upCh:
+			up = r.n
+		case r = <-downCh:
+			down = r.n
+		}
+
+		if r.err != nil && err == nil {
+			err = r.err
+			client.Close()
+			dst.Close()
+		}
+	}
+
+	return up, down, err
+}
+
+// copyIdle copies src to dst until EOF. A read deadline expiring only ends
+// the copy if neither direction has been active for IdleTimeout.
+func (p *ConnectProxy) copyIdle(dst, src net.Conn, lastActive, counter *atomic.Int64) (int64, error) {
+	buf := make([]byte, tunnelBufferSize)
+	var total int64
+
+	for {
+		if p.IdleTimeout > 0 {
+			src.SetReadDeadline(time.Unix(0, lastActive.Load()).Add(p.IdleTimeout))
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			if p.IdleTimeout > 0 {
+				dst.SetWriteDeadline(time.Now().Add(p.IdleTimeout))
+			}
+
+			written, werr := dst.Write(buf[:n])
+			total += int64(written)
+			counter.Add(int64(written))
+			if werr != nil {
+				return total, werr
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return total, nil
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if time.Since(time.Unix(0, lastActive.Load())) < p.IdleTimeout {
+					continue
+				}
+				return total, ErrTunnelIdle
+			}
+			return total, err
+		}
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+func writeHandlerError(w *response.Writer, herr *HandlerError) {
+	body := []byte(herr.Message)
+	w.WriteStatusLine(herr.StatusCode)
+	h := response.GetDefaultHeaders(len(body))
+	for key, value := range herr.Headers {
+		h.Override(key, value)
+	}
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoServer accepts TCP connections and echoes everything back until
+// the client half-closes.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func startConnectProxy(t *testing.T, p *ConnectProxy) string {
+	t.Helper()
+
+	s, err := ServeAddr("tcp", "127.0.0.1:0", p.Handle)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s.Addr().String()
+}
+
+// openTunnel sends a CONNECT request followed by early and returns the
+// connection with the response status line already read.
+func openTunnel(t *testing.T, proxyAddr, target, extraHeaders, early string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n"+extraHeaders+"\r\n"+early)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+
+	return conn, br, status
+}
+
+func TestConnectProxy(t *testing.T) {
+	echo := startEchoServer(t)
+
+	tunnels := make(chan Tunnel, 1)
+	p := NewConnectProxy()
+	p.Authorize = func(req *request.Request) *HandlerError {
+		if req.Headers.Get("Proxy-Authorization") == "Basic dXNlcjpwYXNz" {
+			return nil
+		}
+		return &HandlerError{
+			StatusCode: 407,
+			Message:    "Proxy Authentication Required\n",
+			Headers:    headers.Headers{"proxy-authenticate": `Basic realm="proxy"`},
+		}
+	}
+	p.OnClose = func(tun Tunnel) { tunnels <- tun }
+	addr := startConnectProxy(t, p)
+
+	// Test: Unauthorized tunnels get the handler's 407
+	conn, br, status := openTunnel(t, addr, echo, "Connection: close\r\n", "")
+	assert.Equal(t, "HTTP/1.1 407 Proxy Authentication Required\r\n", status)
+	rest, _ := io.ReadAll(br)
+	assert.Contains(t, string(rest), "proxy-authenticate: Basic realm=\"proxy\"\r\n")
+	conn.Close()
+
+	// Test: Authorized tunnel relays bytes both ways, including bytes sent
+	// with the request
+	conn, br, status = openTunnel(t, addr, echo, "Proxy-Authorization: Basic dXNlcjpwYXNz\r\n", "early ")
+	require.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	blank, err := br.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "\r\n", blank)
+
+	_, err = io.WriteString(conn, "ping")
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	// Test: Half-close propagates so the echo server's EOF ends the tunnel
+	out, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "early ping", string(out))
+
+	tun := <-tunnels
+	assert.Equal(t, echo, tun.Target)
+	assert.Equal(t, int64(10), tun.BytesUpstream)
+	assert.Equal(t, int64(10), tun.BytesDownstream)
+	assert.NoError(t, tun.Err)
+	assert.Equal(t, int64(1), p.Stats.Tunnels.Load())
+	assert.Equal(t, int64(10), p.Stats.BytesUpstream.Load())
+	assert.Equal(t, int64(10), p.Stats.BytesDownstream.Load())
+}
+
+func TestConnectProxyErrors(t *testing.T) {
+	echo := startEchoServer(t)
+
+	tunnels := make(chan Tunnel, 1)
+	p := NewConnectProxy()
+	p.IdleTimeout = 100 * time.Millisecond
+	p.OnClose = func(tun Tunnel) { tunnels <- tun }
+	addr := startConnectProxy(t, p)
+
+	// Test: Idle tunnels are torn down
+	conn, br, status := openTunnel(t, addr, echo, "", "")
+	require.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	start := time.Now()
+	io.ReadAll(br)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.ErrorIs(t, (<-tunnels).Err, ErrTunnelIdle)
+	conn.Close()
+
+	// Test: Activity in either direction keeps the tunnel open
+	conn, br, status = openTunnel(t, addr, echo, "", "")
+	require.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	br.ReadString('\n')
+	for i := 0; i < 4; i++ {
+		time.Sleep(60 * time.Millisecond)
+		io.WriteString(conn, "x")
+		b, err := br.ReadByte()
+		require.NoError(t, err)
+		assert.Equal(t, byte('x'), b)
+	}
+	conn.Close()
+	<-tunnels
+
+	// Test: Unreachable destinations are a 502
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := ln.Addr().String()
+	ln.Close()
+	_, _, status = openTunnel(t, addr, closed, "", "")
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway\r\n", status)
+
+	// Test: Other methods are refused
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	out := readAll(t, conn)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+}
@@ -0,0 +1,24 @@
+package server
+
+import "runtime"
+
+// WithEpoll serves plain TCP connections from an epoll event loop instead
+// of one goroutine per connection. A connection waiting for its next
+// request holds neither a goroutine nor a read buffer: bytes are read when
+// the kernel reports them, fed to the incremental request parser, and
+// complete requests are handled on a pool of workers, GOMAXPROCS of them
+// when workers is not positive.
+//
+// Handlers run on the workers. A long-lived response such as an event
+// stream occupies one for its duration, so the pool grows while every
+// worker is busy and shrinks back once the queue drains. TLS, h2c and
+// non-TCP connections are still served one goroutine each, as is
+// everything on systems other than Linux.
+func WithEpoll(workers int) Option {
+	return func(s *Server) {
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		s.epollWorkers = workers
+	}
+}
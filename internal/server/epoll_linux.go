@@ -0,0 +1,475 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Connections are registered one-shot, so at most one worker serves a
+	// connection at a time; the worker re-arms it once it is done.
+	epollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+	epollReadSize = 16 << 10
+	// epollWriteTimeout fails a write to a client that has stopped reading,
+	// which would otherwise hold its worker indefinitely.
+	epollWriteTimeout = 30 * time.Second
+	// epollCopyChunk is how much ReadFrom sends under one write deadline.
+	epollCopyChunk = 1 << 20
+)
+
+// epollEngine multiplexes connections over one epoll instance. A single
+// goroutine waits for events and queues ready connections for the workers,
+// which read what arrived, feed it to the connection's request.Reader and
+// serve every request that completes. Queueing never blocks, so events and
+// deadlines are still noticed while every worker is busy.
+//
+// The pool keeps size workers. When a connection is queued and none is
+// free, because handlers are streaming or have hijacked their connection,
+// an extra worker is started; extra workers exit once the queue is empty.
+type epollEngine struct {
+	s       *Server
+	epfd    int
+	wake    [2]int // pipe that interrupts EpollWait when the server closes
+	size    int
+	workers sync.WaitGroup
+	stopped chan struct{} // closed once shutdown has finished
+
+	mu     sync.Mutex
+	ready  *sync.Cond // signalled when queue grows or the engine closes
+	queue  []*epollConn
+	conns  map[int]*epollConn
+	closed bool
+	// running counts workers and busy those serving a connection.
+	running int
+	busy    int
+}
+
+type epollConn struct {
+	conn    net.Conn // what handlers write to; counts bytes with metrics
+	tcpConn *net.TCPConn
+	raw     syscall.RawConn
+	fd      int
+	// reader is nil while the connection is idle. The worker that set
+	// busy owns reader and deadline; the sweep reads them under
+	// epollEngine.mu while busy is clear.
+	reader   *request.Reader
+	deadline time.Time
+
+	// Guarded by epollEngine.mu.
+	busy    bool
+	expired bool
+}
+
+func newEpollEngine(s *Server, workers int) (*epollEngine, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create1: %w", err)
+	}
+
+	e := &epollEngine{
+		s:       s,
+		epfd:    epfd,
+		size:    workers,
+		stopped: make(chan struct{}),
+		conns:   make(map[int]*epollConn),
+	}
+	e.ready = sync.NewCond(&e.mu)
+
+	if err := syscall.Pipe2(e.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return nil, fmt.Errorf("pipe2: %w", err)
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(e.wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, e.wake[0], &ev); err != nil {
+		e.closeFDs()
+		return nil, fmt.Errorf("epoll_ctl: %w", err)
+	}
+
+	e.running = workers
+	e.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go e.worker()
+	}
+	go e.poll()
+	go func() {
+		<-s.closing
+		syscall.Write(e.wake[1], []byte{0})
+	}()
+
+	return e, nil
+}
+
+func (e *epollEngine) closeFDs() {
+	syscall.Close(e.wake[0])
+	syscall.Close(e.wake[1])
+	syscall.Close(e.epfd)
+}
+
+// add takes conn over if it is plain TCP and reports whether it did.
+func (e *epollEngine) add(conn net.Conn) bool {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || e.s.h2c {
+		return false
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	fd := -1
+	raw.Control(func(f uintptr) { fd = int(f) })
+	if fd < 0 {
+		return false
+	}
+
+	c := &epollConn{
+		conn:     conn,
+		tcpConn:  tcpConn,
+		raw:      raw,
+		fd:       fd,
+		deadline: time.Now().Add(e.s.requestTimeout()),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return false
+	}
+
+	ev := syscall.EpollEvent{Events: epollEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		return false
+	}
+	e.conns[fd] = c
+
+	if m := e.s.metrics; m != nil {
+		m.activeConnections.Inc()
+		c.conn = &countingConn{Conn: conn, m: m}
+	}
+	c.conn = &writeDeadlineConn{Conn: c.conn, timeout: epollWriteTimeout}
+
+	return true
+}
+
+func (e *epollEngine) poll() {
+	events := make([]syscall.EpollEvent, 128)
+	lastSweep := time.Now()
+
+	for {
+		n, err := syscall.EpollWait(e.epfd, events, 1000)
+		if err != nil && !errors.Is(err, syscall.EINTR) {
+			log.Printf("epoll_wait (stopping): %v", err)
+			e.shutdown()
+			return
+		}
+
+		for _, ev := range events[:max(n, 0)] {
+			fd := int(ev.Fd)
+			if fd == e.wake[0] {
+				e.shutdown()
+				return
+			}
+
+			e.mu.Lock()
+			// A busy connection is re-armed by its worker, so an event
+			// that is still queued for it can be dropped.
+			if c := e.conns[fd]; c != nil && !c.busy {
+				e.enqueue(c)
+			}
+			e.mu.Unlock()
+		}
+
+		if now := time.Now(); now.Sub(lastSweep) >= time.Second {
+			e.sweep(now)
+			lastSweep = now
+		}
+	}
+}
+
+// sweep closes idle connections whose deadline passed and queues those
+// with a request cut off midway, for a worker to answer with a 408.
+func (e *epollEngine) sweep(now time.Time) {
+	var idle []*epollConn
+
+	e.mu.Lock()
+	for _, c := range e.conns {
+		if c.busy || !now.After(c.deadline) {
+			continue
+		}
+		if c.reader == nil {
+			c.busy = true
+			idle = append(idle, c)
+			continue
+		}
+		c.expired = true
+		e.enqueue(c)
+	}
+	e.mu.Unlock()
+
+	for _, c := range idle {
+		e.close(c)
+	}
+}
+
+// enqueue marks c busy and queues it for a worker, starting another one if
+// none is free. e.mu must be held.
+func (e *epollEngine) enqueue(c *epollConn) {
+	c.busy = true
+	e.queue = append(e.queue, c)
+
+	if len(e.queue) > e.running-e.busy {
+		e.running++
+		e.workers.Add(1)
+		go e.worker()
+		return
+	}
+	e.ready.Signal()
+}
+
+// dequeue waits for a queued connection. It returns nil, ending the worker,
+// once the engine is closed and the queue drained, or straight away for
+// an extra worker when the queue is empty.
+func (e *epollEngine) dequeue() *epollConn {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for len(e.queue) == 0 {
+		if e.closed || e.running > e.size {
+			e.running--
+			return nil
+		}
+		e.ready.Wait()
+	}
+
+	c := e.queue[0]
+	e.queue[0] = nil
+	e.queue = e.queue[1:]
+	e.busy++
+	return c
+}
+
+// idle marks a worker free again after serving a connection.
+func (e *epollEngine) idle() {
+	e.mu.Lock()
+	e.busy--
+	e.mu.Unlock()
+}
+
+// shutdown closes idle connections once the server is closing and waits
+// for the workers to finish the rest.
+func (e *epollEngine) shutdown() {
+	var idle []*epollConn
+
+	e.mu.Lock()
+	e.closed = true
+	for _, c := range e.conns {
+		if !c.busy {
+			idle = append(idle, c)
+		}
+	}
+	e.ready.Broadcast()
+	e.mu.Unlock()
+
+	for _, c := range idle {
+		e.close(c)
+	}
+
+	e.workers.Wait()
+	e.closeFDs()
+	close(e.stopped)
+}
+
+// wait blocks until shutdown has finished serving every connection.
+func (e *epollEngine) wait() {
+	<-e.stopped
+}
+
+func (e *epollEngine) worker() {
+	defer e.workers.Done()
+
+	buf := make([]byte, epollReadSize)
+	for c := e.dequeue(); c != nil; c = e.dequeue() {
+		if c.expired {
+			e.expire(c)
+		} else {
+			e.serve(c, buf)
+		}
+		e.idle()
+	}
+}
+
+// serve reads what c has received and answers every request it completes.
+func (e *epollEngine) serve(c *epollConn, buf []byte) {
+	n, err := c.read(buf)
+	if n > 0 {
+		if c.reader == nil {
+			c.reader = request.NewReader(nil)
+		}
+		c.reader.Write(buf[:n])
+		if m := e.s.metrics; m != nil {
+			m.bytesIn.Add(uint64(n))
+		}
+	}
+	switch {
+	case errors.Is(err, syscall.EAGAIN):
+		err = nil
+	case err == nil && n == 0:
+		err = io.EOF
+	}
+
+	for c.reader != nil {
+		req, perr := c.reader.Next()
+		start := time.Now()
+		if perr != nil {
+			log.Printf("error reading request from %s: %v", c.conn.RemoteAddr(), perr)
+			e.s.writeParseError(c.conn, nil, perr, start)
+			e.close(c)
+			return
+		}
+		if req == nil {
+			break
+		}
+
+		keepAlive, hijacked := e.s.serveRequest(c.conn, c.tcpConn, c.reader, req, start)
+		if hijacked {
+			e.forget(c)
+			return
+		}
+		if !keepAlive {
+			e.close(c)
+			return
+		}
+		c.deadline = time.Now().Add(e.s.keepAliveTimeout())
+	}
+
+	if err != nil {
+		if c.reader != nil {
+			err = c.reader.InputError(err)
+		}
+		if !errors.Is(err, io.EOF) {
+			log.Printf("error reading request from %s: %v", c.conn.RemoteAddr(), err)
+			e.s.writeParseError(c.conn, nil, err, time.Now())
+		}
+		e.close(c)
+		return
+	}
+
+	if c.reader != nil && !c.reader.Pending() {
+		c.reader.Release()
+		c.reader = nil
+	}
+
+	if !e.rearm(c) {
+		e.close(c)
+	}
+}
+
+// expire answers a connection whose request was cut off by its deadline.
+func (e *epollEngine) expire(c *epollConn) {
+	err := c.reader.InputError(os.ErrDeadlineExceeded)
+
+	log.Printf("error reading request from %s: %v", c.conn.RemoteAddr(), err)
+	e.s.writeParseError(c.conn, nil, err, time.Now())
+	e.close(c)
+}
+
+// read makes one non-blocking read from the socket.
+func (c *epollConn) read(p []byte) (n int, err error) {
+	cerr := c.raw.Read(func(fd uintptr) bool {
+		for {
+			n, err = syscall.Read(int(fd), p)
+			if err != syscall.EINTR {
+				return true
+			}
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (e *epollEngine) rearm(c *epollConn) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return false
+	}
+
+	c.busy = false
+	ev := syscall.EpollEvent{Events: epollEvents, Fd: int32(c.fd)}
+	return syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_MOD, c.fd, &ev) == nil
+}
+
+func (e *epollEngine) close(c *epollConn) {
+	e.forget(c)
+	c.conn.Close()
+}
+
+// forget removes c from the engine without closing it, which must happen
+// before the descriptor can be reused.
+func (e *epollEngine) forget(c *epollConn) {
+	e.mu.Lock()
+	delete(e.conns, c.fd)
+	syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	e.mu.Unlock()
+
+	if c.reader != nil {
+		c.reader.Release()
+		c.reader = nil
+	}
+	if m := e.s.metrics; m != nil {
+		m.activeConnections.Dec()
+	}
+	e.s.releaseConn()
+}
+
+// writeDeadlineConn gives every write its own deadline, so a stalled client
+// fails the write without limiting how long a response may stream.
+type writeDeadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeDeadlineConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// ReadFrom copies in chunks, each under a fresh deadline. io.CopyN keeps
+// files on the sendfile path.
+func (c *writeDeadlineConn) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		n, err := io.CopyN(c.Conn, r, epollCopyChunk)
+		total += n
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (c *writeDeadlineConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+//go:build linux
+
+package server
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerEpoll(t *testing.T) {
+	s, err := ServeAddr("tcp", "127.0.0.1:0", describeRequest, WithEpoll(2))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NotNil(t, s.epoll)
+
+	// Test: Pipelined requests share a connection until Connection: close
+	conn := dialAndSend(t, s,
+		"GET /one HTTP/1.1\r\nHost: x\r\n\r\n"+
+			"GET /two HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	out := readAll(t, conn)
+	conn.Close()
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "/one host=x")
+	assert.True(t, strings.HasSuffix(out, "/two connection=close,host=x "))
+
+	// Test: A request written a byte at a time is parsed across wakeups
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	raw := "POST /bytes HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello"
+	for i := 0; i < len(raw); i++ {
+		_, err := conn.Write([]byte{raw[i]})
+		require.NoError(t, err)
+	}
+	resp, err := response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "/bytes content-length=5,host=x hello", string(resp.Body))
+
+	// Test: A chunked body split across writes keeps the connection usable
+	for _, part := range []string{
+		"POST /chunks HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nab",
+		"c\r\n2\r\nde\r\n0\r\n",
+		"X-Sum: 5\r\n\r\n",
+	} {
+		_, err := io.WriteString(conn, part)
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err = response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "/chunks host=x,trailer:x-sum=5,transfer-encoding=chunked abcde", string(resp.Body))
+	conn.Close()
+
+	// Test: A malformed request gets 400 and the connection is closed
+	conn = dialAndSend(t, s, "GET  / HTTP/1.1\r\nHost: x\r\n\r\n")
+	out = readAll(t, conn)
+	conn.Close()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+
+	// Test: A client that stops sending mid-request gets 400
+	conn = dialAndSend(t, s, "GET /partial HTTP/1.1\r\nHo")
+	conn.(*net.TCPConn).CloseWrite()
+	out = readAll(t, conn)
+	conn.Close()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+
+	// Test: Idle connections beyond the worker count are all served
+	var idle []net.Conn
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		idle = append(idle, conn)
+	}
+	for i := len(idle) - 1; i >= 0; i-- {
+		_, err := fmt.Fprintf(idle[i], "GET /idle-%d HTTP/1.1\r\nHost: x\r\n\r\n", i)
+		require.NoError(t, err)
+		resp, err := response.ResponseFromReader(idle[i])
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("/idle-%d host=x ", i), string(resp.Body))
+	}
+}
+
+func TestServerEpollConnections(t *testing.T) {
+	// Test: A hijacked connection leaves the engine with its unread bytes
+	hijacked := make(chan []byte, 1)
+	s, err := ServeAddr("tcp", "127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		hijacked <- buffered
+
+		go func() {
+			defer conn.Close()
+			io.WriteString(conn, "raw:")
+			io.Copy(conn, conn)
+		}()
+	}, WithEpoll(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn := dialAndSend(t, s, "GET /hijack HTTP/1.1\r\nHost: x\r\n\r\nextra")
+	defer conn.Close()
+	assert.Equal(t, "extra", string(<-hijacked))
+	_, err = io.WriteString(conn, "ping")
+	require.NoError(t, err)
+	conn.(*net.TCPConn).CloseWrite()
+	assert.Equal(t, "raw:ping", readAll(t, conn))
+
+	// Test: Closed connections give their slot back
+	limited, err := ServeAddr("tcp", "127.0.0.1:0", echoTarget, WithEpoll(1), WithMaxConns(1))
+	require.NoError(t, err)
+	defer limited.Close()
+	for i := 0; i < 3; i++ {
+		conn := dialAndSend(t, limited, "GET /limited HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		assert.True(t, strings.HasSuffix(readAll(t, conn), "/limited"))
+		conn.Close()
+	}
+
+	// Test: Closing the server closes idle connections
+	closing, err := ServeAddr("tcp", "127.0.0.1:0", echoTarget, WithEpoll(1))
+	require.NoError(t, err)
+	conn = dialAndSend(t, closing, "GET /first HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer conn.Close()
+	_, err = response.ResponseFromReader(conn)
+	require.NoError(t, err)
+
+	require.NoError(t, closing.Close())
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.Empty(t, readAll(t, conn))
+}
+
+func TestServerEpollTimeouts(t *testing.T) {
+	testServerTimeouts(t, WithEpoll(1))
+
+	// Test: Idle connections still expire while every worker is busy
+	release := make(chan struct{})
+	s, err := ServeAddr("tcp", "127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/block" {
+			<-release
+		}
+		echoTarget(w, req)
+	}, WithEpoll(1), withTimeouts(200*time.Millisecond))
+	require.NoError(t, err)
+	defer func() {
+		close(release)
+		s.Close()
+	}()
+
+	idle := dialAndSend(t, s, "GET /first HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer idle.Close()
+	_, err = response.ResponseFromReader(idle)
+	require.NoError(t, err)
+
+	blocked := dialAndSend(t, s, "GET /block HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer blocked.Close()
+	for i := 0; i < 4; i++ {
+		conn := dialAndSend(t, s, "GET /queued HTTP/1.1\r\nHost: x\r\n\r\n")
+		defer conn.Close()
+	}
+
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.Empty(t, readAll(t, idle))
+}
+
+func TestServerEpollBlockedWorkers(t *testing.T) {
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	s, err := ServeAddr("tcp", "127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/block" {
+			<-release
+			defer close(returned)
+		}
+		echoTarget(w, req)
+	}, WithEpoll(1))
+	require.NoError(t, err)
+
+	// Test: Handlers holding every worker do not stall other connections
+	blocked := dialAndSend(t, s, "GET /block HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer blocked.Close()
+	for i := 0; i < 3; i++ {
+		conn := dialAndSend(t, s, "GET /next HTTP/1.1\r\nHost: x\r\n\r\n")
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := response.ResponseFromReader(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "/next", string(resp.Body))
+	}
+
+	// Test: Close waits for a handler still being served
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a handler was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+	select {
+	case <-returned:
+	default:
+		t.Fatal("Close returned before the handler")
+	}
+}
+
+// BenchmarkEngines runs keep-alive round trips while idleConns further
+// connections sit open, and reports the heap each idle connection costs.
+func BenchmarkEngines(b *testing.B) {
+	const idleConns = 200
+	raw := "GET /bench HTTP/1.1\r\nHost: x\r\nUser-Agent: bench\r\nAccept: */*\r\n\r\n"
+
+	for _, engine := range []struct {
+		name string
+		opts []Option
+	}{
+		{"goroutines", nil},
+		{"epoll", []Option{WithEpoll(0)}},
+	} {
+		b.Run(engine.name, func(b *testing.B) {
+			s, err := ServeAddr("tcp", "127.0.0.1:0", echoTarget, engine.opts...)
+			require.NoError(b, err)
+			defer s.Close()
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			var idle []net.Conn
+			for i := 0; i < idleConns; i++ {
+				conn, err := net.Dial("tcp", s.Addr().String())
+				require.NoError(b, err)
+				defer conn.Close()
+				// A served request makes every connection idle in the
+				// same state: between requests on keep-alive.
+				io.WriteString(conn, raw)
+				_, err = response.ResponseFromReader(conn)
+				require.NoError(b, err)
+				idle = append(idle, conn)
+			}
+
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			inuse := int64(after.HeapInuse+after.StackInuse) - int64(before.HeapInuse+before.StackInuse)
+
+			var wg sync.WaitGroup
+			work := make(chan struct{})
+			for _, conn := range idle[:8] {
+				wg.Add(1)
+				go func(conn net.Conn) {
+					defer wg.Done()
+					for range work {
+						if _, err := io.WriteString(conn, raw); err != nil {
+							b.Error(err)
+							return
+						}
+						if _, err := response.ResponseFromReader(conn); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}(conn)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				work <- struct{}{}
+			}
+			close(work)
+			wg.Wait()
+
+			// Reported last, as ResetTimer drops extra metrics.
+			b.ReportMetric(float64(inuse)/idleConns, "B/idle-conn")
+		})
+	}
+}
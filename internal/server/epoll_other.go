@@ -0,0 +1,20 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+type epollEngine struct{}
+
+func newEpollEngine(*Server, int) (*epollEngine, error) {
+	return nil, errors.New("epoll is only available on Linux")
+}
+
+func (e *epollEngine) add(net.Conn) bool {
+	return false
+}
+
+func (e *epollEngine) wait() {}
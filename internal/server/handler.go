@@ -1,36 +1,73 @@
 package server
 
 import (
+	"errors"
+	"httpfromtcp/internal/headers"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"io"
-	"log"
 )
 
 type HandlerError struct {
 	StatusCode response.StatusCode
 	Message    string
+	// Headers are added to the default error response headers, and may be nil.
+	Headers headers.Headers
 }
 
-type Handler func(w *response.Writer, req *request.Request)
+// parseErrorResponse maps an error from request.RequestFromReader to the
+// status code and client-facing message sent back. Anything not listed,
+// such as malformed request lines, bad headers and framing errors, is a 400.
+// The message never includes the error text, which may echo
+// attacker-controlled input.
+func parseErrorResponse(err error) *HandlerError {
+	status := response.BadRequest
 
-func WriteErrorResponse(w io.Writer, err *HandlerError) {
-	if err == nil {
-		return
+	switch {
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		status = response.HTTPVersionNotSupported
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		status = response.RequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		status = response.PayloadTooLarge
+	case errors.Is(err, request.ErrTimeout):
+		status = response.RequestTimeout
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		status = response.NotImplemented
 	}
 
-	if writeErr := response.WriteStatusLine(w, err.StatusCode); writeErr != nil {
-		log.Fatalf("status line write error: %v", writeErr)
-		response.WriteStatusLine(w, response.InternalError)
-		return
+	return &HandlerError{
+		StatusCode: status,
+		Message:    response.StatusText(status) + "\n",
+	}
+}
+
+type Handler func(w *response.Writer, req *request.Request)
+
+// WriteErrorResponse writes err as a complete response that closes the
+// connection. Invalid headers are reported before anything is written; a
+// failed write leaves a partial response, so the caller should close the
+// connection either way once an error is returned.
+func WriteErrorResponse(w io.Writer, err *HandlerError) error {
+	if err == nil {
+		return nil
 	}
 
 	headers := response.GetDefaultHeaders(len(err.Message))
-	if writeErr := response.WriteHeaders(w, headers); writeErr != nil {
-		log.Fatalf("headers write error: %v", writeErr)
-		response.WriteStatusLine(w, response.InternalError)
-		return
+	headers.Override("Connection", "close")
+	for key, value := range err.Headers {
+		headers.Override(key, value)
+	}
+	if verr := headers.Validate(); verr != nil {
+		return verr
 	}
 
-	io.WriteString(w, err.Message)
+	if werr := response.WriteStatusLine(w, err.StatusCode); werr != nil {
+		return werr
+	}
+	if werr := response.WriteHeaders(w, headers); werr != nil {
+		return werr
+	}
+	_, werr := io.WriteString(w, err.Message)
+	return werr
 }
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrorResponse(t *testing.T) {
+	cases := []struct {
+		err    error
+		status response.StatusCode
+	}{
+		{fmt.Errorf("%w: %q", request.ErrMalformedRequestLine, "<script>"), response.BadRequest},
+		{fmt.Errorf("%w: HTTP/3.0", request.ErrUnsupportedVersion), response.HTTPVersionNotSupported},
+		{fmt.Errorf("%w: %q", headers.ErrMalformedHeader, "Host"), response.BadRequest},
+		{request.ErrHeaderTooLarge, response.RequestHeaderFieldsTooLarge},
+		{request.ErrBodyTooLarge, response.PayloadTooLarge},
+		{request.ErrTimeout, response.RequestTimeout},
+		{request.ErrUnsupportedTransferEncoding, response.NotImplemented},
+		{request.ErrConflictingContentLength, response.BadRequest},
+		{request.ErrInvalidTransferEncoding, response.BadRequest},
+		{errors.New("something unexpected"), response.BadRequest},
+	}
+
+	for _, c := range cases {
+		herr := parseErrorResponse(c.err)
+		assert.Equal(t, c.status, herr.StatusCode, "error: %v", c.err)
+		assert.NotContains(t, herr.Message, "<script>")
+		assert.Equal(t, response.StatusText(c.status)+"\n", herr.Message)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestWriteErrorResponse(t *testing.T) {
+	// Test: A complete response that closes the connection
+	var buf bytes.Buffer
+	herr := &HandlerError{StatusCode: response.BadRequest, Message: "bad\n", Headers: headers.Headers{"x-reason": "test"}}
+	require.NoError(t, WriteErrorResponse(&buf, herr))
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.Contains(t, out, "x-reason: test\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nbad\n"))
+
+	// Test: An invalid header is reported before anything is written
+	buf.Reset()
+	herr.Headers = headers.Headers{"x-reason": "a\r\nx-injected: 1"}
+	require.ErrorIs(t, WriteErrorResponse(&buf, herr), headers.ErrInvalidFieldValue)
+	assert.Zero(t, buf.Len())
+
+	// Test: A failed write is returned rather than ending the process
+	herr.Headers = nil
+	assert.Error(t, WriteErrorResponse(failingWriter{}, herr))
+}
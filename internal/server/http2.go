@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// WithH2C serves HTTP/2 over cleartext connections, both to clients that
+// open with the HTTP/2 preface and to HTTP/1.1 requests carrying
+// "Upgrade: h2c". TLS connections use HTTP/2 whenever ALPN selects "h2",
+// with or without this option.
+func WithH2C() Option {
+	return func(s *Server) {
+		s.h2c = true
+	}
+}
+
+// sniffPreface reads from conn until the bytes either stop matching the
+// HTTP/2 client preface or complete it. It returns the bytes read, which
+// the caller must replay.
+func sniffPreface(conn net.Conn) ([]byte, bool, error) {
+	buf := make([]byte, len(http2.ClientPreface))
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if !strings.HasPrefix(http2.ClientPreface, string(buf[:n])) {
+			return buf[:n], false, nil
+		}
+		if err != nil {
+			return buf[:n], false, err
+		}
+	}
+	return buf, true, nil
+}
+
+const switchToH2C = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"
+
+// serveHTTP2 runs conn as an HTTP/2 connection until it closes. Each stream
+// goes through the same request limits, access log and metrics as an
+// HTTP/1.x request.
+func (s *Server) serveHTTP2(conn, netConn net.Conn, opts http2.ServeConnOpts) {
+	conn.SetReadDeadline(time.Time{})
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	srv := &http2.Server{
+		Handler: func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			req.RemoteAddr = conn.RemoteAddr().String()
+			req.TLS = tlsState
+
+			if !s.acquireRequest() {
+				writeHandlerError(w, s.unavailableError())
+				s.logAccess(conn, req, response.ServiceUnavailable, w.BytesWritten, start)
+				s.metrics.observeRequest(req.RequestLine.Method, response.ServiceUnavailable, start)
+				return
+			}
+			s.Handler(w, req)
+			s.releaseRequest()
+
+			s.logAccess(conn, req, w.StatusCode, w.BytesWritten, start)
+			s.metrics.observeRequest(req.RequestLine.Method, w.StatusCode, start)
+		},
+		IdleTimeout: s.keepAliveTimeout(),
+		Shutdown:    s.closing,
+	}
+
+	if err := srv.ServeConn(conn, opts); err != nil {
+		log.Printf("http2 connection from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// upgradeH2C answers an "Upgrade: h2c" request with 101 and continues the
+// connection as HTTP/2, serving req as its first stream.
+func (s *Server) upgradeH2C(conn, netConn net.Conn, reader *request.Reader, req *request.Request, settings []byte) {
+	if _, err := io.WriteString(conn, switchToH2C); err != nil {
+		return
+	}
+
+	buffered := bytes.Clone(reader.Buffered())
+	s.serveHTTP2(conn, netConn, http2.ServeConnOpts{
+		Reader:   io.MultiReader(bytes.NewReader(buffered), conn),
+		Upgrade:  req,
+		Settings: settings,
+	})
+}
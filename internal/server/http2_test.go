@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"httpfromtcp/internal/http2"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// h2Request starts HTTP/2 on conn and returns the status and body of
+// stream 1. Upgraded connections already have a request on stream 1, so
+// sendHeaders is false for them.
+func h2Request(t *testing.T, conn net.Conn, r io.Reader, sendHeaders bool) (string, string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	fr := http2.NewFramer(conn, r)
+	_, err := io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	require.NoError(t, fr.WriteSettings())
+
+	if sendHeaders {
+		block := http2.NewEncoder().Encode(nil, []http2.HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "localhost"},
+		})
+		require.NoError(t, fr.WriteHeaders(1, block, true, 16384))
+	}
+	require.NoError(t, fr.Flush())
+
+	dec := http2.NewDecoder()
+	var status, body string
+	for {
+		h, payload, err := fr.ReadFrame()
+		require.NoError(t, err)
+		if h.StreamID != 1 {
+			continue
+		}
+
+		switch h.Type {
+		case http2.FrameHeaders:
+			fields, err := dec.Decode(payload)
+			require.NoError(t, err)
+			status = fields[0].Value
+		case http2.FrameData:
+			body += string(payload)
+		}
+		if h.Has(http2.FlagEndStream) {
+			return status, body
+		}
+	}
+}
+
+func TestServerHTTP2(t *testing.T) {
+	// Test: TLS clients negotiate h2 with ALPN
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certFile, keyFile, "localhost")
+
+	s, err := ServeTLSFiles(0, tlsInfo, certFile, keyFile)
+	require.NoError(t, err)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("https://localhost:" + strconv.Itoa(s.Port) + "/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "localhost h2", string(body))
+
+	// Test: Cleartext clients with prior knowledge get HTTP/2
+	s, err = ServeAddr("tcp", "127.0.0.1:0", tlsInfo, WithH2C())
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	status, text := h2Request(t, conn, conn, true)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "plain", text)
+
+	// Test: HTTP/1.1 clients switch with Upgrade: h2c
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABk\r\n\r\n")
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", line)
+	for line != "\r\n" {
+		line, err = br.ReadString('\n')
+		require.NoError(t, err)
+	}
+	status, text = h2Request(t, conn, br, false)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "plain", text)
+
+	// Test: HTTP/1.1 still works alongside h2c
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Without WithH2C the preface is an HTTP/1.x request for version 2.0
+	plain, err := ServeAddr("tcp", "127.0.0.1:0", tlsInfo)
+	require.NoError(t, err)
+	defer plain.Close()
+
+	conn, err = net.Dial("tcp", plain.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	line, err = bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 505 HTTP Version Not Supported\r\n", line)
+}
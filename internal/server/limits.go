@@ -0,0 +1,197 @@
+package server
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRetryAfter = time.Second
+	lingerTimeout     = 500 * time.Millisecond
+	lingerMaxBytes    = 64 << 10
+	// maxRejecting caps the connections being answered with 503 at once.
+	// Past it, excess connections are closed without a response.
+	maxRejecting = 64
+)
+
+// LimitMode selects what the server does once a concurrency limit is reached.
+type LimitMode string
+
+const (
+	// LimitBlock stops accepting connections, or delays running the handler,
+	// until a slot frees up. Excess clients wait in the kernel backlog.
+	LimitBlock LimitMode = "block"
+	// LimitReject answers excess connections and requests immediately with
+	// 503 Service Unavailable and a Retry-After header.
+	LimitReject LimitMode = "reject"
+)
+
+// LimitStats counts how often the server hit its concurrency limits.
+type LimitStats struct {
+	ConnLimitHits    atomic.Int64
+	RequestLimitHits atomic.Int64
+}
+
+// Option configures a Server before it starts accepting connections.
+type Option func(*Server)
+
+// WithMaxConns caps the number of connections served at once.
+func WithMaxConns(n int) Option {
+	return func(s *Server) {
+		if n > 0 {
+			s.connSlots = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithMaxRequests caps the number of handlers running at once across all
+// connections.
+func WithMaxRequests(n int) Option {
+	return func(s *Server) {
+		if n > 0 {
+			s.requestSlots = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithLimitMode sets how the limits above are enforced. The default is
+// LimitBlock.
+func WithLimitMode(mode LimitMode) Option {
+	return func(s *Server) {
+		s.limitMode = mode
+	}
+}
+
+// WithRetryAfter sets the Retry-After value sent with 503 responses in
+// LimitReject mode.
+func WithRetryAfter(d time.Duration) Option {
+	return func(s *Server) {
+		s.retryAfter = d
+	}
+}
+
+func (s *Server) acquireConnBlocking() bool {
+	if s.connSlots == nil {
+		return true
+	}
+
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+		s.Stats.ConnLimitHits.Add(1)
+	}
+
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	case <-s.closing:
+		return false
+	}
+}
+
+func (s *Server) tryAcquireConn() bool {
+	if s.connSlots == nil {
+		return true
+	}
+
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseConn() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
+
+// acquireRequest reserves a handler slot. It only fails in LimitReject mode.
+func (s *Server) acquireRequest() bool {
+	if s.requestSlots == nil {
+		return true
+	}
+
+	select {
+	case s.requestSlots <- struct{}{}:
+		return true
+	default:
+		s.Stats.RequestLimitHits.Add(1)
+	}
+
+	if s.limitMode == LimitReject {
+		return false
+	}
+
+	s.requestSlots <- struct{}{}
+	return true
+}
+
+func (s *Server) releaseRequest() {
+	if s.requestSlots != nil {
+		<-s.requestSlots
+	}
+}
+
+// unavailableError is the 503 sent when a limit is hit in LimitReject mode.
+func (s *Server) unavailableError() *HandlerError {
+	seconds := int(s.retryAfter.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	status := response.ServiceUnavailable
+	return &HandlerError{
+		StatusCode: status,
+		Message:    response.StatusText(status) + "\n",
+		Headers:    headers.Headers{"retry-after": strconv.Itoa(seconds)},
+	}
+}
+
+// rejectAsync answers an excess connection with 503 in the background, or
+// closes it outright if too many are already being answered.
+func (s *Server) rejectAsync(conn net.Conn) {
+	select {
+	case s.rejectSlots <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+
+	go func() {
+		defer func() { <-s.rejectSlots }()
+		s.reject(conn)
+	}()
+}
+
+// reject answers conn with 503 and closes it, returning the body size sent.
+// It gives up after lingerTimeout on a client that does not keep up.
+func (s *Server) reject(conn net.Conn) int64 {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(lingerTimeout))
+
+	herr := s.unavailableError()
+	if err := WriteErrorResponse(conn, herr); err != nil {
+		log.Printf("error writing %d response to %s: %v", herr.StatusCode, conn.RemoteAddr(), err)
+		return 0
+	}
+
+	// Closing with unread request bytes makes the kernel send a reset that
+	// can discard the 503 before the client reads it, so half-close and
+	// drain briefly first.
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		io.Copy(io.Discard, io.LimitReader(conn, lingerMaxBytes))
+	}
+
+	return int64(len(herr.Message))
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bufio"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dialAndSend(t *testing.T, s *Server, raw string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, raw)
+	require.NoError(t, err)
+	return conn
+}
+
+func readStatusLine(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return line
+}
+
+func TestConnLimitReject(t *testing.T) {
+	s, err := ServeAddr("tcp", "127.0.0.1:0", echoTarget,
+		WithMaxConns(1), WithLimitMode(LimitReject), WithRetryAfter(3*time.Second))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: First connection is served and held open by keep-alive
+	first := dialAndSend(t, s, "GET /a HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer first.Close()
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", readStatusLine(t, first))
+
+	// Test: Second connection is answered with 503 and Retry-After
+	second := dialAndSend(t, s, "GET /b HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer second.Close()
+	out := readAll(t, second)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.Contains(t, out, "retry-after: 3\r\n")
+	assert.Equal(t, int64(1), s.Stats.ConnLimitHits.Load())
+
+	// Test: With every rejecter busy, excess connections are just closed
+	for i := 0; i < cap(s.rejectSlots); i++ {
+		s.rejectSlots <- struct{}{}
+	}
+	third, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer third.Close()
+	assert.Empty(t, readAll(t, third))
+	assert.Equal(t, int64(2), s.Stats.ConnLimitHits.Load())
+}
+
+func TestConnLimitBlock(t *testing.T) {
+	s, err := ServeAddr("tcp", "127.0.0.1:0", echoTarget, WithMaxConns(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	first := dialAndSend(t, s, "GET /a HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", readStatusLine(t, first))
+
+	// Test: Second connection waits while the first is open
+	second := dialAndSend(t, s, "GET /b HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = second.Read(make([]byte, 1))
+	require.Error(t, err)
+	assert.Equal(t, int64(1), s.Stats.ConnLimitHits.Load())
+
+	// Test: Closing the first connection lets the second through
+	first.Close()
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", readStatusLine(t, second))
+}
+
+func TestRequestLimitReject(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		echoTarget(w, req)
+	}
+
+	s, err := ServeAddr("tcp", "127.0.0.1:0", handler, WithMaxRequests(1), WithLimitMode(LimitReject))
+	require.NoError(t, err)
+	defer s.Close()
+
+	slow := dialAndSend(t, s, "GET /slow HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	defer slow.Close()
+	<-started
+
+	// Test: A request arriving while the handler slot is busy gets 503
+	fast := dialAndSend(t, s, "GET /fast HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer fast.Close()
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable\r\n", readStatusLine(t, fast))
+	assert.Equal(t, int64(1), s.Stats.RequestLimitHits.Load())
+
+	close(release)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", readStatusLine(t, slow))
+}
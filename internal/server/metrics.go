@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Metrics instruments a Server. Create one with NewMetrics, pass it to
+// WithMetrics, and mount Handler on a route to expose it.
+type Metrics struct {
+	Registry *metrics.Registry
+
+	requests          *metrics.CounterVec
+	duration          *metrics.Histogram
+	activeConnections *metrics.Gauge
+	bytesIn           *metrics.Counter
+	bytesOut          *metrics.Counter
+	parseErrors       *metrics.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry:          metrics.NewRegistry(),
+		requests:          metrics.NewCounterVec("method", "status"),
+		duration:          metrics.NewHistogram(metrics.DefaultBuckets),
+		activeConnections: &metrics.Gauge{},
+		bytesIn:           &metrics.Counter{},
+		bytesOut:          &metrics.Counter{},
+		parseErrors:       metrics.NewCounterVec("kind"),
+	}
+
+	m.Registry.Register("httpfromtcp_requests_total", "Requests served, by method and status code.", m.requests)
+	m.Registry.Register("httpfromtcp_request_duration_seconds", "Time from reading a request to finishing its response.", m.duration)
+	m.Registry.Register("httpfromtcp_active_connections", "Connections currently open.", m.activeConnections)
+	m.Registry.Register("httpfromtcp_received_bytes_total", "Bytes read from client connections.", m.bytesIn)
+	m.Registry.Register("httpfromtcp_sent_bytes_total", "Bytes written to client connections.", m.bytesOut)
+	m.Registry.Register("httpfromtcp_parse_errors_total", "Requests rejected before reaching a handler, by kind.", m.parseErrors)
+
+	return m
+}
+
+// WithMetrics records server activity into m.
+func WithMetrics(m *Metrics) Option {
+	return func(s *Server) {
+		s.metrics = m
+	}
+}
+
+// Handler serves the metrics in the Prometheus text exposition format.
+func (m *Metrics) Handler() Handler {
+	return func(w *response.Writer, _ *request.Request) {
+		var buf bytes.Buffer
+		if err := m.Registry.WriteText(&buf); err != nil {
+			w.WriteStatusLine(response.InternalError)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+			w.WriteBody(nil)
+			return
+		}
+
+		h := response.GetDefaultHeaders(buf.Len())
+		h.Override("Content-Type", metrics.ContentType)
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody(buf.Bytes())
+	}
+}
+
+// knownMethods bounds the method label so clients cannot create unlimited
+// series by sending made-up methods.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+// The observe methods are no-ops on a nil *Metrics, so the server can call
+// them unconditionally.
+func (m *Metrics) observeRequest(method string, status response.StatusCode, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	m.requests.With(method, strconv.Itoa(int(status))).Inc()
+	m.duration.Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeParseError(err error) {
+	if m == nil {
+		return
+	}
+
+	m.parseErrors.With(parseErrorKind(err)).Inc()
+}
+
+// parseErrorKind classifies errors from the request parser into a small
+// fixed set of label values.
+func parseErrorKind(err error) string {
+	switch {
+	case errors.Is(err, request.ErrMalformedRequestLine):
+		return "malformed_request_line"
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return "unsupported_version"
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		return "header_too_large"
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return "body_too_large"
+	case errors.Is(err, request.ErrTimeout):
+		return "timeout"
+	case errors.Is(err, request.ErrIncompleteRequest):
+		return "incomplete"
+	case errors.Is(err, request.ErrMissingHost), errors.Is(err, request.ErrMultipleHost):
+		return "bad_host"
+	case errors.Is(err, headers.ErrMalformedHeader),
+		errors.Is(err, headers.ErrInvalidFieldName),
+		errors.Is(err, headers.ErrInvalidFieldValue),
+		errors.Is(err, headers.ErrWhitespaceBeforeColon),
+		errors.Is(err, headers.ErrObsFold):
+		return "bad_header"
+	case errors.Is(err, request.ErrInvalidContentLength),
+		errors.Is(err, request.ErrConflictingContentLength),
+		errors.Is(err, request.ErrContentLengthWithTransferEncoding),
+		errors.Is(err, request.ErrInvalidTransferEncoding),
+		errors.Is(err, request.ErrUnsupportedTransferEncoding),
+		errors.Is(err, request.ErrChunkedNotFinal),
+		errors.Is(err, request.ErrInvalidChunk),
+		errors.Is(err, request.ErrWhitespaceAfterStartLine):
+		return "framing"
+	default:
+		return "other"
+	}
+}
+
+// countingConn counts bytes moved over a connection.
+type countingConn struct {
+	net.Conn
+	m *Metrics
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.m.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.m.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+// ReadFrom lets response writers keep using sendfile when metrics are on.
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.Conn, r)
+	c.m.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerMetrics(t *testing.T) {
+	m := NewMetrics()
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/metrics" {
+			m.Handler()(w, req)
+			return
+		}
+		echoTarget(w, req)
+	}
+
+	s, err := ServeAddr("tcp", "127.0.0.1:0", handler, WithMetrics(m))
+	require.NoError(t, err)
+	defer s.Close()
+
+	send := func(raw string) string {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		go io.WriteString(conn, raw)
+		return readAll(t, conn)
+	}
+
+	send("GET /a HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	send("BREW /pot HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	send("GET / HTTP/9.0\r\nHost: x\r\n\r\n")
+	send("GET / HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n")
+	send("GET / HTTP/1.1\r\nHost: x\r\nX-Bad: a\x00b\r\n\r\n")
+
+	// Test: Scrape reports requests, errors, connections and bytes
+	out := send("GET /metrics HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "content-type: text/plain; version=0.0.4; charset=utf-8\r\n")
+	assert.Contains(t, out, `httpfromtcp_requests_total{method="GET",status="200"} 1`)
+	assert.Contains(t, out, `httpfromtcp_requests_total{method="OTHER",status="200"} 1`)
+	assert.Contains(t, out, `httpfromtcp_parse_errors_total{kind="framing"} 1`)
+	assert.Contains(t, out, `httpfromtcp_parse_errors_total{kind="unsupported_version"} 1`)
+	assert.Contains(t, out, `httpfromtcp_parse_errors_total{kind="bad_header"} 1`)
+	assert.Contains(t, out, "httpfromtcp_request_duration_seconds_count 2\n")
+	assert.Contains(t, out, "httpfromtcp_active_connections 1\n")
+	assert.NotContains(t, out, "httpfromtcp_received_bytes_total 0\n")
+	assert.NotContains(t, out, "httpfromtcp_sent_bytes_total 0\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+}
@@ -0,0 +1,490 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// bufferBeforeChunking is how much body a net/http handler may write before
+// its response is committed: with chunked encoding, or with the declared
+// Content-Length. Smaller responses are sent with a Content-Length, as
+// net/http does.
+const bufferBeforeChunking = 4096
+
+// FromHTTPHandler runs a net/http handler, or middleware chain, as a
+// Handler. Responses are buffered until the handler returns, writes more
+// than a few KiB or flushes, and are then streamed, with chunked encoding
+// unless a Content-Length was declared. Writes past a declared length fail
+// with http.ErrContentLength. Trailers are sent when declared in the
+// Trailer header, or set with http.TrailerPrefix before the body is
+// committed. The http.ResponseWriter also implements http.Flusher and
+// http.Hijacker.
+func FromHTTPHandler(h http.Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		httpReq, err := newHTTPRequest(req)
+		if err != nil {
+			writeHandlerError(w, &HandlerError{
+				StatusCode: response.BadRequest,
+				Message:    response.StatusText(response.BadRequest) + "\n",
+			})
+			return
+		}
+
+		rw := &httpResponseWriter{
+			w:      w,
+			header: make(http.Header),
+			head:   req.RequestLine.Method == "HEAD",
+		}
+		h.ServeHTTP(rw, httpReq)
+
+		if w.Hijacked() {
+			return
+		}
+		if err := rw.finish(); err != nil {
+			log.Printf("net/http handler for %s: %v", req.RequestLine.RequestTarget, err)
+		}
+	}
+}
+
+// newHTTPRequest converts a parsed request to its net/http equivalent, as
+// http.ReadRequest would have produced it.
+func newHTTPRequest(req *request.Request) (*http.Request, error) {
+	target := req.RequestLine.RequestTarget
+
+	var (
+		u   *url.URL
+		err error
+	)
+	switch {
+	case req.RequestLine.Method == "CONNECT" && !strings.HasPrefix(target, "/"):
+		u = &url.URL{Host: target}
+	case target == "*":
+		u = &url.URL{Path: "*"}
+	default:
+		u, err = url.ParseRequestURI(target)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	major, minor, ok := http.ParseHTTPVersion("HTTP/" + req.RequestLine.HttpVersion)
+	if !ok {
+		return nil, fmt.Errorf("invalid HTTP version %q", req.RequestLine.HttpVersion)
+	}
+
+	header := make(http.Header, len(req.Headers))
+	for key, value := range req.Headers {
+		if key == "host" {
+			continue
+		}
+		header[http.CanonicalHeaderKey(key)] = []string{value}
+	}
+
+	host := req.Headers.Get("host")
+	if host == "" {
+		host = u.Host
+	}
+
+	var trailer http.Header
+	if len(req.Trailers) > 0 {
+		trailer = make(http.Header, len(req.Trailers))
+		for key, value := range req.Trailers {
+			trailer[http.CanonicalHeaderKey(key)] = []string{value}
+		}
+	}
+
+	var body io.ReadCloser = http.NoBody
+	if req.ContentLength() != 0 {
+		body = io.NopCloser(req.BodyReader())
+	}
+
+	httpReq := &http.Request{
+		Method:        req.RequestLine.Method,
+		URL:           u,
+		Proto:         "HTTP/" + req.RequestLine.HttpVersion,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		Body:          body,
+		ContentLength: int64(req.ContentLength()),
+		Host:          host,
+		RemoteAddr:    req.RemoteAddr,
+		RequestURI:    target,
+		TLS:           req.TLS,
+		Trailer:       trailer,
+		Close:         !req.KeepAlive(),
+	}
+	return httpReq, nil
+}
+
+// httpResponseWriter implements http.ResponseWriter on top of a Writer.
+type httpResponseWriter struct {
+	w      *response.Writer
+	header http.Header
+	head   bool
+
+	status    int
+	committed bool
+	chunked   bool
+	// fixed means the headers went out with the declared Content-Length.
+	fixed   bool
+	buf     []byte
+	written int64
+	// trailerNames are the trailers announced when the headers were sent.
+	trailerNames []string
+}
+
+func (rw *httpResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *httpResponseWriter) WriteHeader(code int) {
+	// Informational responses are not relayed; the final status follows.
+	if rw.status != 0 || code < 200 {
+		return
+	}
+	rw.status = code
+}
+
+func (rw *httpResponseWriter) Write(p []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	if !responseHasBody("GET", rw.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+
+	if rw.chunked {
+		return rw.w.WriteChunkedBody(p)
+	}
+
+	declared := rw.declaredLength()
+	if declared >= 0 && !rw.head && rw.written+int64(len(p)) > declared {
+		return 0, http.ErrContentLength
+	}
+	rw.written += int64(len(p))
+	if rw.fixed {
+		return rw.w.WriteBodyPart(p)
+	}
+
+	rw.buf = append(rw.buf, p...)
+	if !rw.head && len(rw.buf) > bufferBeforeChunking {
+		if err := rw.commit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends the headers and any buffered body.
+func (rw *httpResponseWriter) Flush() {
+	rw.WriteHeader(http.StatusOK)
+	if !rw.committed && (rw.head || !responseHasBody("GET", rw.status)) {
+		return
+	}
+
+	if !rw.committed {
+		if err := rw.commit(); err != nil {
+			return
+		}
+	}
+	rw.w.Flush()
+}
+
+func (rw *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.committed {
+		return nil, nil, errors.New("response already started")
+	}
+
+	conn, buffered, err := rw.w.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+	return conn, bufio.NewReadWriter(r, bufio.NewWriter(conn)), nil
+}
+
+func (rw *httpResponseWriter) declaredLength() int64 {
+	n, err := strconv.ParseInt(rw.header.Get("Content-Length"), 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// responseHeaders converts the handler's headers, leaving out trailer
+// values set with http.TrailerPrefix and announcing them in Trailer.
+func (rw *httpResponseWriter) responseHeaders() headers.Headers {
+	h := headers.NewHeaders()
+	var names []string
+	for key, values := range rw.header {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			names = append(names, name)
+			continue
+		}
+		h.Override(key, strings.Join(values, ", "))
+	}
+
+	for _, value := range rw.header["Trailer"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) > 0 {
+		h.Override("Trailer", strings.Join(names, ", "))
+	}
+	rw.trailerNames = names
+
+	if h.Get("Content-Type") == "" && len(rw.buf) > 0 {
+		h.Override("Content-Type", http.DetectContentType(rw.buf))
+	}
+	return h
+}
+
+// commit sends the headers and the buffered body, framed by the declared
+// Content-Length if there is one and chunked otherwise.
+func (rw *httpResponseWriter) commit() error {
+	if rw.declaredLength() < 0 || rw.hasTrailers() {
+		return rw.commitChunked()
+	}
+	return rw.commitFixed()
+}
+
+func (rw *httpResponseWriter) commitFixed() error {
+	h := rw.responseHeaders()
+	h.Del("Trailer")
+
+	rw.committed, rw.fixed = true, true
+	if err := rw.w.WriteStatusLine(response.StatusCode(rw.status)); err != nil {
+		return err
+	}
+	if err := rw.w.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	buf := rw.buf
+	rw.buf = nil
+	_, err := rw.w.WriteBodyPart(buf)
+	return err
+}
+
+func (rw *httpResponseWriter) commitChunked() error {
+	h := rw.responseHeaders()
+	h.Del("Content-Length")
+	h.Override("Transfer-Encoding", "chunked")
+
+	rw.committed, rw.chunked = true, true
+	if err := rw.w.WriteStatusLine(response.StatusCode(rw.status)); err != nil {
+		return err
+	}
+	if err := rw.w.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	buf := rw.buf
+	rw.buf = nil
+	if len(buf) > 0 {
+		_, err := rw.w.WriteChunkedBody(buf)
+		return err
+	}
+	return nil
+}
+
+// finish completes the response once the handler has returned.
+func (rw *httpResponseWriter) finish() error {
+	rw.WriteHeader(http.StatusOK)
+
+	// Trailers need a chunked body even when it fits in the buffer.
+	if !rw.committed && !rw.head && rw.hasTrailers() {
+		if err := rw.commitChunked(); err != nil {
+			return err
+		}
+	}
+
+	if rw.chunked {
+		if _, err := rw.w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		if rw.w.State != response.WriterStateTrailers {
+			return nil
+		}
+		return rw.w.WriteTrailers(rw.trailers())
+	}
+
+	// A short body still gets its headers and what was written; the
+	// connection is closed after it.
+	if n := rw.declaredLength(); n >= 0 && rw.written != n && !rw.head && responseHasBody("GET", rw.status) {
+		if !rw.committed {
+			if err := rw.commitFixed(); err != nil {
+				return err
+			}
+		}
+		rw.w.Flush()
+		return fmt.Errorf("%w: wrote %d bytes, declared %d", http.ErrContentLength, rw.written, n)
+	}
+	if rw.fixed {
+		return nil
+	}
+
+	h := rw.responseHeaders()
+	if responseHasBody("GET", rw.status) {
+		if !rw.head || h.Get("Content-Length") == "" {
+			h.Override("Content-Length", strconv.Itoa(len(rw.buf)))
+		}
+	}
+	h.Del("Trailer")
+
+	rw.committed = true
+	if err := rw.w.WriteStatusLine(response.StatusCode(rw.status)); err != nil {
+		return err
+	}
+	if err := rw.w.WriteHeaders(h); err != nil {
+		return err
+	}
+	if rw.head {
+		_, err := rw.w.WriteBody(nil)
+		return err
+	}
+	_, err := rw.w.WriteBody(rw.buf)
+	return err
+}
+
+func (rw *httpResponseWriter) hasTrailers() bool {
+	if len(rw.header["Trailer"]) > 0 {
+		return true
+	}
+	for key := range rw.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// trailers collects the trailer values once the body is done.
+func (rw *httpResponseWriter) trailers() headers.Headers {
+	h := headers.NewHeaders()
+	for _, name := range rw.trailerNames {
+		if values := rw.header.Values(name); len(values) > 0 {
+			h.Override(name, strings.Join(values, ", "))
+		}
+	}
+	for key, values := range rw.header {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			h.Override(name, strings.Join(values, ", "))
+		}
+	}
+	return h
+}
+
+// ToHTTPHandler mounts a Handler in a net/http server, such as an
+// httptest.Server. The request body is read in full before the handler
+// runs, as this server does. Chunked responses stream through and Flush
+// reaches the client; Hijack and SwitchProtocols are not supported.
+func ToHTTPHandler(h Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req, err := newRequestFromHTTP(r)
+		if err != nil {
+			http.Error(rw, response.StatusText(response.BadRequest), http.StatusBadRequest)
+			return
+		}
+
+		w := response.NewStreamWriter(&httpStream{rw: rw})
+		h(w, req)
+		w.HandlerDone()
+	})
+}
+
+func newRequestFromHTTP(r *http.Request) (*request.Request, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	for key, values := range r.Header {
+		h.Override(key, strings.Join(values, ", "))
+	}
+	h.Override("Host", r.Host)
+
+	var trailers headers.Headers
+	if len(r.Trailer) > 0 {
+		trailers = headers.NewHeaders()
+		for key, values := range r.Trailer {
+			trailers.Override(key, strings.Join(values, ", "))
+		}
+	}
+
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        r.Method,
+			RequestTarget: target,
+			HttpVersion:   fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor),
+		},
+		Headers:    h,
+		Trailers:   trailers,
+		Body:       body,
+		State:      request.DoneState,
+		RemoteAddr: r.RemoteAddr,
+		TLS:        r.TLS,
+	}, nil
+}
+
+// httpStream feeds a Writer's output to an http.ResponseWriter, leaving
+// framing and connection management to net/http.
+type httpStream struct {
+	rw http.ResponseWriter
+}
+
+func (s *httpStream) WriteHeaders(status response.StatusCode, h headers.Headers, endStream bool) error {
+	header := s.rw.Header()
+	for key, value := range h {
+		switch key {
+		case "connection", "keep-alive", "transfer-encoding":
+			continue
+		}
+		header.Set(key, value)
+	}
+
+	s.rw.WriteHeader(int(status))
+	return nil
+}
+
+func (s *httpStream) WriteData(p []byte, endStream bool) error {
+	_, err := s.rw.Write(p)
+	return err
+}
+
+func (s *httpStream) WriteTrailers(h headers.Headers) error {
+	header := s.rw.Header()
+	for key, value := range h {
+		header.Set(http.TrailerPrefix+key, value)
+	}
+	return nil
+}
+
+func (s *httpStream) Flush() error {
+	err := http.NewResponseController(s.rw).Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromHTTPHandler(t *testing.T) {
+	release := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %s %s %s", r.Method, r.URL.Path, r.URL.Query().Get("q"), r.Host, r.Header.Get("X-In"), body)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second")
+	})
+	lengthRelease := make(chan struct{})
+	lengthErr := make(chan error, 1)
+	mux.HandleFunc("/length", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		<-lengthRelease
+		io.WriteString(w, "after")
+		_, err := io.WriteString(w, "more")
+		lengthErr <- err
+	})
+	mux.HandleFunc("/short", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "short")
+	})
+	mux.HandleFunc("/trailers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Sum")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Sum", "42")
+	})
+	mux.HandleFunc("/nocontent", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/hijack", func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		rw.Flush()
+	})
+	middleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "yes")
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	s, err := ServeAddr("tcp", "127.0.0.1:0", FromHTTPHandler(middleware(mux)))
+	require.NoError(t, err)
+	defer s.Close()
+	base := "http://" + s.Addr().String()
+
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(base + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	// Test: Requests reach net/http handlers and middleware intact
+	req, err := http.NewRequest("POST", base+"/echo?q=1", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set("X-In", "in")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "POST /echo 1 "+s.Addr().String()+" in payload", string(body))
+	assert.Equal(t, "yes", resp.Header.Get("X-Middleware"))
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	// Test: Flush streams the body with chunked encoding
+	resp, err = http.Get(base + "/stream")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	first := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(first))
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(rest))
+
+	// Test: Flush sends a declared-length response before it is complete
+	resp, err = http.Get(base + "/length")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), resp.ContentLength)
+	_, err = io.ReadFull(resp.Body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(first))
+	close(lengthRelease)
+	rest, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "after", string(rest))
+
+	// Test: Writes past the declared length fail
+	assert.ErrorIs(t, <-lengthErr, http.ErrContentLength)
+
+	// Test: A short body is still answered, then the connection closes
+	conn := dialAndSend(t, s, "GET /short HTTP/1.1\r\nHost: x\r\n\r\n")
+	out, err := io.ReadAll(bufio.NewReader(conn))
+	conn.Close()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\nshort"))
+
+	// Test: Declared trailers are sent after the body
+	resp, body2 := get("/trailers")
+	assert.Equal(t, "body", body2)
+	assert.Equal(t, "42", resp.Trailer.Get("X-Sum"))
+
+	// Test: Status codes without a body and unknown routes
+	resp, body2 = get("/nocontent")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, body2)
+	resp, body2 = get("/missing")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "404 page not found\n", body2)
+
+	// Test: Hijack hands over the connection
+	conn = dialAndSend(t, s, "GET /hijack HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer conn.Close()
+	out, err = io.ReadAll(bufio.NewReader(conn))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\nhijacked"))
+}
+
+func TestToHTTPHandler(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/chunked" {
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Checksum")
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("one "))
+			w.Flush()
+			w.WriteChunkedBody([]byte("two"))
+			w.WriteChunkedBodyDone()
+			w.WriteTrailers(headers.Headers{"x-checksum": "abc"})
+			return
+		}
+
+		body := []byte(fmt.Sprintf("%s %s %s %s %s", req.RequestLine.Method, req.RequestLine.RequestTarget,
+			req.RequestLine.HttpVersion, req.Headers.Get("host"), req.Body))
+		w.WriteStatusLine(response.Created)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+
+	ts := httptest.NewServer(ToHTTPHandler(handler))
+	defer ts.Close()
+
+	// Test: Requests and fixed-length responses are converted
+	resp, err := http.Post(ts.URL+"/path?x=1", "text/plain", strings.NewReader("data"))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "POST /path?x=1 1.1 "+strings.TrimPrefix(ts.URL, "http://")+" data", string(body))
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+
+	// Test: Chunked responses keep their trailers
+	resp, err = http.Get(ts.URL + "/chunked")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "one two", string(body))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+}
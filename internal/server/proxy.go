@@ -0,0 +1,397 @@
+package server
+
+import (
+	"fmt"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hopByHopHeaders apply to a single connection and are never forwarded
+// (RFC 9110 section 7.6.1).
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// Upstream is one backend a ReverseProxy can forward to.
+type Upstream struct {
+	URL *url.URL
+
+	healthy atomic.Bool
+}
+
+// Healthy reports the result of the most recent health check. Upstreams
+// start out healthy.
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+// ReverseProxy forwards requests to a pool of upstreams in round-robin
+// order, skipping any that failed their last health check.
+type ReverseProxy struct {
+	Upstreams []*Upstream
+	// StripPrefix is removed from the request path before it is appended
+	// to the upstream URL's path. It only matches whole segments: "/api"
+	// strips "/api" and "/api/x" but leaves "/apix" alone.
+	StripPrefix string
+	Client      *client.Client
+
+	next atomic.Uint64
+	stop chan struct{}
+	once sync.Once
+}
+
+// WithStreamedBodies hands each request to the handler as soon as its
+// header section has arrived, so that a handler such as ReverseProxy.Handle
+// can pass the body on while it is still being received. Handlers read the
+// body with Request.BodyReader; Body holds only the part not yet read. A
+// connection whose handler leaves part of the body unread is closed. The
+// epoll engine, h2c and HTTP/2 still read bodies in full.
+func WithStreamedBodies() Option {
+	return func(s *Server) {
+		s.streamBodies = true
+	}
+}
+
+func NewReverseProxy(targets ...string) (*ReverseProxy, error) {
+	c := client.NewClient()
+	c.ResponseHeaderTimeout = 30 * time.Second
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("at least one upstream is required")
+	}
+
+	p := &ReverseProxy{
+		Client: c,
+		stop:   make(chan struct{}),
+	}
+
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %w", target, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid upstream %q: scheme must be http or https", target)
+		}
+
+		upstream := &Upstream{URL: u}
+		upstream.healthy.Store(true)
+		p.Upstreams = append(p.Upstreams, upstream)
+	}
+
+	return p, nil
+}
+
+// pick returns the next healthy upstream, or nil if none are healthy.
+func (p *ReverseProxy) pick() *Upstream {
+	n := uint64(len(p.Upstreams))
+
+	// Unhealthy upstreams still consume a turn so that their share is
+	// spread evenly over the rest instead of landing on their neighbour.
+	for i := uint64(0); i < n; i++ {
+		u := p.Upstreams[(p.next.Add(1)-1)%n]
+		if u.Healthy() {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// Handle forwards req to an upstream and relays the response. It has the
+// Handler signature, so a proxy can be served directly or from a route.
+//
+// headers.Headers holds one value per field name, so repeated upstream
+// fields are joined with ", ". That is lossy for Set-Cookie.
+func (p *ReverseProxy) Handle(w *response.Writer, req *request.Request) {
+	upstream := p.pick()
+	if upstream == nil {
+		writeProxyError(w, response.ServiceUnavailable)
+		return
+	}
+
+	outReq, err := p.outgoingRequest(upstream, req)
+	if err != nil {
+		log.Printf("proxy: building upstream request: %v", err)
+		writeProxyError(w, response.BadRequest)
+		return
+	}
+
+	resp, err := p.Client.Do(outReq)
+	if err != nil {
+		log.Printf("proxy: upstream %s: %v", upstream.URL.Host, err)
+		writeProxyError(w, response.BadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	h := resp.Headers
+	trailerNames := h.Get("Trailer")
+	removeHopByHop(h)
+
+	if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+		log.Printf("proxy: writing status line: %v", err)
+		return
+	}
+
+	if !responseHasBody(req.RequestLine.Method, resp.StatusCode) {
+		if err := w.WriteHeaders(h); err != nil {
+			log.Printf("proxy: writing headers: %v", err)
+			return
+		}
+		w.WriteBody(nil)
+		return
+	}
+
+	// The body is streamed with chunked encoding as it arrives, so the
+	// upstream's length no longer applies.
+	h.Del("Content-Length")
+	h.Override("Transfer-Encoding", "chunked")
+	if trailerNames != "" {
+		h.Override("Trailer", trailerNames)
+	}
+
+	if err := w.WriteHeaders(h); err != nil {
+		log.Printf("proxy: writing headers: %v", err)
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				log.Printf("proxy: writing body: %v", werr)
+				return
+			}
+			if werr := w.Flush(); werr != nil {
+				log.Printf("proxy: writing body: %v", werr)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The status line is already out, so the only way to signal a
+			// truncated body is to end the response without the last chunk.
+			log.Printf("proxy: reading upstream body: %v", err)
+			return
+		}
+	}
+
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		log.Printf("proxy: finishing body: %v", err)
+		return
+	}
+
+	if trailerNames != "" {
+		if err := w.WriteTrailers(resp.Trailers); err != nil {
+			log.Printf("proxy: writing trailers: %v", err)
+		}
+	}
+}
+
+func (p *ReverseProxy) outgoingRequest(upstream *Upstream, req *request.Request) (*client.Request, error) {
+	target := req.RequestLine.RequestTarget
+	if strings.Contains(target, "://") {
+		// Absolute-form: only the path and query are forwarded.
+		abs, err := url.ParseRequestURI(target)
+		if err != nil {
+			return nil, err
+		}
+		target = abs.EscapedPath()
+		if abs.RawQuery != "" {
+			target += "?" + abs.RawQuery
+		}
+	}
+
+	path, rawQuery, _ := strings.Cut(target, "?")
+	path = stripPrefix(path, p.StripPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// RawPath keeps the client's escaping, so "%20" is not escaped again
+	// and an encoded "%2F" does not become a path separator.
+	u := *upstream.URL
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + path
+	u.Path = strings.TrimSuffix(u.Path, "/") + unescaped
+	u.RawQuery = rawQuery
+
+	// The body is read from the client as the upstream takes it; its
+	// length is -1 while a chunked body is still arriving.
+	var body io.Reader
+	if req.ContentLength() != 0 {
+		body = req.BodyReader()
+	}
+
+	outReq, err := client.NewRequest(req.RequestLine.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	outReq.ContentLength = int64(req.ContentLength())
+
+	for key, value := range req.Headers {
+		outReq.Headers[key] = value
+	}
+	removeHopByHop(outReq.Headers)
+	outReq.Headers.Del("Host")
+	outReq.Headers.Del("Content-Length")
+	addForwardedHeaders(outReq.Headers, req)
+
+	return outReq, nil
+}
+
+// stripPrefix removes prefix from path when it ends at a segment boundary.
+func stripPrefix(path, prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return path
+	}
+
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return path
+	}
+	return rest
+}
+
+// removeHopByHop deletes the standard hop-by-hop fields and any field the
+// sender listed in Connection.
+func removeHopByHop(h headers.Headers) {
+	for _, name := range strings.Split(h.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.Del(name)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// addForwardedHeaders records the original client, host and scheme in both
+// the X-Forwarded-* fields and the standard Forwarded field (RFC 7239).
+func addForwardedHeaders(h headers.Headers, req *request.Request) {
+	clientIP := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if clientIP != "" {
+		h.Set("X-Forwarded-For", clientIP)
+	}
+	if host := req.Headers.Get("Host"); host != "" {
+		h.Override("X-Forwarded-Host", host)
+	}
+	h.Override("X-Forwarded-Proto", proto)
+
+	var forwarded []string
+	if clientIP != "" {
+		node := clientIP
+		if strings.Contains(node, ":") {
+			node = `"[` + node + `]"`
+		}
+		forwarded = append(forwarded, "for="+node)
+	}
+	if host := req.Headers.Get("Host"); host != "" {
+		forwarded = append(forwarded, fmt.Sprintf("host=%q", host))
+	}
+	forwarded = append(forwarded, "proto="+proto)
+	h.Set("Forwarded", strings.Join(forwarded, ";"))
+}
+
+func responseHasBody(method string, status int) bool {
+	return method != "HEAD" &&
+		status >= 200 &&
+		status != int(response.NoContent) &&
+		status != int(response.NotModified)
+}
+
+func writeProxyError(w *response.Writer, status response.StatusCode) {
+	body := []byte(response.StatusText(status) + "\n")
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// StartHealthChecks probes every upstream with a GET for path on the given
+// interval, marking it unhealthy on a transport error or a 5xx response.
+// It runs until Close is called.
+func (p *ReverseProxy) StartHealthChecks(interval time.Duration, path string) {
+	p.checkAll(path)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.checkAll(path)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *ReverseProxy) checkAll(path string) {
+	var wg sync.WaitGroup
+	for _, u := range p.Upstreams {
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			u.healthy.Store(p.check(u, path))
+		}(u)
+	}
+	wg.Wait()
+}
+
+func (p *ReverseProxy) check(u *Upstream, path string) bool {
+	target := *u.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + path
+
+	resp, err := p.Client.Get(target.String())
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode < 500
+}
+
+// Close stops health checking.
+func (p *ReverseProxy) Close() {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+}
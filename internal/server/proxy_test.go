@@ -0,0 +1,256 @@
+package server
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstreamHandler reports what it received so tests can inspect what the
+// proxy forwarded.
+func upstreamHandler(name string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/health":
+			status := response.OK
+			if name == "sick" {
+				status = response.InternalError
+			}
+			w.WriteStatusLine(status)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+			w.WriteBody(nil)
+		case "/stream":
+			h := response.GetDefaultHeaders(0)
+			h.Del("Content-Length")
+			h.Override("Transfer-Encoding", "chunked")
+			h.Override("Trailer", "X-Checksum")
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("part one, "))
+			w.WriteChunkedBody([]byte("part two"))
+			w.WriteChunkedBodyDone()
+			w.WriteTrailers(headers.Headers{"x-checksum": "abc123"})
+		default:
+			body := []byte(fmt.Sprintf("%s %s %s body=%s", name, req.RequestLine.Method, req.RequestLine.RequestTarget, req.Body))
+			h := response.GetDefaultHeaders(len(body))
+			h.Override("X-Upstream", name)
+			h.Override("X-Seen-Forwarded", req.Headers.Get("Forwarded"))
+			h.Override("X-Seen-Xff", req.Headers.Get("X-Forwarded-For"))
+			h.Override("X-Seen-Xfh", req.Headers.Get("X-Forwarded-Host"))
+			h.Override("X-Seen-Secret", req.Headers.Get("X-Secret"))
+			h.Override("X-Seen-Keep", req.Headers.Get("X-Keep"))
+			h.Override("Connection", "X-Hop")
+			h.Override("X-Hop", "should not reach client")
+			w.WriteStatusLine(response.Created)
+			w.WriteHeaders(h)
+			w.WriteBody(body)
+		}
+	}
+}
+
+func startUpstream(t *testing.T, name string) *Server {
+	t.Helper()
+	s, err := ServeAddr("tcp", "127.0.0.1:0", upstreamHandler(name))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func proxyRoundTrip(t *testing.T, s *Server, raw string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	go io.WriteString(conn, raw)
+	return readAll(t, conn)
+}
+
+func TestReverseProxy(t *testing.T) {
+	up := startUpstream(t, "one")
+
+	p, err := NewReverseProxy("http://" + up.Addr().String())
+	require.NoError(t, err)
+	p.StripPrefix = "/api"
+	defer p.Close()
+
+	s, err := ServeAddr("tcp", "127.0.0.1:0", p.Handle)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Method, target, body, status and headers are relayed
+	out := proxyRoundTrip(t, s, "POST /api/items?x=1 HTTP/1.1\r\n"+
+		"Host: front.example\r\n"+
+		"Connection: close, X-Secret\r\n"+
+		"X-Secret: hop\r\n"+
+		"X-Keep: end-to-end\r\n"+
+		"Content-Length: 5\r\n\r\nhello")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"), out)
+	assert.Contains(t, out, "x-upstream: one\r\n")
+	assert.Contains(t, out, "one POST /items?x=1 body=hello")
+	assert.Contains(t, out, "x-seen-keep: end-to-end\r\n")
+	assert.Contains(t, out, "x-seen-secret: \r\n")
+	assert.NotContains(t, out, "should not reach client")
+
+	// Test: Forwarding headers describe the original request
+	assert.Contains(t, out, "x-seen-xff: 127.0.0.1\r\n")
+	assert.Contains(t, out, "x-seen-xfh: front.example\r\n")
+	assert.Contains(t, out, "x-seen-forwarded: for=127.0.0.1;host=\"front.example\";proto=http\r\n")
+
+	// Test: Streamed body and trailers are relayed
+	out = proxyRoundTrip(t, s, "GET /api/stream HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	r, err := response.ResponseFromReader(strings.NewReader(out))
+	require.NoError(t, err)
+	assert.Equal(t, "part one, part two", string(r.Body))
+	assert.Equal(t, "abc123", r.Trailers.Get("X-Checksum"))
+
+	// Test: The prefix is only stripped at a segment boundary
+	out = proxyRoundTrip(t, s, "GET /apix HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "one GET /apix body=")
+	out = proxyRoundTrip(t, s, "GET /api?x=1 HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "one GET /?x=1 body=")
+
+	// Test: An absolute-form target is forwarded as its path and query
+	out = proxyRoundTrip(t, s, "GET http://front.example/api/items?x=2 HTTP/1.1\r\nHost: front.example\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "one GET /items?x=2 body=")
+
+	// Test: An encoded path is forwarded with its escaping intact
+	out = proxyRoundTrip(t, s, "GET /api/a%20b/c%2Fd?q=%20 HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "one GET /a%20b/c%2Fd?q=%20 body=")
+
+	// Test: So is one joined to an upstream base path
+	based, err := NewReverseProxy("http://" + up.Addr().String() + "/base%20dir/")
+	require.NoError(t, err)
+	defer based.Close()
+	bs, err := ServeAddr("tcp", "127.0.0.1:0", based.Handle)
+	require.NoError(t, err)
+	defer bs.Close()
+	out = proxyRoundTrip(t, bs, "GET /a%20b HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "one GET /base%20dir/a%20b body=")
+
+	// Test: A malformed escape is rejected
+	out = proxyRoundTrip(t, bs, "GET /a%zz HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+
+	// Test: Unreachable upstream is a 502
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := ln.Addr().String()
+	ln.Close()
+	deadProxy, err := NewReverseProxy("http://" + dead)
+	require.NoError(t, err)
+	ds, err := ServeAddr("tcp", "127.0.0.1:0", deadProxy.Handle)
+	require.NoError(t, err)
+	defer ds.Close()
+	out = proxyRoundTrip(t, ds, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 502 Bad Gateway\r\n"))
+}
+
+func TestReverseProxyBalancing(t *testing.T) {
+	one := startUpstream(t, "one")
+	two := startUpstream(t, "two")
+	sick := startUpstream(t, "sick")
+
+	p, err := NewReverseProxy(
+		"http://"+one.Addr().String(),
+		"http://"+two.Addr().String(),
+		"http://"+sick.Addr().String(),
+	)
+	require.NoError(t, err)
+	defer p.Close()
+
+	s, err := ServeAddr("tcp", "127.0.0.1:0", p.Handle)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Round-robin across all upstreams before health checks run
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		out := proxyRoundTrip(t, s, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		seen[out[strings.Index(out, "x-upstream: ")+12:][:3]]++
+	}
+	assert.Equal(t, map[string]int{"one": 2, "two": 2, "sic": 2}, seen)
+
+	// Test: Failing health check takes an upstream out of rotation
+	p.StartHealthChecks(time.Hour, "/health")
+	assert.True(t, p.Upstreams[0].Healthy())
+	assert.False(t, p.Upstreams[2].Healthy())
+
+	seen = map[string]int{}
+	for i := 0; i < 4; i++ {
+		out := proxyRoundTrip(t, s, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		seen[out[strings.Index(out, "x-upstream: ")+12:][:3]]++
+	}
+	assert.Equal(t, map[string]int{"one": 2, "two": 2}, seen)
+}
+
+func TestReverseProxyStreaming(t *testing.T) {
+	gotFirst := make(chan string, 1)
+	release := make(chan struct{})
+	up, err := ServeAddr("tcp", "127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		body := req.BodyReader()
+		first := make([]byte, 5)
+		io.ReadFull(body, first)
+		gotFirst <- string(first)
+		rest, _ := io.ReadAll(body)
+
+		h := response.GetDefaultHeaders(0)
+		h.Del("Content-Length")
+		h.Override("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody(rest)
+		w.Flush()
+		<-release
+		w.WriteChunkedBody([]byte(" done"))
+		w.WriteChunkedBodyDone()
+	}, WithStreamedBodies())
+	require.NoError(t, err)
+	defer up.Close()
+
+	p, err := NewReverseProxy("http://" + up.Addr().String())
+	require.NoError(t, err)
+	defer p.Close()
+	s, err := ServeAddr("tcp", "127.0.0.1:0", p.Handle, WithStreamedBodies())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The request body reaches the upstream as the client sends it
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nfirst\r\n")
+	select {
+	case first := <-gotFirst:
+		assert.Equal(t, "first", first)
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream did not see the start of the body")
+	}
+	io.WriteString(conn, "4\r\nrest\r\n0\r\n\r\n")
+
+	// Test: Each upstream chunk is flushed to the client as it arrives
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got strings.Builder
+	buf := make([]byte, 1024)
+	for !strings.Contains(got.String(), "4\r\nrest\r\n") {
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		got.Write(buf[:n])
+	}
+	close(release)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for !strings.HasSuffix(got.String(), "0\r\n\r\n") {
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		got.Write(buf[:n])
+	}
+	assert.Contains(t, got.String(), "5\r\n done\r\n")
+}
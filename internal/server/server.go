@@ -1,22 +1,54 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"httpfromtcp/internal/http2"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"io"
 	"log"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReadTimeout = 30 * time.Second
+	defaultIdleTimeout = 60 * time.Second
 )
 
 type Server struct {
 	Listener net.Listener
 	Handler  Handler
-	State    ServerState
 	Port     int
 	Closed   atomic.Bool
+	Stats    LimitStats
 	wg       sync.WaitGroup
+
+	connSlots    chan struct{}
+	requestSlots chan struct{}
+	rejectSlots  chan struct{}
+	limitMode    LimitMode
+	retryAfter   time.Duration
+	closing      chan struct{}
+	accessLog    AccessLogger
+	metrics      *Metrics
+	h2c          bool
+	// readTimeout and idleTimeout override the defaults when set.
+	readTimeout  time.Duration
+	idleTimeout  time.Duration
+	epollWorkers int
+	epoll        *epollEngine
+	streamBodies bool
+
+	// mu guards state and idle, the connections waiting for a request.
+	mu    sync.Mutex
+	state ServerState
+	idle  map[net.Conn]struct{}
 }
 
 type ServerState string
@@ -28,21 +60,80 @@ const (
 	ServerStateError   ServerState = "error"
 )
 
-func Serve(port int, handler Handler) (*Server, error) {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	return ServeAddr("tcp", fmt.Sprintf(":%d", port), handler, opts...)
+}
+
+// ServeAddr listens on the given network and address, as accepted by
+// net.Listen, for example ("tcp", "127.0.0.1:0") or ("unix", "/run/app.sock").
+func ServeAddr(network, address string, handler Handler, opts ...Option) (*Server, error) {
+	ln, err := net.Listen(network, address)
 	if err != nil {
 		return nil, err
 	}
 
+	return ServeListener(ln, handler, opts...)
+}
+
+// ServeListener serves connections accepted from ln. The server owns ln and
+// closes it in Close.
+func ServeListener(ln net.Listener, handler Handler, opts ...Option) (*Server, error) {
+	if ln == nil {
+		return nil, fmt.Errorf("listener is required")
+	}
+
+	return newServer(ln, handler, opts), nil
+}
+
+func newServer(ln net.Listener, handler Handler, opts []Option) *Server {
 	s := &Server{
-		Handler:  handler,
-		Port:     port,
-		Listener: ln,
-		State:    ServerStateRunning,
+		Handler:     handler,
+		Listener:    ln,
+		state:       ServerStateRunning,
+		limitMode:   LimitBlock,
+		retryAfter:  defaultRetryAfter,
+		rejectSlots: make(chan struct{}, maxRejecting),
+		closing:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		s.Port = addr.Port
+	}
+
+	if s.epollWorkers > 0 {
+		e, err := newEpollEngine(s, s.epollWorkers)
+		if err != nil {
+			log.Printf("epoll engine unavailable, serving a goroutine per connection: %v", err)
+		}
+		s.epoll = e
 	}
+
 	go s.listen()
 
-	return s, nil
+	return s
+}
+
+// Addr returns the address the server is bound to, which reports the chosen
+// port when the server was started on port 0.
+func (s *Server) Addr() net.Addr {
+	return s.Listener.Addr()
+}
+
+// State reports whether the server is running, closing or stopped.
+func (s *Server) State() ServerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *Server) setState(state ServerState) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
 }
 
 func (s *Server) Close() error {
@@ -54,25 +145,38 @@ func (s *Server) Close() error {
 		return nil
 	}
 
-	s.State = ServerStateClosing
+	s.setState(ServerStateClosing)
+	close(s.closing)
 
 	err := s.Listener.Close()
+	s.wakeIdle()
 
 	s.wg.Wait()
+	if s.epoll != nil {
+		s.epoll.wait()
+	}
 
 	if err != nil {
-		s.State = ServerStateError
+		s.setState(ServerStateError)
 		return fmt.Errorf("failed to close listener: %w", err)
 	}
-	s.State = ServerStateStopped
+	s.setState(ServerStateStopped)
 	return nil
 }
 
 func (s *Server) listen() {
 	for {
+		if s.limitMode == LimitBlock && !s.acquireConnBlocking() {
+			return
+		}
+
 		conn, err := s.Listener.Accept()
 
 		if err != nil {
+			if s.limitMode == LimitBlock {
+				s.releaseConn()
+			}
+
 			if s.Closed.Load() {
 				return
 			}
@@ -82,31 +186,249 @@ func (s *Server) listen() {
 				continue
 			}
 			log.Printf("accept error (stopping): %v", err)
-			s.State = ServerStateError
+			s.setState(ServerStateError)
 			return
 		}
 
+		if s.limitMode == LimitReject && !s.tryAcquireConn() {
+			s.Stats.ConnLimitHits.Add(1)
+			s.rejectAsync(conn)
+			continue
+		}
+
+		if s.epoll != nil && s.epoll.add(conn) {
+			continue
+		}
+
 		s.wg.Add(1)
 		go func(c net.Conn) {
 			defer s.wg.Done()
-
-			go s.handle(c)
+			defer s.releaseConn()
+			s.handle(c)
 		}(conn)
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+func (s *Server) handle(netConn net.Conn) {
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			netConn.Close()
+		}
+	}()
 
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		WriteErrorResponse(conn, &HandlerError{
-			StatusCode: response.BadRequest,
-			Message:    fmt.Sprintf("error reading request: %v", err),
-		})
+	conn := netConn
+	if s.metrics != nil {
+		s.metrics.activeConnections.Inc()
+		defer s.metrics.activeConnections.Dec()
+		conn = &countingConn{Conn: netConn, m: s.metrics}
+	}
+
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(s.requestTimeout()))
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			s.serveHTTP2(conn, netConn, http2.ServeConnOpts{})
+			return
+		}
+	}
+
+	var src io.Reader = conn
+	if s.h2c {
+		conn.SetReadDeadline(time.Now().Add(s.requestTimeout()))
+		peeked, isH2, err := sniffPreface(conn)
+		if isH2 {
+			s.serveHTTP2(conn, netConn, http2.ServeConnOpts{
+				Reader: io.MultiReader(bytes.NewReader(peeked), conn),
+			})
+			return
+		}
+		if err != nil && len(peeked) == 0 {
+			return
+		}
+		src = io.MultiReader(bytes.NewReader(peeked), conn)
+	}
+
+	reader := request.NewReader(src)
+	defer reader.Release()
+	for served := 0; ; served++ {
+		timeout := s.requestTimeout()
+		if served > 0 {
+			timeout = s.keepAliveTimeout()
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+
+		if !s.markIdle(conn) {
+			return
+		}
+		var req *request.Request
+		var err error
+		if s.streamBodies && !s.h2c {
+			req, err = reader.ReadRequestHeader()
+		} else {
+			req, err = reader.ReadRequest()
+		}
+		s.markBusy(conn)
+		start := time.Now()
+		if err != nil {
+			// Close cuts short the wait for a request.
+			if errors.Is(err, io.EOF) || s.Closed.Load() && errors.Is(err, request.ErrTimeout) {
+				return
+			}
+			log.Printf("error reading request from %s: %v", conn.RemoteAddr(), err)
+			s.writeParseError(conn, nil, err, start)
+			return
+		}
+		// A body still to come is read under the same deadline.
+		if req.State == request.DoneState {
+			conn.SetReadDeadline(time.Time{})
+		}
+
+		var keepAlive bool
+		keepAlive, hijacked = s.serveRequest(conn, netConn, reader, req, start)
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// markIdle records that conn is waiting for a request, so that Close can
+// end the wait. It reports false once the server is closed.
+func (s *Server) markIdle(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Closed.Load() {
+		return false
+	}
+	if s.idle == nil {
+		s.idle = make(map[net.Conn]struct{})
+	}
+	s.idle[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) markBusy(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.idle, conn)
+	s.mu.Unlock()
+}
+
+// wakeIdle expires the read deadline of every connection waiting for a
+// request. Connections serving one finish it first.
+func (s *Server) wakeIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.idle {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// requestTimeout bounds the time to read a request.
+func (s *Server) requestTimeout() time.Duration {
+	if s.readTimeout > 0 {
+		return s.readTimeout
+	}
+	return defaultReadTimeout
+}
+
+// keepAliveTimeout bounds the wait for a further request on a kept-alive
+// connection.
+func (s *Server) keepAliveTimeout() time.Duration {
+	if s.idleTimeout > 0 {
+		return s.idleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+// serveRequest answers one request read from conn and reports whether the
+// connection can carry another. hijacked is set when the handler took the
+// connection over; it then belongs to the handler and is neither logged
+// nor closed.
+func (s *Server) serveRequest(conn, netConn net.Conn, reader *request.Reader, req *request.Request, start time.Time) (keepAlive, hijacked bool) {
+	req.RemoteAddr = conn.RemoteAddr().String()
+
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+
+	if err := req.ValidateHost(); err != nil {
+		log.Printf("rejecting request from %s: %v", conn.RemoteAddr(), err)
+		s.writeParseError(conn, req, err, start)
+		return false, false
+	}
+
+	if s.h2c {
+		if settings, ok := http2.UpgradeSettings(req); ok {
+			s.upgradeH2C(conn, netConn, reader, req, settings)
+			return false, false
+		}
+	}
+
+	if !s.acquireRequest() {
+		n := s.reject(conn)
+		s.logAccess(conn, req, response.ServiceUnavailable, n, start)
+		s.metrics.observeRequest(req.RequestLine.Method, response.ServiceUnavailable, start)
+		return false, false
+	}
+
+	writer := response.NewResponseWriter(conn)
+	writer.Attach(conn, reader.Buffered())
+	writer.Negotiate(req.RequestLine.HttpVersion, req.KeepAlive(), s.keepAliveTimeout())
+	s.Handler(writer, req)
+	writer.HandlerDone()
+	s.releaseRequest()
+
+	// The request and writer of a hijacked connection are not released,
+	// since the handler's goroutines may still refer to them.
+	if writer.Hijacked() {
+		return false, true
+	}
+
+	s.logAccess(conn, req, writer.StatusCode, writer.BytesWritten, start)
+	s.metrics.observeRequest(req.RequestLine.Method, writer.StatusCode, start)
+
+	// A streamed body the handler left unread ends the connection.
+	keepAlive = writer.KeepAlive() && req.State == request.DoneState && !s.Closed.Load()
+	writer.Release()
+	req.Release()
+	return keepAlive, false
+}
+
+// writeParseError answers a request that could not be read or was rejected
+// before reaching the handler.
+func (s *Server) writeParseError(conn net.Conn, req *request.Request, err error, start time.Time) {
+	herr := parseErrorResponse(err)
+	if werr := WriteErrorResponse(conn, herr); werr != nil {
+		log.Printf("error writing %d response to %s: %v", herr.StatusCode, conn.RemoteAddr(), werr)
+	}
+	s.logAccess(conn, req, herr.StatusCode, int64(len(herr.Message)), start)
+	s.metrics.observeParseError(err)
+}
+
+func (s *Server) logAccess(conn net.Conn, req *request.Request, status response.StatusCode, bytes int64, start time.Time) {
+	if s.accessLog == nil {
 		return
 	}
 
-	writter := response.NewResponseWriter(conn)
-	s.Handler(writter, req)
+	entry := AccessLogEntry{
+		Time:       start,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Status:     int(status),
+		Bytes:      bytes,
+		Duration:   time.Since(start),
+	}
+	if req != nil {
+		entry.Method = req.RequestLine.Method
+		entry.Target = req.RequestLine.RequestTarget
+		entry.Version = req.RequestLine.HttpVersion
+		entry.UserAgent = req.Headers.Get("user-agent")
+		entry.Referer = req.Headers.Get("referer")
+	}
+
+	s.accessLog.LogAccess(entry)
 }
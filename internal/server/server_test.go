@@ -0,0 +1,344 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoTarget(w *response.Writer, req *request.Request) {
+	body := []byte(req.RequestLine.RequestTarget)
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func readAll(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	out, err := io.ReadAll(bufio.NewReader(conn))
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	// Test: Pipelined HTTP/1.1 requests share a connection until Connection: close
+	client, conn := net.Pipe()
+	s := &Server{Handler: echoTarget}
+	go s.handle(conn)
+
+	go io.WriteString(client,
+		"GET /one HTTP/1.1\r\nHost: x\r\n\r\n"+
+			"GET /two HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+
+	out := readAll(t, client)
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "/one")
+	assert.True(t, strings.HasSuffix(out, "/two"))
+
+	// Test: HTTP/1.0 closes after one response by default
+	client, conn = net.Pipe()
+	go s.handle(conn)
+	go io.WriteString(client, "GET /one HTTP/1.0\r\n\r\nGET /two HTTP/1.0\r\n\r\n")
+
+	out = readAll(t, client)
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "connection: close\r\n")
+
+	// Test: HTTP/1.0 with Transfer-Encoding closes even if asked to keep alive
+	client, conn = net.Pipe()
+	go s.handle(conn)
+	go io.WriteString(client, "POST /one HTTP/1.0\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"+
+		"GET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n")
+
+	out = readAll(t, client)
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.NotContains(t, out, "/smuggled")
+
+	// Test: HTTP/1.1 without Host is rejected
+	client, conn = net.Pipe()
+	go s.handle(conn)
+	go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+
+	out = readAll(t, client)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+
+	// Test: Unsupported major version gets 505
+	client, conn = net.Pipe()
+	go s.handle(conn)
+	go io.WriteString(client, "GET / HTTP/2.0\r\nHost: x\r\n\r\n")
+
+	out = readAll(t, client)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 505 HTTP Version Not Supported\r\n"))
+}
+
+func TestServeAddr(t *testing.T) {
+	// Test: Port 0 picks a free port and exposes it
+	s, err := ServeAddr("tcp", "127.0.0.1:0", echoTarget)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NotZero(t, s.Port)
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", s.Port), s.Addr().String())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	go io.WriteString(conn, "GET /tcp HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasSuffix(readAll(t, conn), "/tcp"))
+
+	// Test: Unix domain socket
+	path := filepath.Join(t.TempDir(), "server.sock")
+	us, err := ServeAddr("unix", path, echoTarget)
+	require.NoError(t, err)
+	assert.Equal(t, path, us.Addr().String())
+	assert.Zero(t, us.Port)
+
+	conn, err = net.Dial("unix", path)
+	require.NoError(t, err)
+	go io.WriteString(conn, "GET /unix HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasSuffix(readAll(t, conn), "/unix"))
+
+	require.NoError(t, us.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: Caller-provided listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ls, err := ServeListener(ln, echoTarget)
+	require.NoError(t, err)
+	defer ls.Close()
+	assert.Equal(t, ln.Addr(), ls.Addr())
+}
+
+func TestServerHijack(t *testing.T) {
+	// Test: Hijacked connection outlives the handler and keeps unread bytes
+	hijacked := make(chan []byte, 1)
+	entries := make(chanAccessLogger, 1)
+	s, err := ServeAddr("tcp", "127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		hijacked <- buffered
+
+		go func() {
+			defer conn.Close()
+			io.WriteString(conn, "raw:")
+			io.Copy(conn, conn)
+		}()
+
+		// Test: The writer is unusable once hijacked
+		assert.ErrorIs(t, w.WriteStatusLine(response.OK), response.ErrHijacked)
+	}, WithAccessLog(entries))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET /hijack HTTP/1.1\r\nHost: x\r\n\r\nextra")
+	require.NoError(t, err)
+	assert.Equal(t, "extra", string(<-hijacked))
+
+	_, err = io.WriteString(conn, "ping")
+	require.NoError(t, err)
+	conn.(*net.TCPConn).CloseWrite()
+
+	// Test: Nothing but the handler's own bytes reaches the client
+	assert.Equal(t, "raw:ping", readAll(t, conn))
+	assert.Empty(t, entries)
+}
+
+// describeRequest reports every field of req the pools reuse, so a
+// response reveals anything carried over from an earlier request.
+func describeRequest(w *response.Writer, req *request.Request) {
+	var fields []string
+	for key, value := range req.Headers {
+		fields = append(fields, key+"="+value)
+	}
+	for key, value := range req.Trailers {
+		fields = append(fields, "trailer:"+key+"="+value)
+	}
+	sort.Strings(fields)
+
+	body := []byte(fmt.Sprintf("%s %s %s", req.RequestLine.RequestTarget, strings.Join(fields, ","), req.Body))
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestServerPooling(t *testing.T) {
+	// Test: Concurrent keep-alive requests never see each other's fields
+	s, err := ServeAddr("tcp", "127.0.0.1:0", describeRequest)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			for i := 0; i < 25; i++ {
+				id := fmt.Sprintf("%d-%d", c, i)
+				var raw, want string
+				if i%2 == 0 {
+					raw = "POST /" + id + " HTTP/1.1\r\nHost: x\r\nX-Id-" + id + ": " + id + "\r\nTransfer-Encoding: chunked\r\n\r\n" +
+						fmt.Sprintf("%x\r\n%s\r\n", len(id), id) + "0\r\nX-Sum: " + id + "\r\n\r\n"
+					want = "/" + id + " host=x,trailer:x-sum=" + id + ",transfer-encoding=chunked,x-id-" + id + "=" + id + " " + id
+				} else {
+					raw = "GET /" + id + " HTTP/1.1\r\nHost: x\r\nX-Id-" + id + ": " + id + "\r\n\r\n"
+					want = "/" + id + " host=x,x-id-" + id + "=" + id + " "
+				}
+
+				_, err := io.WriteString(conn, raw)
+				if !assert.NoError(t, err) {
+					return
+				}
+				resp, err := response.ResponseFromReader(conn)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, want, string(resp.Body))
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+func BenchmarkServerKeepAlive(b *testing.B) {
+	s, err := ServeAddr("tcp", "127.0.0.1:0", echoTarget)
+	require.NoError(b, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(b, err)
+	defer conn.Close()
+
+	raw := "GET /bench HTTP/1.1\r\nHost: x\r\nUser-Agent: bench\r\nAccept: */*\r\n\r\n"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.WriteString(conn, raw); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := response.ResponseFromReader(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// withTimeouts shortens the read and idle timeouts to d.
+func withTimeouts(d time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout, s.idleTimeout = d, d
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	testServerTimeouts(t)
+}
+
+// testServerTimeouts checks that only a request cut off by its deadline is
+// answered, logged and counted; connections that time out between requests
+// are closed quietly.
+func testServerTimeouts(t *testing.T, opts ...Option) {
+	entries := make(chanAccessLogger, 4)
+	m := NewMetrics()
+	opts = append(opts, withTimeouts(200*time.Millisecond), WithAccessLog(entries), WithMetrics(m))
+	s, err := ServeAddr("tcp", "127.0.0.1:0", echoTarget, opts...)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: An idle keep-alive connection is closed without a response
+	conn := dialAndSend(t, s, "GET /first HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer conn.Close()
+	_, err = response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, 200, (<-entries).Status)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.Empty(t, readAll(t, conn))
+
+	// Test: So is a connection that never sends a byte
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.Empty(t, readAll(t, conn))
+
+	// Test: A request cut off by the deadline gets 408
+	conn = dialAndSend(t, s, "GET /partial HTTP/1.1\r\nHo")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.True(t, strings.HasPrefix(readAll(t, conn), "HTTP/1.1 408 Request Timeout\r\n"))
+	assert.Equal(t, 408, (<-entries).Status)
+
+	var out bytes.Buffer
+	require.NoError(t, m.Registry.WriteText(&out))
+	assert.Contains(t, out.String(), `httpfromtcp_parse_errors_total{kind="timeout"} 1`)
+	assert.Empty(t, entries)
+}
+
+func TestServerClose(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s, err := ServeAddr("tcp", "127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			close(started)
+			<-release
+		}
+		echoTarget(w, req)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ServerStateRunning, s.State())
+
+	idle := dialAndSend(t, s, "GET /first HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer idle.Close()
+	_, err = response.ResponseFromReader(idle)
+	require.NoError(t, err)
+
+	busy := dialAndSend(t, s, "GET /slow HTTP/1.1\r\nHost: x\r\n\r\n")
+	defer busy.Close()
+	<-started
+
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+
+	// Test: Close ends the wait on an idle keep-alive connection
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.Empty(t, readAll(t, idle))
+
+	// Test: Close waits for a handler still running
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the handler finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, ServerStateClosing, s.State())
+
+	close(release)
+	busy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.True(t, strings.HasPrefix(readAll(t, busy), "HTTP/1.1 200 OK\r\n"))
+	require.NoError(t, <-closed)
+	assert.Equal(t, ServerStateStopped, s.State())
+}
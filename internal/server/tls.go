@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServeTLS starts a server that terminates TLS itself using config. The
+// config should supply Certificates or GetCertificate.
+func ServeTLS(port int, handler Handler, config *tls.Config, opts ...Option) (*Server, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := ServeTLSListener(ln, handler, config, opts...)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ServeTLSListener wraps ln in TLS using config and serves it. Unless config
+// sets NextProtos, clients may negotiate "h2" or "http/1.1" with ALPN.
+func ServeTLSListener(ln net.Listener, handler Handler, config *tls.Config, opts ...Option) (*Server, error) {
+	if config == nil {
+		return nil, fmt.Errorf("tls config is required")
+	}
+
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	return ServeListener(tls.NewListener(ln, config), handler, opts...)
+}
+
+// ServeTLSFiles starts a TLS server with the certificate and key at the
+// given PEM paths. The files are reloaded when they change on disk, so a
+// renewed certificate takes effect without a restart.
+func ServeTLSFiles(port int, handler Handler, certFile, keyFile string, opts ...Option) (*Server, error) {
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return ServeTLS(port, handler, &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, opts...)
+}
+
+// CertificateSource supplies the certificate for a TLS handshake. It matches
+// tls.Config.GetCertificate.
+type CertificateSource interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// CertReloader serves a certificate loaded from disk and reloads it on the
+// next handshake after either file's modification time changes.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *CertReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	certInfo, certErr := os.Stat(c.CertFile)
+	keyInfo, keyErr := os.Stat(c.KeyFile)
+	if certErr == nil && keyErr == nil &&
+		(!certInfo.ModTime().Equal(c.certModTime) || !keyInfo.ModTime().Equal(c.keyModTime)) {
+		// A failed reload, for example while the files are half written,
+		// keeps serving the previous certificate.
+		_ = c.reloadLocked()
+	}
+
+	return c.cert, nil
+}
+
+func (c *CertReloader) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reloadLocked()
+}
+
+func (c *CertReloader) reloadLocked() error {
+	certInfo, err := os.Stat(c.CertFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat certificate: %w", err)
+	}
+
+	keyInfo, err := os.Stat(c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat key: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %w", err)
+	}
+
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+
+	return nil
+}
+
+// SNICertificates picks a certificate source by the server name the client
+// sent. Names are matched exactly first, then against a "*.example.com"
+// wildcard entry, then fall back to Default.
+type SNICertificates struct {
+	Default CertificateSource
+
+	mu    sync.RWMutex
+	hosts map[string]CertificateSource
+}
+
+func (s *SNICertificates) Add(host string, source CertificateSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hosts == nil {
+		s.hosts = make(map[string]CertificateSource)
+	}
+	s.hosts[strings.ToLower(host)] = source
+}
+
+func (s *SNICertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	s.mu.RLock()
+	source, ok := s.hosts[name]
+	if !ok {
+		if i := strings.IndexByte(name, '.'); i != -1 {
+			source, ok = s.hosts["*"+name[i:]]
+		}
+	}
+	s.mu.RUnlock()
+
+	if !ok {
+		source = s.Default
+	}
+
+	if source == nil {
+		return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+	}
+
+	return source.GetCertificate(hello)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSignedCert writes a fresh self-signed certificate for names to
+// certFile and keyFile and returns it.
+func writeSelfSignedCert(t *testing.T, certFile, keyFile string, names ...string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func tlsInfo(w *response.Writer, req *request.Request) {
+	body := []byte("plain")
+	if req.TLS != nil {
+		body = []byte(fmt.Sprintf("%s %s", req.TLS.ServerName, req.TLS.NegotiatedProtocol))
+	}
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// tlsGet performs one request against s and returns the peer certificate
+// and the raw response.
+func tlsGet(t *testing.T, s *Server, serverName string) (*x509.Certificate, string) {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1"},
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+serverName+"\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	return conn.ConnectionState().PeerCertificates[0], string(out)
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	first := writeSelfSignedCert(t, certFile, keyFile, "localhost")
+
+	// Test: Request exposes the negotiated TLS state
+	s, err := ServeTLSFiles(0, tlsInfo, certFile, keyFile)
+	require.NoError(t, err)
+	defer s.Close()
+
+	peer, out := tlsGet(t, s, "localhost")
+	assert.Equal(t, first.SerialNumber, peer.SerialNumber)
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, out, "localhost http/1.1")
+
+	// Test: Replaced certificate files are picked up without a restart
+	second := writeSelfSignedCert(t, certFile, keyFile, "localhost")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+
+	peer, _ = tlsGet(t, s, "localhost")
+	assert.Equal(t, second.SerialNumber, peer.SerialNumber)
+}
+
+func TestSNICertificates(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]*x509.Certificate{}
+	certs := &SNICertificates{}
+
+	for _, name := range []string{"default.test", "a.test", "*.b.test"} {
+		base := filepath.Join(dir, name)
+		sources[name] = writeSelfSignedCert(t, base+".crt", base+".key", name)
+		reloader, err := NewCertReloader(base+".crt", base+".key")
+		require.NoError(t, err)
+
+		if name == "default.test" {
+			certs.Default = reloader
+			continue
+		}
+		certs.Add(name, reloader)
+	}
+
+	s, err := ServeTLS(0, tlsInfo, &tls.Config{GetCertificate: certs.GetCertificate})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Exact, wildcard and default matches
+	cases := map[string]string{
+		"a.test":     "a.test",
+		"A.TEST":     "a.test",
+		"api.b.test": "*.b.test",
+		"other.test": "default.test",
+	}
+	for serverName, want := range cases {
+		peer, _ := tlsGet(t, s, serverName)
+		assert.Equal(t, sources[want].SerialNumber, peer.SerialNumber, serverName)
+	}
+}
@@ -0,0 +1,249 @@
+package servertest
+
+import (
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultRemoteAddr is the client address given to requests from NewRequest.
+const DefaultRemoteAddr = "192.0.2.1:1234"
+
+// NewRequest returns a request as the server hands it to a handler: an
+// HTTP/1.1 request for target with a Host of example.com and, when body is
+// not empty, a matching Content-Length. Callers may adjust any field.
+func NewRequest(method, target string, body []byte) *request.Request {
+	h := headers.NewHeaders()
+	h.Set("Host", "example.com")
+	if len(body) > 0 {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: target,
+			HttpVersion:   "1.1",
+		},
+		Headers:    h,
+		Body:       body,
+		State:      request.DoneState,
+		RemoteAddr: DefaultRemoteAddr,
+	}
+}
+
+// Recorder captures the response a handler writes to Writer. The writer
+// validates headers and enforces write order as on a connection, but
+// framing such as chunk sizes and connection headers is not recorded; use
+// Server to check those.
+type Recorder struct {
+	Writer *response.Writer
+
+	StatusCode response.StatusCode
+	Headers    headers.Headers
+	Body       bytes.Buffer
+	Trailers   headers.Headers
+	// Flushes counts calls to Writer.Flush.
+	Flushes int
+	// Finished is set once the handler completed the body.
+	Finished bool
+}
+
+func NewRecorder() *Recorder {
+	r := &Recorder{}
+	r.Writer = response.NewStreamWriter(recorderStream{r})
+	return r
+}
+
+// Record runs h on req and returns what it wrote.
+func Record(h server.Handler, req *request.Request) *Recorder {
+	r := NewRecorder()
+	h(r.Writer, req)
+	r.Writer.HandlerDone()
+	return r
+}
+
+// recorderStream keeps the response.Stream methods off Recorder's API.
+type recorderStream struct {
+	r *Recorder
+}
+
+func (s recorderStream) WriteHeaders(status response.StatusCode, h headers.Headers, endStream bool) error {
+	s.r.StatusCode = status
+	s.r.Headers = h
+	s.r.Finished = endStream
+	return nil
+}
+
+func (s recorderStream) WriteData(p []byte, endStream bool) error {
+	s.r.Body.Write(p)
+	s.r.Finished = endStream
+	return nil
+}
+
+func (s recorderStream) WriteTrailers(h headers.Headers) error {
+	s.r.Trailers = h
+	s.r.Finished = true
+	return nil
+}
+
+func (s recorderStream) Flush() error {
+	s.r.Flushes++
+	return nil
+}
+
+// Server is a server.Server whose connections are in-memory pipes.
+type Server struct {
+	*server.Server
+	Listener *PipeListener
+}
+
+// NewServer starts serving h. Close it when done.
+func NewServer(h server.Handler, opts ...server.Option) *Server {
+	ln := NewPipeListener()
+	s, _ := server.ServeListener(ln, h, opts...)
+	return &Server{Server: s, Listener: ln}
+}
+
+// Dial opens a new client connection to the server.
+func (s *Server) Dial() (net.Conn, error) {
+	return s.Listener.Dial()
+}
+
+// RoundTrip sends req on a new connection and reads the response.
+func (s *Server) RoundTrip(req *request.Request) (*response.Response, error) {
+	var buf bytes.Buffer
+	if err := WriteRequest(&buf, req); err != nil {
+		return nil, err
+	}
+	return s.roundTrip(buf.Bytes(), req.RequestLine.Method)
+}
+
+// RoundTripRaw sends raw bytes, which need not be a valid request, on a new
+// connection and reads one response.
+func (s *Server) RoundTripRaw(raw string) (*response.Response, error) {
+	method, _, _ := strings.Cut(raw, " ")
+	return s.roundTrip([]byte(raw), method)
+}
+
+func (s *Server) roundTrip(raw []byte, method string) (*response.Response, error) {
+	conn, err := s.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Pipes are unbuffered, and the server may answer before reading the
+	// whole request, so the request is written concurrently.
+	go conn.Write(raw)
+
+	return response.ResponseFromReaderForMethod(conn, method)
+}
+
+// WriteRequest serialises req in HTTP/1.x wire format. Headers are written
+// in sorted order. A body without framing headers gets a Content-Length,
+// and Trailers are sent after a chunked body.
+func WriteRequest(w io.Writer, req *request.Request) error {
+	h := headers.NewHeaders()
+	for key, value := range req.Headers {
+		h[key] = value
+	}
+
+	chunked := headers.HasToken(h.Get("Transfer-Encoding"), "chunked")
+	if len(req.Trailers) > 0 && !chunked {
+		h.Del("Content-Length")
+		h.Override("Transfer-Encoding", "chunked")
+		chunked = true
+	}
+	if len(req.Body) > 0 && !chunked && h.Get("Content-Length") == "" {
+		h.Override("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/%s\r\n", req.RequestLine.Method, req.RequestLine.RequestTarget, req.RequestLine.HttpVersion)
+	writeFields(&b, h)
+	b.WriteString("\r\n")
+
+	if chunked {
+		if len(req.Body) > 0 {
+			fmt.Fprintf(&b, "%x\r\n%s\r\n", len(req.Body), req.Body)
+		}
+		b.WriteString("0\r\n")
+		writeFields(&b, req.Trailers)
+		b.WriteString("\r\n")
+	} else {
+		b.Write(req.Body)
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func writeFields(b *bytes.Buffer, h headers.Headers) {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s: %s\r\n", key, h[key])
+	}
+}
+
+// PipeListener is a net.Listener whose connections come from Dial.
+type PipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Dial returns the client end of a new pipe once the server accepted it.
+func (l *PipeListener) Dial() (net.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+	select {
+	case l.conns <- serverConn:
+		return clientConn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,118 @@
+package servertest
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	switch req.RequestLine.RequestTarget {
+	case "/chunked":
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Count")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("a"))
+		w.Flush()
+		w.WriteChunkedBody([]byte("b"))
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(headers.Headers{"x-count": "2"})
+	default:
+		body := []byte(req.RequestLine.Method + " " + req.Headers.Get("host") + " " + string(req.Body) + req.Trailers.Get("x-sum"))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	// Test: Fixed-length responses are captured
+	rec := Record(echoHandler, NewRequest("POST", "/", []byte("data")))
+	assert.Equal(t, response.OK, rec.StatusCode)
+	assert.Equal(t, "21", rec.Headers.Get("Content-Length"))
+	assert.Equal(t, "POST example.com data", rec.Body.String())
+	assert.True(t, rec.Finished)
+
+	// Test: Chunked bodies, flushes and trailers are captured
+	rec = Record(echoHandler, NewRequest("GET", "/chunked", nil))
+	assert.Equal(t, "ab", rec.Body.String())
+	assert.Equal(t, 1, rec.Flushes)
+	assert.Equal(t, "2", rec.Trailers.Get("X-Count"))
+	assert.True(t, rec.Finished)
+
+	// Test: Handlers that never finish are visible
+	rec = Record(func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.NotFound)
+		w.WriteHeaders(headers.Headers{"transfer-encoding": "chunked"})
+	}, NewRequest("GET", "/", nil))
+	assert.Equal(t, response.NotFound, rec.StatusCode)
+	assert.False(t, rec.Finished)
+
+	// Test: Invalid headers are rejected as on a connection
+	rec = NewRecorder()
+	rec.Writer.WriteStatusLine(response.OK)
+	assert.Error(t, rec.Writer.WriteHeaders(headers.Headers{"bad key": "x"}))
+	assert.Nil(t, rec.Headers)
+
+	// Test: ReadFrom sends a fixed-length body and ends the stream
+	rec = NewRecorder()
+	rec.Writer.WriteStatusLine(response.OK)
+	rec.Writer.WriteHeaders(response.GetDefaultHeaders(5))
+	n, err := rec.Writer.ReadFrom(strings.NewReader("hello, world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, "hello", rec.Body.String())
+	assert.True(t, rec.Finished)
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(echoHandler)
+	defer s.Close()
+
+	// Test: Requests round trip over the wire
+	resp, err := s.RoundTrip(NewRequest("PUT", "/", []byte("body")))
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "PUT example.com body", string(resp.Body))
+
+	// Test: Trailers are sent with a chunked request body
+	req := NewRequest("POST", "/", []byte("x"))
+	req.Trailers = headers.Headers{"x-sum": "1"}
+	resp, err = s.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST example.com x1", string(resp.Body))
+
+	// Test: Chunked responses are decoded with their trailers
+	resp, err = s.RoundTrip(NewRequest("GET", "/chunked", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(resp.Body))
+	assert.Equal(t, "2", resp.Trailers.Get("X-Count"))
+
+	// Test: Malformed requests get the server's error response
+	resp, err = s.RoundTripRaw("GET / HTTP/1.1\r\nBad Header: x\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, response.BadRequest, resp.StatusLine.StatusCode)
+
+	// Test: Connections stay open between requests
+	conn, err := s.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	for i := 0; i < 2; i++ {
+		go WriteRequest(conn, NewRequest("GET", "/", nil))
+		resp, err := response.ResponseFromReader(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "GET example.com ", string(resp.Body))
+	}
+
+	// Test: WriteRequest output is deterministic
+	var b strings.Builder
+	require.NoError(t, WriteRequest(&b, NewRequest("POST", "/x", []byte("hi"))))
+	assert.Equal(t, "POST /x HTTP/1.1\r\ncontent-length: 2\r\nhost: example.com\r\n\r\nhi", b.String())
+}
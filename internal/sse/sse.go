@@ -0,0 +1,184 @@
+package sse
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidField is returned for an event name or id that would break the
+// line-based framing of the stream.
+var ErrInvalidField = errors.New("sse: invalid field")
+
+// ErrClosed is returned by writes after Close.
+var ErrClosed = errors.New("sse: stream closed")
+
+// Event is one message in an event stream. Empty fields are omitted; an
+// event with only Retry set just updates the client's reconnection delay.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// Stream writes Server-Sent Events as a chunked text/event-stream response.
+// Every event and comment is flushed immediately. Methods are safe for
+// concurrent use, so a heartbeat can run alongside the sender. Once the
+// handler returns the stream is closed for writing, even without Close.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{}
+}
+
+// NewStream starts the event stream response on w.
+func NewStream(w *response.Writer, req *request.Request) (*Stream, error) {
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		w:           w,
+		lastEventID: req.Headers.Get("Last-Event-ID"),
+		stop:        make(chan struct{}),
+	}
+	w.OnHandlerDone(s.abandon)
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID the client sent when reconnecting,
+// or "" on a first connection. Handlers use it to resume the stream.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Send writes and flushes ev. Multi-line data is split into one data field
+// per line, accepting CRLF, LF and CR line endings.
+func (s *Stream) Send(ev Event) error {
+	if strings.ContainsAny(ev.Event, "\r\n") {
+		return fmt.Errorf("%w: event name %q contains a line break", ErrInvalidField, ev.Event)
+	}
+	if strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return fmt.Errorf("%w: id %q contains a line break or NUL", ErrInvalidField, ev.ID)
+	}
+
+	var b strings.Builder
+	if ev.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", ev.ID)
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", ev.Event)
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+	if ev.Data != "" {
+		for _, line := range splitLines(ev.Data) {
+			fmt.Fprintf(&b, "data: %s\n", line)
+		}
+	}
+	b.WriteString("\n")
+
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore. Line breaks in text
+// start new comment lines.
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		fmt.Fprintf(&b, ": %s\n", line)
+	}
+	b.WriteString("\n")
+
+	return s.write(b.String())
+}
+
+// StartHeartbeat sends an empty comment every interval until Close or the
+// handler returns, which keeps idle connections from being dropped by
+// intermediaries.
+func (s *Stream) StartHeartbeat(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.write(":\n\n"); err != nil {
+					return
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the heartbeat and ends the chunked response.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+
+	_, err := s.w.WriteChunkedBodyDone()
+	return err
+}
+
+// abandon stops the heartbeat and further writes when the handler returns
+// without Close, before the server reuses the Writer. The body is left
+// unfinished, so the connection is closed after it.
+func (s *Stream) abandon() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+}
+
+func (s *Stream) write(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	if _, err := s.w.WriteChunkedBody([]byte(msg)); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+func splitLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return strings.Split(text, "\n")
+}
@@ -0,0 +1,138 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/servertest"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readEvent reads lines up to and including the blank line ending an event.
+func readEvent(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+
+	var b strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		b.WriteString(line)
+		if line == "\n" {
+			return b.String()
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	release := make(chan struct{})
+	lastIDs := make(chan string, 1)
+
+	s, err := server.ServeAddr("tcp", "127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		stream, err := NewStream(w, req)
+		if err != nil {
+			t.Errorf("new stream: %v", err)
+			return
+		}
+		defer stream.Close()
+		lastIDs <- stream.LastEventID()
+
+		stream.Send(Event{ID: "1", Event: "greeting", Data: "hello"})
+		stream.Send(Event{Data: "line one\nline two\r\nline three\rline four"})
+		stream.Send(Event{Retry: 2500 * time.Millisecond})
+		stream.Comment("just a comment")
+		stream.StartHeartbeat(20 * time.Millisecond)
+		<-release
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", "http://"+s.Addr().String()+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "41")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// Test: Response is an uncached chunked event stream
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	// Test: Last-Event-ID is read from the request
+	assert.Equal(t, "41", <-lastIDs)
+
+	// Test: Events arrive while the handler is still running
+	br := bufio.NewReader(resp.Body)
+	assert.Equal(t, "id: 1\nevent: greeting\ndata: hello\n\n", readEvent(t, br))
+
+	// Test: Every line ending style splits data into separate fields
+	assert.Equal(t, "data: line one\ndata: line two\ndata: line three\ndata: line four\n\n", readEvent(t, br))
+
+	// Test: Retry is sent in milliseconds
+	assert.Equal(t, "retry: 2500\n\n", readEvent(t, br))
+	assert.Equal(t, ": just a comment\n\n", readEvent(t, br))
+
+	// Test: Heartbeats are empty comments
+	assert.Equal(t, ":\n\n", readEvent(t, br))
+	assert.Equal(t, ":\n\n", readEvent(t, br))
+
+	// Test: Close ends the chunked body
+	close(release)
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Empty(t, strings.ReplaceAll(string(rest), ":\n\n", ""))
+}
+
+func TestStreamInvalidFields(t *testing.T) {
+	var buf bytes.Buffer
+	w := response.NewResponseWriter(&buf)
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+
+	stream, err := NewStream(w, req)
+	require.NoError(t, err)
+	assert.Empty(t, stream.LastEventID())
+
+	// Test: Line breaks in the event name or id are rejected
+	assert.ErrorIs(t, stream.Send(Event{Event: "a\nb", Data: "x"}), ErrInvalidField)
+	assert.ErrorIs(t, stream.Send(Event{ID: "1\r", Data: "x"}), ErrInvalidField)
+	assert.ErrorIs(t, stream.Send(Event{ID: "1\x00", Data: "x"}), ErrInvalidField)
+
+	// Test: Multi-line comments stay comments
+	require.NoError(t, stream.Comment("a\nb"))
+	assert.True(t, strings.HasSuffix(buf.String(), ": a\n: b\n\n\r\n"))
+
+	// Test: Writes after Close fail
+	require.NoError(t, stream.Close())
+	assert.ErrorIs(t, stream.Send(Event{Data: "late"}), ErrClosed)
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\n\r\n"))
+}
+
+func TestStreamHandlerReturn(t *testing.T) {
+	var stream *Stream
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Test: The heartbeat stops once the handler returns without Close
+	rec := servertest.Record(func(w *response.Writer, req *request.Request) {
+		stream, err = NewStream(w, req)
+		require.NoError(t, err)
+		stream.StartHeartbeat(time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+	}, req)
+	flushes := rec.Flushes
+	assert.Greater(t, flushes, 1)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, flushes, rec.Flushes)
+	assert.ErrorIs(t, stream.Send(Event{Data: "late"}), ErrClosed)
+	assert.False(t, rec.Finished)
+}
@@ -0,0 +1,543 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"unicode/utf8"
+)
+
+// MessageType is a frame opcode (RFC 6455 section 5.2).
+type MessageType byte
+
+const (
+	continuationFrame MessageType = 0x0
+
+	TextMessage   MessageType = 0x1
+	BinaryMessage MessageType = 0x2
+	CloseMessage  MessageType = 0x8
+	PingMessage   MessageType = 0x9
+	PongMessage   MessageType = 0xa
+)
+
+func (t MessageType) isControl() bool {
+	return t&0x8 != 0
+}
+
+// Close codes (RFC 6455 section 7.4.1).
+const (
+	CloseNormalClosure      = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatusReceived   = 1005
+	CloseAbnormalClosure    = 1006
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+const maxControlPayload = 125
+
+var (
+	ErrProtocol        = errors.New("websocket: protocol error")
+	ErrMessageTooBig   = errors.New("websocket: message too big")
+	ErrInvalidUTF8     = errors.New("websocket: invalid UTF-8 in text message")
+	ErrCloseSent       = errors.New("websocket: close frame already sent")
+	ErrInvalidCloseArg = errors.New("websocket: invalid close code or reason")
+)
+
+// CloseError is returned by ReadMessage once the peer has sent a close frame.
+// Code is CloseNoStatusReceived if the frame carried no status.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: close %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: close %d: %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. One goroutine may read and one may write
+// data messages at a time; control frames may be written concurrently with
+// either.
+type Conn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	isServer    bool
+	compress    bool
+	subprotocol string
+	maxSize     int64
+
+	// PongHandler, if set, is called with the payload of each pong received
+	// by ReadMessage. Pings are answered automatically.
+	PongHandler func(data []byte)
+
+	wmu       sync.Mutex
+	closeSent bool
+	readErr   error
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isServer, compress bool, maxSize int64) *Conn {
+	return &Conn{
+		conn:     conn,
+		br:       br,
+		isServer: isServer,
+		compress: compress,
+		maxSize:  maxSize,
+	}
+}
+
+// Subprotocol returns the negotiated subprotocol, or "" if none was.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Compressed reports whether permessage-deflate was negotiated.
+func (c *Conn) Compressed() bool {
+	return c.compress
+}
+
+// NetConn returns the underlying connection, for example to set deadlines.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// Close closes the underlying connection without a closing handshake. Use
+// WriteClose first for a clean shutdown.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	opcode MessageType
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+func (c *Conn) readFrameHeader() (frameHeader, error) {
+	var h frameHeader
+
+	var b [8]byte
+	if _, err := io.ReadFull(c.br, b[:2]); err != nil {
+		return h, err
+	}
+
+	h.fin = b[0]&0x80 != 0
+	h.rsv1 = b[0]&0x40 != 0
+	h.opcode = MessageType(b[0] & 0x0f)
+	h.masked = b[1]&0x80 != 0
+	h.length = int64(b[1] & 0x7f)
+
+	if b[0]&0x30 != 0 {
+		return h, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+
+	switch h.opcode {
+	case continuationFrame, TextMessage, BinaryMessage:
+	case CloseMessage, PingMessage, PongMessage:
+		if !h.fin {
+			return h, fmt.Errorf("%w: fragmented control frame", ErrProtocol)
+		}
+		if h.length > maxControlPayload {
+			return h, fmt.Errorf("%w: control frame payload too long", ErrProtocol)
+		}
+	default:
+		return h, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, byte(h.opcode))
+	}
+
+	if h.rsv1 && (!c.compress || h.opcode == continuationFrame || h.opcode.isControl()) {
+		return h, fmt.Errorf("%w: unexpected RSV1 bit", ErrProtocol)
+	}
+
+	if h.masked != c.isServer {
+		if c.isServer {
+			return h, fmt.Errorf("%w: unmasked client frame", ErrProtocol)
+		}
+		return h, fmt.Errorf("%w: masked server frame", ErrProtocol)
+	}
+
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(c.br, b[:2]); err != nil {
+			return h, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, b[:8]); err != nil {
+			return h, err
+		}
+		length := binary.BigEndian.Uint64(b[:8])
+		if length>>63 != 0 {
+			return h, fmt.Errorf("%w: invalid payload length", ErrProtocol)
+		}
+		h.length = int64(length)
+	}
+
+	if h.masked {
+		if _, err := io.ReadFull(c.br, h.mask[:]); err != nil {
+			return h, err
+		}
+	}
+
+	return h, nil
+}
+
+// ReadMessage returns the next text or binary message, reassembled from its
+// fragments and decompressed. Pings are answered and pongs passed to
+// PongHandler while waiting. When the peer closes the connection the close
+// frame is echoed and a *CloseError returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	msgType, data, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+	}
+	return msgType, data, err
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var (
+		msgType    MessageType
+		compressed bool
+		data       []byte
+	)
+
+	for {
+		h, err := c.readFrameHeader()
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		if !h.opcode.isControl() && int64(len(data))+h.length > c.maxSize {
+			return 0, nil, c.fail(ErrMessageTooBig)
+		}
+
+		payload := make([]byte, h.length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return 0, nil, err
+		}
+		if h.masked {
+			maskBytes(h.mask, payload)
+		}
+
+		switch h.opcode {
+		case PingMessage:
+			if err := c.WriteControl(PongMessage, payload); err != nil && !errors.Is(err, ErrCloseSent) {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if c.PongHandler != nil {
+				c.PongHandler(payload)
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(payload)
+		case continuationFrame:
+			if msgType == 0 {
+				return 0, nil, c.fail(fmt.Errorf("%w: continuation without a message", ErrProtocol))
+			}
+		default:
+			if msgType != 0 {
+				return 0, nil, c.fail(fmt.Errorf("%w: new message before final fragment", ErrProtocol))
+			}
+			msgType = h.opcode
+			compressed = h.rsv1
+		}
+
+		data = append(data, payload...)
+		if !h.fin {
+			continue
+		}
+
+		if compressed {
+			data, err = c.decompress(data)
+			if err != nil {
+				return 0, nil, c.fail(err)
+			}
+		}
+
+		if msgType == TextMessage && !utf8.Valid(data) {
+			return 0, nil, c.fail(ErrInvalidUTF8)
+		}
+
+		return msgType, data, nil
+	}
+}
+
+// handleClose validates a received close frame, echoes it if no close has
+// been sent yet and returns the resulting *CloseError.
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+
+	switch {
+	case len(payload) == 1:
+		return c.fail(fmt.Errorf("%w: truncated close code", ErrProtocol))
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(fmt.Errorf("%w: invalid close code %d", ErrProtocol, closeErr.Code))
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(ErrInvalidUTF8)
+		}
+	}
+
+	echo := closeErr.Code
+	if echo == CloseNoStatusReceived {
+		echo = CloseNormalClosure
+	}
+	if err := c.WriteClose(echo, ""); err != nil && !errors.Is(err, ErrCloseSent) {
+		return err
+	}
+
+	return closeErr
+}
+
+// fail sends a close frame matching err, as required when a frame violates
+// the protocol, and returns err. I/O errors are returned unchanged.
+func (c *Conn) fail(err error) error {
+	code := 0
+	switch {
+	case errors.Is(err, ErrProtocol):
+		code = CloseProtocolError
+	case errors.Is(err, ErrInvalidUTF8):
+		code = CloseInvalidPayload
+	case errors.Is(err, ErrMessageTooBig):
+		code = CloseMessageTooBig
+	}
+	if code != 0 {
+		c.WriteClose(code, "")
+	}
+	return err
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// deflateTail restores the sync flush marker stripped by the sender and
+// appends an empty final block so the reader ends cleanly
+// (RFC 7692 section 7.2.2).
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+func (c *Conn) decompress(data []byte) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail)))
+	defer fr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(fr, c.maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid compressed data: %v", ErrProtocol, err)
+	}
+	if int64(len(out)) > c.maxSize {
+		return nil, ErrMessageTooBig
+	}
+	return out, nil
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail[:4]), nil
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// writeFrame sends a single frame. Client frames are masked with a fresh
+// key as RFC 6455 section 5.3 requires.
+func (c *Conn) writeFrame(fin, rsv1 bool, opcode MessageType, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, b0)
+
+	var maskBit byte
+	if !c.isServer {
+		maskBit = 0x80
+	}
+
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.isServer {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	}
+
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// WriteMessage sends data as a single text or binary frame, compressed if
+// permessage-deflate was negotiated.
+func (c *Conn) WriteMessage(msgType MessageType, data []byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", msgType)
+	}
+
+	if c.compress {
+		compressed, err := compress(data)
+		if err != nil {
+			return err
+		}
+		return c.writeFrame(true, true, msgType, compressed)
+	}
+
+	return c.writeFrame(true, false, msgType, data)
+}
+
+// WriteControl sends a ping or pong frame. The payload is at most 125
+// bytes.
+func (c *Conn) WriteControl(msgType MessageType, data []byte) error {
+	if msgType != PingMessage && msgType != PongMessage {
+		return fmt.Errorf("websocket: invalid control message type %d", msgType)
+	}
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("websocket: control payload of %d bytes exceeds %d", len(data), maxControlPayload)
+	}
+
+	return c.writeFrame(true, false, msgType, data)
+}
+
+// WriteClose starts or completes the closing handshake with the given code
+// and reason. No further frames can be written afterwards.
+func (c *Conn) WriteClose(code int, reason string) error {
+	if !validCloseCode(code) || len(reason) > maxControlPayload-2 || !utf8.ValidString(reason) {
+		return ErrInvalidCloseArg
+	}
+
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+
+	return c.writeFrame(true, false, CloseMessage, payload)
+}
+
+// NextWriter returns a writer for a fragmented message. Without compression
+// each Write is sent as its own frame; with compression the message is
+// compressed and sent on Close. Close must be called to finish the message
+// before another data message is written.
+func (c *Conn) NextWriter(msgType MessageType) (io.WriteCloser, error) {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return nil, fmt.Errorf("websocket: invalid message type %d", msgType)
+	}
+
+	return &messageWriter{c: c, opcode: msgType}, nil
+}
+
+type messageWriter struct {
+	c       *Conn
+	opcode  MessageType
+	started bool
+	closed  bool
+	buf     []byte
+}
+
+func (mw *messageWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, fmt.Errorf("websocket: write to closed message writer")
+	}
+
+	if mw.c.compress {
+		mw.buf = append(mw.buf, p...)
+		return len(p), nil
+	}
+
+	if err := mw.c.writeFrame(false, false, mw.nextOpcode(), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (mw *messageWriter) Close() error {
+	if mw.closed {
+		return nil
+	}
+	mw.closed = true
+
+	if mw.c.compress {
+		return mw.c.WriteMessage(mw.opcode, mw.buf)
+	}
+
+	return mw.c.writeFrame(true, false, mw.nextOpcode(), nil)
+}
+
+func (mw *messageWriter) nextOpcode() MessageType {
+	if mw.started {
+		return continuationFrame
+	}
+	mw.started = true
+	return mw.opcode
+}
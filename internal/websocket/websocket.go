@@ -0,0 +1,170 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+)
+
+// acceptGUID is appended to Sec-WebSocket-Key to derive Sec-WebSocket-Accept
+// (RFC 6455 section 1.3).
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	supportedVersion      = "13"
+	defaultMaxMessageSize = 32 << 20
+)
+
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// Upgrader negotiates a WebSocket connection from an HTTP/1.1 request.
+type Upgrader struct {
+	// Subprotocols lists the application protocols the server supports, in
+	// order of preference. The first one the client also offers is selected.
+	Subprotocols []string
+	// EnableCompression accepts permessage-deflate (RFC 7692) when the
+	// client offers it.
+	EnableCompression bool
+	// MaxMessageSize limits the size of a reassembled, decompressed
+	// message. Zero means 32 MiB.
+	MaxMessageSize int64
+	// CheckOrigin, if set, rejects the handshake with 403 when it returns
+	// false.
+	CheckOrigin func(req *request.Request) bool
+}
+
+// Upgrade validates the opening handshake in req and switches the
+// connection to the WebSocket protocol. If the handshake is invalid an error
+// response is written and ErrBadHandshake is returned. The connection is
+// closed by the server when the handler returns.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	if status, err := u.checkHandshake(req); err != nil {
+		writeHandshakeError(w, status)
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(req.Headers.Get("Sec-WebSocket-Key")))
+
+	subprotocol := u.selectSubprotocol(req)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
+	compress := u.EnableCompression && offersDeflate(req.Headers.Get("Sec-WebSocket-Extensions"))
+	if compress {
+		h.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+
+	netConn, err := w.SwitchProtocols(h)
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize := u.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxMessageSize
+	}
+
+	c := newConn(netConn, bufio.NewReader(netConn), true, compress, maxSize)
+	c.subprotocol = subprotocol
+
+	return c, nil
+}
+
+// checkHandshake returns the status to reject req with, if any
+// (RFC 6455 section 4.2.1).
+func (u *Upgrader) checkHandshake(req *request.Request) (response.StatusCode, error) {
+	if req.RequestLine.Method != "GET" {
+		return response.BadRequest, fmt.Errorf("%w: method %s is not GET", ErrBadHandshake, req.RequestLine.Method)
+	}
+	if req.RequestLine.HttpVersion != "1.1" {
+		return response.BadRequest, fmt.Errorf("%w: HTTP/%s request", ErrBadHandshake, req.RequestLine.HttpVersion)
+	}
+	if !headers.HasToken(req.Headers.Get("Connection"), "upgrade") {
+		return response.BadRequest, fmt.Errorf("%w: Connection does not contain upgrade", ErrBadHandshake)
+	}
+	if !headers.HasToken(req.Headers.Get("Upgrade"), "websocket") {
+		return response.BadRequest, fmt.Errorf("%w: Upgrade does not contain websocket", ErrBadHandshake)
+	}
+	if v := req.Headers.Get("Sec-WebSocket-Version"); v != supportedVersion {
+		return response.UpgradeRequired, fmt.Errorf("%w: unsupported version %q", ErrBadHandshake, v)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(req.Headers.Get("Sec-WebSocket-Key"))
+	if err != nil || len(key) != 16 {
+		return response.BadRequest, fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrBadHandshake)
+	}
+
+	if u.CheckOrigin != nil && !u.CheckOrigin(req) {
+		return response.Forbidden, fmt.Errorf("%w: origin %q not allowed", ErrBadHandshake, req.Headers.Get("Origin"))
+	}
+
+	return 0, nil
+}
+
+func writeHandshakeError(w *response.Writer, status response.StatusCode) {
+	body := []byte(response.StatusText(status) + "\n")
+
+	w.WriteStatusLine(status)
+	h := response.GetDefaultHeaders(len(body))
+	if status == response.UpgradeRequired {
+		h.Set("Sec-WebSocket-Version", supportedVersion)
+		h.Set("Upgrade", "websocket")
+	}
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered := req.Headers.Get("Sec-WebSocket-Protocol")
+	if offered == "" {
+		return ""
+	}
+
+	for _, p := range u.Subprotocols {
+		if headers.HasToken(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// offersDeflate reports whether the client offered permessage-deflate with
+// parameters this server can honour. The compressor always uses a 32 KiB
+// window, so offers that restrict server_max_window_bits are skipped.
+func offersDeflate(extensions string) bool {
+	for _, offer := range strings.Split(extensions, ",") {
+		params := strings.Split(offer, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "permessage-deflate") {
+			continue
+		}
+
+		ok := true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "server_max_window_bits") && strings.Trim(value, `"`) != "15" {
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept value for a client's
+// Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
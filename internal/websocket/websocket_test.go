@@ -0,0 +1,290 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// startEcho serves an upgrader that echoes every message back until the
+// client closes.
+func startEcho(t *testing.T, u *Upgrader) string {
+	t.Helper()
+
+	s, err := server.ServeAddr("tcp", "127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		for {
+			msgType, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s.Addr().String()
+}
+
+// dial performs the opening handshake, sending extra right after the
+// request, and returns the client side of the connection.
+func dial(t *testing.T, addr, extraHeaders string, extra []byte) (*Conn, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	handshake := "GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + testKey + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		extraHeaders + "\r\n"
+	_, err = conn.Write(append([]byte(handshake), extra...))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+
+	compress := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	return newConn(conn, br, false, compress, defaultMaxMessageSize), resp
+}
+
+// readClose reads until the server's close frame arrives and returns its
+// code.
+func readClose(t *testing.T, c *Conn) int {
+	t.Helper()
+
+	_, _, err := c.ReadMessage()
+	var closeErr *CloseError
+	require.True(t, errors.As(err, &closeErr), "expected close, got %v", err)
+	return closeErr.Code
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Test: Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey(testKey))
+}
+
+func TestUpgrade(t *testing.T) {
+	addr := startEcho(t, &Upgrader{Subprotocols: []string{"chat.v2", "chat.v1"}})
+
+	// Test: Successful handshake with subprotocol selection by server preference
+	c, resp := dial(t, addr, "Sec-WebSocket-Protocol: chat.v1, chat.v2\r\n", nil)
+	require.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", resp.Header.Get("Connection"))
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "chat.v2", resp.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"))
+
+	// Test: Text and binary messages are echoed
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hello")))
+	msgType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, msgType)
+	assert.Equal(t, "hello", string(data))
+
+	big := bytes.Repeat([]byte{0, 1, 2, 3}, 20000)
+	require.NoError(t, c.WriteMessage(BinaryMessage, big))
+	msgType, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, msgType)
+	assert.Equal(t, big, data)
+
+	// Test: Pings are answered with a pong carrying the same payload
+	pongs := make(chan string, 1)
+	c.PongHandler = func(data []byte) { pongs <- string(data) }
+	require.NoError(t, c.WriteControl(PingMessage, []byte("are you there")))
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("after ping")))
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(data))
+	assert.Equal(t, "are you there", <-pongs)
+
+	// Test: Fragmented messages with an interleaved ping are reassembled
+	mw, err := c.NextWriter(TextMessage)
+	require.NoError(t, err)
+	mw.Write([]byte("frag"))
+	require.NoError(t, c.WriteControl(PingMessage, nil))
+	mw.Write([]byte("mented"))
+	require.NoError(t, mw.Close())
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "fragmented", string(data))
+
+	// Test: Closing handshake is echoed with the client's code
+	require.NoError(t, c.WriteClose(CloseNormalClosure, "bye"))
+	assert.Equal(t, CloseNormalClosure, readClose(t, c))
+	assert.ErrorIs(t, c.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+
+	// Test: No subprotocol is selected when none match
+	_, resp = dial(t, addr, "Sec-WebSocket-Protocol: other\r\n", nil)
+	require.Equal(t, 101, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	// Test: Frames sent in the same packet as the handshake are not lost
+	client := newConn(nil, nil, false, false, 0)
+	var early bytes.Buffer
+	client.conn = &writeOnlyConn{w: &early}
+	client.WriteMessage(TextMessage, []byte("early"))
+	c, resp = dial(t, addr, "", early.Bytes())
+	require.Equal(t, 101, resp.StatusCode)
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "early", string(data))
+}
+
+func TestUpgradeRejected(t *testing.T) {
+	addr := startEcho(t, &Upgrader{
+		CheckOrigin: func(req *request.Request) bool {
+			return req.Headers.Get("Origin") != "https://evil.example"
+		},
+	})
+
+	send := func(raw string) *http.Response {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, raw)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		return resp
+	}
+	base := "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+
+	// Test: Missing key is a bad request
+	resp := send(base + "Sec-WebSocket-Version: 13\r\n\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Test: Key must decode to 16 bytes
+	resp = send(base + "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: c2hvcnQ=\r\n\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Test: Unsupported version gets 426 advertising version 13
+	resp = send(base + "Sec-WebSocket-Version: 8\r\nSec-WebSocket-Key: " + testKey + "\r\n\r\n")
+	assert.Equal(t, 426, resp.StatusCode)
+	assert.Equal(t, "13", resp.Header.Get("Sec-WebSocket-Version"))
+
+	// Test: Plain requests without Upgrade are rejected
+	resp = send("GET /ws HTTP/1.1\r\nHost: localhost\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\n\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Test: CheckOrigin can refuse the handshake
+	resp = send(base + "Origin: https://evil.example\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\n\r\n")
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestCompression(t *testing.T) {
+	addr := startEcho(t, &Upgrader{EnableCompression: true})
+
+	// Test: permessage-deflate is negotiated without context takeover
+	c, resp := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n", nil)
+	require.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		resp.Header.Get("Sec-WebSocket-Extensions"))
+	require.True(t, c.Compressed())
+
+	// Test: Compressed messages round trip, including empty ones
+	for _, msg := range []string{strings.Repeat("compress me ", 5000), "", "short"} {
+		require.NoError(t, c.WriteMessage(TextMessage, []byte(msg)))
+		_, data, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(data))
+	}
+
+	// Test: Compressed payload is smaller on the wire
+	compressed, err := compress([]byte(strings.Repeat("compress me ", 5000)))
+	require.NoError(t, err)
+	assert.Less(t, len(compressed), 1000)
+
+	// Test: Offers restricting the server window are declined
+	_, resp = dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10\r\n", nil)
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"))
+
+	// Test: Compression is off unless the server enables it
+	addr = startEcho(t, &Upgrader{})
+	_, resp = dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate\r\n", nil)
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"))
+}
+
+func TestProtocolErrors(t *testing.T) {
+	addr := startEcho(t, &Upgrader{MaxMessageSize: 1024})
+
+	rawFrame := func(b0 byte, masked bool, payload []byte) []byte {
+		frame := []byte{b0, byte(len(payload))}
+		if masked {
+			frame[1] |= 0x80
+			frame = append(frame, 0, 0, 0, 0)
+		}
+		return append(frame, payload...)
+	}
+
+	// Test: Unmasked client frames fail the connection with 1002
+	c, _ := dial(t, addr, "", rawFrame(0x81, false, []byte("hi")))
+	assert.Equal(t, CloseProtocolError, readClose(t, c))
+
+	// Test: Invalid UTF-8 in a text message fails with 1007
+	c, _ = dial(t, addr, "", rawFrame(0x81, true, []byte{0xff, 0xfe}))
+	assert.Equal(t, CloseInvalidPayload, readClose(t, c))
+
+	// Test: Messages over MaxMessageSize fail with 1009
+	c, _ = dial(t, addr, "", nil)
+	assert.NoError(t, c.WriteMessage(BinaryMessage, make([]byte, 2048)))
+	assert.Equal(t, CloseMessageTooBig, readClose(t, c))
+
+	// Test: Fragmented control frames are rejected
+	c, _ = dial(t, addr, "", rawFrame(0x09, true, nil))
+	assert.Equal(t, CloseProtocolError, readClose(t, c))
+
+	// Test: RSV1 without negotiated compression is rejected
+	c, _ = dial(t, addr, "", rawFrame(0xc1, true, []byte("x")))
+	assert.Equal(t, CloseProtocolError, readClose(t, c))
+
+	// Test: Continuation without a first fragment is rejected
+	c, _ = dial(t, addr, "", rawFrame(0x80, true, []byte("x")))
+	assert.Equal(t, CloseProtocolError, readClose(t, c))
+
+	// Test: Invalid close codes are rejected
+	c, _ = dial(t, addr, "", rawFrame(0x88, true, []byte{0x03, 0xed}))
+	assert.Equal(t, CloseProtocolError, readClose(t, c))
+
+	// Test: Close without a status is answered with a normal closure
+	c, _ = dial(t, addr, "", rawFrame(0x88, true, nil))
+	assert.Equal(t, CloseNormalClosure, readClose(t, c))
+}
+
+// writeOnlyConn captures frames written by a Conn without a socket.
+type writeOnlyConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *writeOnlyConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}